@@ -0,0 +1,212 @@
+// Package client helps Go clients stay within the limits of the rate limiter.
+// Its Transport reads the rate limit headers of the responses, delays requests
+// locally once the advertised budget is spent and retries the requests denied
+// with 429 after their Retry-After.
+package client
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaxRetries is the number of retries of a denied request when
+// Transport.MaxRetries is zero
+const defaultMaxRetries = 3
+
+// Transport is an http.RoundTripper honoring the limits advertised by the
+// rate limiter. Budgets are tracked per host and API key, so a single
+// Transport can be shared by clients of several APIs or keys.
+//
+// Waiting for the budget or for a Retry-After ends with the context of the
+// request. Requests with a body are only retried when the body can be
+// replayed, see http.Request.GetBody.
+type Transport struct {
+	// Base performs the requests, http.DefaultTransport when nil
+	Base http.RoundTripper
+	// MaxRetries is the number of times a request denied with 429 is retried,
+	// 3 when zero and none when negative
+	MaxRetries int
+	// MaxWait caps the time a request waits for the budget or a Retry-After,
+	// zero waiting as long as advertised. A request that would wait longer is
+	// sent right away, and a denial that would is returned to the caller.
+	MaxWait time.Duration
+
+	mu      sync.Mutex
+	budgets map[string]*budget
+}
+
+// budget is the state of a limit as last advertised by the server
+type budget struct {
+	limit     int64
+	remaining int64
+	// resetAt is when the limit is fully restored
+	resetAt time.Time
+	// retryAt is when the server accepts requests again after a denial
+	retryAt time.Time
+}
+
+// RoundTrip waits until the budget of the request allows it, sends it and
+// retries it while it is denied with 429
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.Host + " " + req.Header.Get("API_KEY")
+	retries := t.MaxRetries
+	if retries == 0 {
+		retries = defaultMaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(req, key); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		retryAfter := t.update(key, resp)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= retries || !replayable(req) {
+			return resp, nil
+		}
+		if t.MaxWait > 0 && retryAfter > t.MaxWait {
+			return resp, nil
+		}
+
+		// Free the connection of the denied response before retrying
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// wait blocks until the budget of the key has room for the request, taking
+// one request from it
+func (t *Transport) wait(req *http.Request, key string) error {
+	for {
+		delay := t.reserve(key)
+		if delay <= 0 || (t.MaxWait > 0 && delay > t.MaxWait) {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes one request from the budget of the key, or returns how long
+// to wait until the budget may have room
+func (t *Transport) reserve(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.budgets[key]
+	if b == nil {
+		return 0
+	}
+	now := time.Now()
+	if now.Before(b.retryAt) {
+		return b.retryAt.Sub(now)
+	}
+	if b.remaining > 0 {
+		b.remaining--
+		return 0
+	}
+	if now.Before(b.resetAt) {
+		return b.resetAt.Sub(now)
+	}
+
+	// The window was reset, assume the full limit until told otherwise
+	b.remaining = b.limit - 1
+	return 0
+}
+
+// update records the budget advertised by the response and returns its
+// Retry-After
+func (t *Transport) update(key string, resp *http.Response) time.Duration {
+	limit, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Limit"), 10, 64)
+	if err != nil {
+		limit = -1
+	}
+	remaining, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Remaining"), 10, 64)
+	if err != nil {
+		remaining = -1
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		reset = -1
+	}
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if limit < 0 && retryAfter <= 0 {
+		// Not a response of the rate limiter
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.budgets == nil {
+		t.budgets = make(map[string]*budget)
+	}
+	b := t.budgets[key]
+	if b == nil {
+		b = &budget{}
+		t.budgets[key] = b
+	}
+
+	now := time.Now()
+	if limit >= 0 && remaining >= 0 && reset >= 0 {
+		b.limit, b.remaining = limit, remaining
+		b.resetAt = now.Add(time.Duration(reset) * time.Second)
+	}
+	if retryAfter > 0 {
+		b.retryAt = now.Add(retryAfter)
+	}
+	return retryAfter
+}
+
+// parseRetryAfter parses a Retry-After in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// replayable reports whether the request can be sent again
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewind returns a copy of the request with a fresh body to send it again
+func rewind(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportStaysWithinBudget(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules:   limiter.Rules{IPPolicy: limiter.Policy{Limit: 2, Window: time.Second}},
+	})
+	var served atomic.Int64
+	handler := middleware.NewRateLimiterMiddleware(rl, middleware.IPExtractor{}, nil).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{MaxRetries: -1}}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+	}
+
+	// Without retries, every request succeeded by waiting for the window
+	assert.Equal(t, int64(5), served.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestTransportRetriesAfterRetryAfter(t *testing.T) {
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "payload", string(body))
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+	start := time.Now()
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(2), calls.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestTransportGivesUp(t *testing.T) {
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	t.Run("retry after above the maximum wait", func(t *testing.T) {
+		client := &http.Client{Transport: &Transport{MaxWait: time.Second}}
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, int64(1), calls.Load())
+	})
+
+	t.Run("context canceled while waiting", func(t *testing.T) {
+		client := &http.Client{Transport: &Transport{}}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+
+		_, err = client.Do(req)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Zero(t, parseRetryAfter(""))
+	assert.Zero(t, parseRetryAfter("soon"))
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, time.Minute, parseRetryAfter(date), float64(2*time.Second))
+}
@@ -0,0 +1,66 @@
+// Command apikey creates the API keys verified by the rate limiter.
+//
+//	apikey generate <id>                    prints a new key and the hash to register for the id
+//	apikey sign [-ttl 720h] <id>            prints a key for the id signed with the first secret of API_SIGNING_SECRETS
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		key, hash, err := apikey.Generate(os.Args[2])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("key:  %s\nhash: %s\n", key, hash)
+	case "sign":
+		flags := flag.NewFlagSet("sign", flag.ExitOnError)
+		ttl := flags.Duration("ttl", 30*24*time.Hour, "validity of the key")
+		secretEnv := flags.String("secret-env", "API_SIGNING_SECRETS", "environment variable holding the signing secret, the first of the list")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			usage()
+		}
+
+		// The newest secret comes first, without its expiry
+		secret, _, _ := strings.Cut(os.Getenv(*secretEnv), ",")
+		secret, _, _ = strings.Cut(strings.TrimSpace(secret), "@")
+		if secret == "" {
+			fail(fmt.Errorf("%s is not set", *secretEnv))
+		}
+		key, err := apikey.Sign([]byte(secret), flags.Arg(0), time.Now().Add(*ttl))
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(key)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apikey generate <id>")
+	fmt.Fprintln(os.Stderr, "       apikey sign [-ttl 720h] [-secret-env API_SIGNING_SECRETS] <id>")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "apikey:", err)
+	os.Exit(1)
+}
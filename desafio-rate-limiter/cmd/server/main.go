@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/admin"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/audit"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/config"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/metrics"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/policy"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/rls"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -25,52 +34,157 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize storage (Redis)
-	redisAddr := fmt.Sprintf("%s:%s", cfg.Redis.Host, cfg.Redis.Port)
-	store, err := storage.NewRedisStorage(redisAddr, cfg.Redis.Password, cfg.Redis.DB)
+	// Initialize storage
+	store, err := storage.FromConfig(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize Redis storage: %v", err)
+		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 	defer store.Close()
+	if cfg.StorageBackend == "memory" {
+		log.Println("Using in-memory storage")
+	} else {
+		log.Printf("Connected to Redis successfully (%s mode, %s)", cfg.Redis.Mode, strings.Join(cfg.Redis.Addrs, ","))
+	}
+	if cfg.KeyPrefix != "" {
+		log.Printf("Storage Key Prefix: %s", cfg.KeyPrefix)
+	}
 
-	log.Println("Connected to Redis successfully")
+	failureMode, err := limiter.ParseFailureMode(cfg.FailureMode)
+	if err != nil {
+		log.Fatalf("Invalid failure mode: %v", err)
+	}
+	limiterConfig := limiter.Config{Storage: store, FailureMode: failureMode}
+	if failureMode == limiter.FailLocal {
+		fallback := storage.NewMemoryStorage(time.Minute)
+		defer fallback.Close()
+		limiterConfig.Fallback = fallback
+	}
+
+	// Write the audit events of denials and blocks to the configured sink
+	switch cfg.AuditSink {
+	case "stdout":
+		limiterConfig.Audit = audit.NewWriterSink(os.Stdout)
+	case "file":
+		sink, err := audit.NewFileSink(cfg.AuditFile, cfg.AuditFileMaxBytes, cfg.AuditFileMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to initialize audit sink: %v", err)
+		}
+		defer sink.Close()
+		limiterConfig.Audit = sink
+	}
+	if cfg.AuditSink != "" {
+		limiterConfig.AuditHashKey = []byte(cfg.AuditHashKey)
+		if cfg.AuditHashKey == "" {
+			// Without a configured secret, the hashes of a key differ between
+			// instances and restarts
+			limiterConfig.AuditHashKey = make([]byte, 32)
+			if _, err := rand.Read(limiterConfig.AuditHashKey); err != nil {
+				log.Fatalf("Failed to generate audit hash key: %v", err)
+			}
+			log.Printf("AUDIT_HASH_KEY not set, hashing the audit keys with a random secret")
+		}
+	}
+
+	// Instrument the storage and the decisions when metrics are enabled
+	var m *metrics.Metrics
+	if cfg.MetricsEnabled {
+		m = metrics.NewMetrics()
+		if cfg.MetricsBlocksRefresh > 0 {
+			m.RegisterBlocks(store, cfg.MetricsBlocksRefresh)
+		}
+		store = m.InstrumentStorage(store)
+		limiterConfig.Storage = store
+		limiterConfig.Observer = m
+	}
 
 	// Initialize rate limiter
-	rateLimiter := limiter.NewRateLimiter(limiter.Config{
-		Storage:       store,
-		IPLimit:       cfg.RateLimitIP,
-		BlockDuration: time.Duration(cfg.BlockDuration) * time.Second,
-		TokenLimits:   cfg.TokenLimits,
-	})
+	rateLimiter := limiter.NewRateLimiter(limiterConfig)
+
+	// Load rate limit policies from the policy file, watching it for changes,
+	// or from the environment
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	// Defaults of the tokens registered through the admin API
+	defaults := func() policy.Defaults { return policy.EnvDefaults(cfg) }
+	if cfg.PolicyFile != "" {
+		watcher, err := policy.NewWatcher(cfg.PolicyFile, cfg.PolicyReloadInterval, rateLimiter)
+		if err != nil {
+			log.Fatalf("Failed to load policy file: %v", err)
+		}
+		defaults = watcher.Defaults
+		go watcher.Run(watchCtx)
+	} else {
+		rules, err := policy.FromConfig(cfg)
+		if err != nil {
+			log.Fatalf("Invalid rate limit configuration: %v", err)
+		}
+		rateLimiter.SetRules(rules)
+	}
+	rules := rateLimiter.Rules()
 
-	// Initialize middleware
-	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter)
+	// Initialize middleware, charging large bodies more when configured
+	var cost middleware.CostFunc
+	if cfg.BodyCostBytes > 0 {
+		cost = middleware.BodyCost(cfg.BodyCostBytes, cfg.BodyMaxBytes)
+	}
+	ipExtractor := middleware.IPExtractor{
+		TrustedProxies:   cfg.TrustedProxies,
+		IPv6PrefixLength: cfg.IPv6PrefixLength,
+	}
+	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter, ipExtractor, cost)
 
 	// Setup router
 	r := chi.NewRouter()
 
 	// Middleware
+	r.Use(chimiddleware.RequestID)
 	r.Use(chimiddleware.Logger)
 	r.Use(chimiddleware.Recoverer)
-	r.Use(rateLimiterMiddleware.Handle)
 
-	// Routes
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"message": "Rate Limiter API", "status": "ok"}`))
-	})
+	// Admin API, not subject to rate limiting
+	if cfg.AdminToken != "" {
+		r.Mount("/admin", admin.NewHandler(rateLimiter, store, cfg.AdminToken, defaults).Routes())
+	}
 
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "healthy"}`))
-	})
+	// Metrics, not subject to rate limiting
+	if m != nil {
+		r.Handle("/metrics", m.Handler())
+	}
+
+	// Decision of requests served elsewhere, e.g. by an Envoy ext_authz filter
+	// or an nginx auth_request: /check/api/test checks a request to /api/test
+	if cfg.CheckEnabled {
+		r.Handle("/check/*", http.StripPrefix("/check", rateLimiterMiddleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status": "allowed"}`))
+		}))))
+	}
+
+	// Unknown routes are rate limited as well
+	r.NotFound(rateLimiterMiddleware.Handle(http.NotFoundHandler()).ServeHTTP)
+
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimiterMiddleware.Handle)
+
+		// Routes
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"message": "Rate Limiter API", "status": "ok"}`))
+		})
 
-	r.Get("/api/test", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"message": "Test endpoint", "timestamp": "` + time.Now().Format(time.RFC3339) + `"}`))
+		r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status": "healthy"}`))
+		})
+
+		r.Get("/api/test", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"message": "Test endpoint", "timestamp": "` + time.Now().Format(time.RFC3339) + `"}`))
+		})
 	})
 
 	// Create server
@@ -82,13 +196,89 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Envoy rate limit service sharing the policies and storage of the server
+	var grpcServer *grpc.Server
+	if cfg.RLSAddr != "" {
+		listener, err := net.Listen("tcp", cfg.RLSAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen for the rate limit service: %v", err)
+		}
+		grpcServer = grpc.NewServer()
+		rlsv3.RegisterRateLimitServiceServer(grpcServer, rls.NewServer(rateLimiter, ipExtractor))
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("Rate limit service failed: %v", err)
+			}
+		}()
+	}
+
 	// Start server in a goroutine
 	go func() {
 		log.Printf("Starting server on port 8080...")
 		log.Printf("Rate Limiter Configuration:")
-		log.Printf("  - IP Limit: %d requests/second", cfg.RateLimitIP)
-		log.Printf("  - Block Duration: %d seconds", cfg.BlockDuration)
-		log.Printf("  - Registered Tokens with Limits: %v", cfg.TokenLimits)
+		if cfg.PolicyFile != "" {
+			log.Printf("  - Policy File: %s (reloaded every %s)", cfg.PolicyFile, cfg.PolicyReloadInterval)
+		}
+		log.Printf("  - IP Limit: %d requests/%s (%s)", rules.IPPolicy.Limit, rules.IPPolicy.Window, rules.IPPolicy.Algorithm.Name())
+		if rules.IPPolicy.DryRun {
+			log.Printf("  - IP Limit Dry Run: denials are logged, not enforced")
+		}
+		if shadow := rules.IPPolicy.Shadow; shadow != nil {
+			log.Printf("  - IP Shadow Limit: %d requests/%s, denials are logged, not enforced", shadow.Limit, shadow.Window)
+		}
+		if rules.IPPolicy.Concurrency > 0 {
+			log.Printf("  - IP Concurrency: %d requests in flight", rules.IPPolicy.Concurrency)
+		}
+		log.Printf("  - Block Duration: %s", rules.IPPolicy.BlockDuration)
+		log.Printf("  - Registered Tokens: %d", len(rules.TokenPolicies))
+		if len(rules.KeyPolicies) > 0 {
+			log.Printf("  - Registered API Keys: %d", len(rules.KeyPolicies))
+		}
+		if len(rules.Tenants) > 0 {
+			log.Printf("  - Tenants: %d", len(rules.Tenants))
+		}
+		log.Printf("  - Trusted Proxies: %v", cfg.TrustedProxies)
+		log.Printf("  - Failure Mode: %s", failureMode)
+		if cfg.AdminToken != "" {
+			log.Printf("  - Admin API: enabled on /admin")
+		}
+		if cfg.MetricsEnabled {
+			log.Printf("  - Metrics: enabled on /metrics")
+		}
+		if cfg.CheckEnabled {
+			log.Printf("  - Check Endpoint: enabled on /check/*")
+		}
+		if cfg.RLSAddr != "" {
+			log.Printf("  - Rate Limit Service: enabled on %s", cfg.RLSAddr)
+		}
+		switch cfg.AuditSink {
+		case "stdout":
+			log.Printf("  - Audit Log: stdout")
+		case "file":
+			log.Printf("  - Audit Log: %s (rotated at %d bytes, %d backups)", cfg.AuditFile, cfg.AuditFileMaxBytes, cfg.AuditFileMaxBackups)
+		}
+		for _, network := range rules.NetworkPolicies {
+			switch {
+			case network.Action != limiter.NetworkLimit:
+				log.Printf("  - Network %s: %s", network.Prefix, network.Action)
+			case network.Shared:
+				log.Printf("  - Network %s: %d requests/%s shared", network.Prefix, network.Policy.Limit, network.Policy.Window)
+			default:
+				log.Printf("  - Network %s: %d requests/%s", network.Prefix, network.Policy.Limit, network.Policy.Window)
+			}
+		}
+		for _, route := range rules.RoutePolicies {
+			log.Printf("  - Route %s: %d requests/%s", route.Name(), route.Policy.Limit, route.Policy.Window)
+			if route.Policy.Concurrency > 0 {
+				log.Printf("  - Route %s Concurrency: %d requests in flight", route.Name(), route.Policy.Concurrency)
+			}
+		}
+		for _, cost := range rules.RouteCosts {
+			log.Printf("  - Route Cost %s %s: %d units", cost.Method, cost.Pattern, cost.Cost)
+		}
+		if cfg.BodyCostBytes > 0 {
+			log.Printf("  - Body Cost: 1 unit per %d bytes", cfg.BodyCostBytes)
+		}
 
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
@@ -105,6 +295,10 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
@@ -0,0 +1,35 @@
+package grpclimit_test
+
+import (
+	"log"
+	"net"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/grpclimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// The interceptors read the policies and the storage from the same
+// environment as the server, e.g. REDIS_HOST and RATE_LIMIT_POLICY_FILE
+func ExampleNewFromEnv() {
+	interceptor, err := grpclimit.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure the rate limiter: %v", err)
+	}
+	defer interceptor.Close()
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	listener, err := net.Listen("tcp", ":50051")
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
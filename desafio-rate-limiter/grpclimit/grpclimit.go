@@ -0,0 +1,240 @@
+// Package grpclimit applies the rate limiter to the calls of gRPC servers,
+// with the policies and storage of the HTTP middleware. NewFromEnv configures
+// the interceptors from the environment like the server, so that other
+// modules can protect their gRPC servers with the same limits.
+package grpclimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/config"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/policy"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Method is the request method of gRPC calls, which are HTTP/2 POSTs.
+// Per-method policies are route policies matching the full method name of the
+// call, e.g. "/helloworld.Greeter/SayHello" or "/helloworld.Greeter/*".
+const Method = http.MethodPost
+
+// apiKeyMetadata is the metadata key of the API key, the gRPC form of the
+// API_KEY header
+const apiKeyMetadata = "api_key"
+
+// requestIDMetadata is the metadata key identifying the call in the audit
+// events
+const requestIDMetadata = "x-request-id"
+
+// tenantMetadata is the metadata key of the tenant, the gRPC form of the
+// middleware.TenantHeader header, only honored on calls from trusted proxies
+const tenantMetadata = "x-tenant-id"
+
+// Interceptor applies the rate limiter to the calls of a gRPC server
+type Interceptor struct {
+	limiter     *limiter.RateLimiter
+	ipExtractor middleware.IPExtractor
+	// close releases what NewFromEnv created
+	close func() error
+}
+
+// New creates the interceptors of a rate limiter, extracting the client IP of
+// the calls like the HTTP middleware
+func New(limiter *limiter.RateLimiter, ipExtractor middleware.IPExtractor) *Interceptor {
+	return &Interceptor{
+		limiter:     limiter,
+		ipExtractor: ipExtractor,
+		close:       func() error { return nil },
+	}
+}
+
+// NewFromEnv creates the interceptors from the same environment variables
+// and .env file as the server: the storage, the failure mode, the trusted
+// proxies and the policies, from the policy file, watched for changes, or
+// from the environment. Audit events and metrics are only written by the
+// server. Close releases the storage once the gRPC server stopped.
+func NewFromEnv() (*Interceptor, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	failureMode, err := limiter.ParseFailureMode(cfg.FailureMode)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	limiterConfig := limiter.Config{Storage: store, FailureMode: failureMode}
+	closers := []func() error{store.Close}
+	if failureMode == limiter.FailLocal {
+		fallback := storage.NewMemoryStorage(time.Minute)
+		limiterConfig.Fallback = fallback
+		closers = append(closers, fallback.Close)
+	}
+	rl := limiter.NewRateLimiter(limiterConfig)
+
+	ctx, stopWatching := context.WithCancel(context.Background())
+	closers = append(closers, func() error { stopWatching(); return nil })
+	closeAll := func() error {
+		var firstErr error
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	if cfg.PolicyFile != "" {
+		watcher, err := policy.NewWatcher(cfg.PolicyFile, cfg.PolicyReloadInterval, rl)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		go watcher.Run(ctx)
+	} else {
+		rules, err := policy.FromConfig(cfg)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		rl.SetRules(rules)
+	}
+
+	interceptor := New(rl, middleware.IPExtractor{
+		TrustedProxies:   cfg.TrustedProxies,
+		IPv6PrefixLength: cfg.IPv6PrefixLength,
+	})
+	interceptor.close = closeAll
+	return interceptor, nil
+}
+
+// Close stops watching the policy file and closes the storage of the
+// interceptors created by NewFromEnv. The rate limiter given to New is left
+// to its owner.
+func (i *Interceptor) Close() error {
+	return i.close()
+}
+
+// Unary returns the interceptor checking every unary call
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		decision, err := i.check(ctx, info.FullMethod, func(md metadata.MD) error { return grpc.SetHeader(ctx, md) })
+		if err != nil {
+			return nil, err
+		}
+		defer i.limiter.Release(context.WithoutCancel(ctx), decision)
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns the interceptor checking every stream when it is opened.
+// Messages exchanged on an allowed stream are not limited, and the stream
+// holds its concurrency slots until it ends.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		decision, err := i.check(ss.Context(), info.FullMethod, ss.SetHeader)
+		if err != nil {
+			return err
+		}
+		defer i.limiter.Release(context.WithoutCancel(ss.Context()), decision)
+		return handler(srv, ss)
+	}
+}
+
+// check limits the call and reports the limit through the header metadata.
+// The returned error is the status of the rejected call, and the decision of
+// an accepted call must be released once it completes.
+func (i *Interceptor) check(ctx context.Context, fullMethod string, setHeader func(metadata.MD) error) (limiter.Decision, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// Build the request seen by the IP extractor, so that forwarding metadata
+	// is only honored for trusted proxies like the equivalent HTTP headers
+	r := &http.Request{Header: http.Header{}}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"} {
+		if values := md.Get(name); len(values) > 0 {
+			r.Header[name] = values
+		}
+	}
+
+	var token string
+	if values := md.Get(apiKeyMetadata); len(values) > 0 {
+		token = values[0]
+	}
+	var id string
+	if values := md.Get(requestIDMetadata); len(values) > 0 {
+		id = values[0]
+	}
+	var tenant string
+	if values := md.Get(tenantMetadata); len(values) > 0 && i.ipExtractor.FromTrustedProxy(r) {
+		tenant = values[0]
+	}
+
+	decision, err := i.limiter.Allow(ctx, limiter.Request{
+		IP:     i.ipExtractor.ClientIP(r),
+		Token:  token,
+		Method: Method,
+		Path:   fullMethod,
+		ID:     id,
+		Tenant: tenant,
+	})
+	if err != nil {
+		return limiter.Decision{}, status.Error(codes.Internal, "internal server error")
+	}
+
+	// If token was provided but is invalid or not registered
+	if decision.Forbidden {
+		return limiter.Decision{}, status.Error(codes.PermissionDenied, "invalid API key")
+	}
+
+	// If the client network is denylisted
+	if decision.Denied {
+		return limiter.Decision{}, status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	// Allowlisted networks are not limited
+	if decision.Exempt {
+		return decision, nil
+	}
+
+	header := http.Header{}
+	middleware.SetRateLimitHeaders(header, decision)
+	// The limit is informative, a call is not failed for missing header metadata
+	_ = setHeader(headerMetadata(header))
+
+	if !decision.Allowed {
+		message := "you have reached the maximum number of requests or actions allowed within a certain time frame"
+		if decision.ConcurrencyLimited {
+			message = "too many concurrent requests"
+		}
+		st := status.New(codes.ResourceExhausted, message)
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(decision.RetryAfter)}); err == nil {
+			st = detailed
+		}
+		return limiter.Decision{}, st.Err()
+	}
+	return decision, nil
+}
+
+// headerMetadata converts HTTP headers into gRPC metadata, whose keys are lowercase
+func headerMetadata(header http.Header) metadata.MD {
+	md := make(metadata.MD, len(header))
+	for name, values := range header {
+		md.Set(name, values...)
+	}
+	return md
+}
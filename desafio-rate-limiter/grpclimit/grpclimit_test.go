@@ -0,0 +1,129 @@
+package grpclimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestInterceptor(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules: limiter.Rules{
+			IPPolicy:      limiter.Policy{Limit: 2, Window: time.Minute},
+			TokenPolicies: map[string]limiter.Policy{"abc123": {Limit: 5, Window: time.Minute}},
+			RoutePolicies: []limiter.RoutePolicy{
+				{Method: Method, Pattern: "/grpc.health.v1.Health/Watch", Policy: limiter.Policy{Limit: 1, Window: time.Minute}},
+			},
+		},
+	})
+	interceptor := New(rl, middleware.IPExtractor{})
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(ctx context.Context) (metadata.MD, error) {
+		var header metadata.MD
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		return header, err
+	}
+
+	t.Run("unary calls are limited by IP", func(t *testing.T) {
+		ctx := context.Background()
+		for i := 0; i < 2; i++ {
+			header, err := check(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"2"}, header.Get("x-ratelimit-limit"))
+		}
+
+		header, err := check(ctx)
+		st := status.Convert(err)
+		assert.Equal(t, codes.ResourceExhausted, st.Code())
+		assert.Equal(t, []string{"0"}, header.Get("x-ratelimit-remaining"))
+		require.Len(t, st.Details(), 1)
+		retry, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		assert.Positive(t, retry.RetryDelay.AsDuration())
+	})
+
+	t.Run("API key from metadata", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", "abc123")
+		header, err := check(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"5"}, header.Get("x-ratelimit-limit"))
+	})
+
+	t.Run("unknown API key is denied", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", "unknown")
+		_, err := check(ctx)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("streams are limited by method policy", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", "abc123")
+		for _, want := range []codes.Code{codes.OK, codes.ResourceExhausted} {
+			ctx, cancel := context.WithCancel(ctx)
+			stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			cancel()
+			assert.Equal(t, want, status.Code(err))
+		}
+	})
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "memory")
+	t.Setenv("RATE_LIMIT_IP", "5")
+	t.Setenv("RATE_LIMIT_ROUTES", "/grpc.health.v1.Health/Check=1/1m")
+	interceptor, err := NewFromEnv()
+	require.NoError(t, err)
+	defer interceptor.Close()
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}})
+	setHeader := func(metadata.MD) error { return nil }
+	// Route policies match the full method of the calls
+	_, err = interceptor.check(ctx, "/grpc.health.v1.Health/Check", setHeader)
+	require.NoError(t, err)
+	_, err = interceptor.check(ctx, "/grpc.health.v1.Health/Check", setHeader)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = interceptor.check(ctx, "/grpc.health.v1.Health/Watch", setHeader)
+	assert.NoError(t, err)
+
+	t.Setenv("STORAGE_BACKEND", "disk")
+	_, err = NewFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,346 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/policy"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+)
+
+// Handler serves the admin API used to manage tokens, counters and blocks of
+// the rate limiter at runtime. Every request must carry the admin token in the
+// Authorization header as a bearer token. Plaintext tokens are only accepted
+// in request bodies and never returned, tokens are addressed by their id (see
+// limiter.TokenID) so that they are not written to access logs.
+type Handler struct {
+	limiter  *limiter.RateLimiter
+	storage  storage.Storage
+	token    string
+	defaults func() policy.Defaults
+}
+
+// NewHandler creates the handler. defaults returns the defaults of the
+// configured policies, completing the policies of the registered tokens.
+func NewHandler(rl *limiter.RateLimiter, store storage.Storage, token string, defaults func() policy.Defaults) *Handler {
+	return &Handler{
+		limiter:  rl,
+		storage:  store,
+		token:    token,
+		defaults: defaults,
+	}
+}
+
+// Routes returns the admin API router
+func (h *Handler) Routes() http.Handler {
+	r := chi.NewRouter()
+	r.Use(h.authenticate)
+
+	r.Get("/tokens", h.listTokens)
+	r.Post("/tokens", h.putToken)
+	r.Delete("/tokens/{id}", h.deleteToken)
+
+	r.Get("/keys", h.getKey)
+	r.Get("/keys/{type}/{id}", h.getKey)
+
+	r.Get("/blocks", h.listBlocks)
+	r.Post("/blocks", h.createBlock)
+	r.Delete("/blocks", h.deleteBlock)
+	r.Delete("/blocks/{type}/{id}", h.deleteBlock)
+
+	return r
+}
+
+type policyResponse struct {
+	Limit         int    `json:"limit"`
+	Window        string `json:"window"`
+	Algorithm     string `json:"algorithm"`
+	BlockDuration string `json:"block_duration"`
+	// BlockMultiplier escalates the blocks repeated within BlockLookback
+	BlockMultiplier  float64         `json:"block_multiplier"`
+	MaxBlockDuration string          `json:"max_block_duration"`
+	BlockLookback    string          `json:"block_lookback"`
+	Quotas           []quotaResponse `json:"quotas,omitempty"`
+	// Concurrency caps the requests in flight, zero does not cap them
+	Concurrency  int    `json:"concurrency"`
+	LeaseTimeout string `json:"lease_timeout,omitempty"`
+	DryRun       bool   `json:"dry_run"`
+	// Shadow is the candidate policy evaluated in dry-run mode next to this one
+	Shadow *policyResponse `json:"shadow,omitempty"`
+}
+
+type quotaResponse struct {
+	Limit  int    `json:"limit"`
+	Window string `json:"window"`
+}
+
+type tokenRequest struct {
+	Token string `json:"token"`
+	policy.Spec
+}
+
+type tokenResponse struct {
+	// ID identifies the token in the admin API and the storage keys
+	ID     string         `json:"id"`
+	Policy policyResponse `json:"policy"`
+}
+
+type counterResponse struct {
+	Algorithm string            `json:"algorithm"`
+	Fields    map[string]string `json:"fields"`
+	TTL       string            `json:"ttl"`
+}
+
+type keyResponse struct {
+	Key      string            `json:"key"`
+	Counters []counterResponse `json:"counters"`
+	Blocked  bool              `json:"blocked"`
+	BlockTTL string            `json:"block_ttl,omitempty"`
+	// Offenses is the number of times the key was blocked within the lookback
+	Offenses int64 `json:"offenses"`
+	// InFlight is the number of requests holding a lease on the key
+	InFlight int64 `json:"in_flight"`
+}
+
+type blockResponse struct {
+	Key      string `json:"key"`
+	TTL      string `json:"ttl"`
+	Offenses int64  `json:"offenses"`
+}
+
+type blockRequest struct {
+	// Key is a storage key as returned by GET /blocks, replacing Type, ID and
+	// Tenant
+	Key      string          `json:"key,omitempty"`
+	Type     string          `json:"type"`
+	ID       string          `json:"id"`
+	Tenant   string          `json:"tenant,omitempty"`
+	Duration policy.Duration `json:"duration"`
+}
+
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) listTokens(w http.ResponseWriter, r *http.Request) {
+	tokens := make([]tokenResponse, 0, len(h.limiter.Rules().TokenPolicies))
+	for token, policy := range h.limiter.Rules().TokenPolicies {
+		tokens = append(tokens, tokenResponse{ID: limiter.TokenID(token), Policy: newPolicyResponse(policy)})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (h *Handler) putToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+	tokenPolicy, err := h.defaults().TokenPolicy(req.Spec)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.limiter.SetTokenPolicy(req.Token, tokenPolicy)
+	writeJSON(w, http.StatusOK, tokenResponse{ID: limiter.TokenID(req.Token), Policy: newPolicyResponse(tokenPolicy)})
+}
+
+func (h *Handler) deleteToken(w http.ResponseWriter, r *http.Request) {
+	if !h.limiter.RemoveToken(chi.URLParam(r, "id")) {
+		writeError(w, http.StatusNotFound, "token not registered")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	state, err := h.storage.Inspect(r.Context(), key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := keyResponse{Key: key, Counters: make([]counterResponse, 0, len(state.Counters)), Blocked: state.Blocked, Offenses: state.Offenses, InFlight: state.InFlight}
+	for _, counter := range state.Counters {
+		response.Counters = append(response.Counters, counterResponse{
+			Algorithm: counter.Algorithm,
+			Fields:    counter.Fields,
+			TTL:       counter.TTL.String(),
+		})
+	}
+	if state.Blocked {
+		response.BlockTTL = state.BlockTTL.String()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) listBlocks(w http.ResponseWriter, r *http.Request) {
+	blocks, err := h.storage.Blocks(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := make([]blockResponse, 0, len(blocks))
+	for _, block := range blocks {
+		response = append(response, blockResponse{Key: block.Key, TTL: block.TTL.String(), Offenses: block.Offenses})
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Key < response[j].Key })
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) createBlock(w http.ResponseWriter, r *http.Request) {
+	var req blockRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := parseKey(req.Key)
+	if req.Key == "" {
+		key, err = keyFromParams(req.Tenant, req.Type, req.ID)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	duration := time.Duration(req.Duration)
+	if duration <= 0 {
+		writeError(w, http.StatusBadRequest, "duration must be positive")
+		return
+	}
+
+	if err := h.storage.SetBlock(r.Context(), key, duration); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, blockResponse{Key: key, TTL: duration.String()})
+}
+
+func (h *Handler) deleteBlock(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	unblocked, err := h.storage.Unblock(r.Context(), key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !unblocked {
+		writeError(w, http.StatusNotFound, "key not blocked")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyFromRequest returns the storage key given by the key query parameter or
+// by the type and id in the path. The key parameter addresses the keys that
+// have no type, such as those of networks and routes, and the IPv6 networks
+// whose id contains a slash.
+func keyFromRequest(r *http.Request) (string, error) {
+	if chi.URLParam(r, "type") == "" {
+		return parseKey(r.URL.Query().Get("key"))
+	}
+	return keyFromParams(r.URL.Query().Get("tenant"), chi.URLParam(r, "type"), chi.URLParam(r, "id"))
+}
+
+// parseKey validates a storage key given as is, e.g. "ratelimit:{ip:10.0.0.1}"
+// or "ratelimit:{ip:10.0.0.1}:route:POST:/login"
+func parseKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("key is required")
+	}
+	if !strings.HasPrefix(key, "ratelimit:{") || !strings.Contains(key, "}") {
+		return "", errors.New(`key must be a rate limiter key, e.g. "ratelimit:{ip:10.0.0.1}"`)
+	}
+	return key, nil
+}
+
+// keyFromParams returns the storage key of an IP, of the id of a token or of
+// an API key within its tenant, if any, or of the aggregate of a tenant
+func keyFromParams(tenant, keyType, id string) (string, error) {
+	if keyType != "ip" && keyType != "token" && keyType != "key" && keyType != "tenant" {
+		return "", errors.New(`type must be "ip", "token", "key" or "tenant"`)
+	}
+	if id == "" {
+		return "", errors.New("id is required")
+	}
+	if tenant != "" && keyType == "ip" {
+		return "", errors.New("IPs are not counted within tenants")
+	}
+	if keyType == "tenant" {
+		return limiter.Key(keyType, id), nil
+	}
+	return limiter.TenantKey(tenant, keyType, id), nil
+}
+
+func newPolicyResponse(p limiter.Policy) policyResponse {
+	response := policyResponse{
+		Limit:            p.Limit,
+		Window:           p.Window.String(),
+		Algorithm:        p.Algorithm.Name(),
+		BlockDuration:    p.BlockDuration.String(),
+		BlockMultiplier:  p.BlockMultiplier,
+		MaxBlockDuration: p.MaxBlockDuration.String(),
+		BlockLookback:    p.BlockLookback.String(),
+		Concurrency:      p.Concurrency,
+		DryRun:           p.DryRun,
+	}
+	if p.Concurrency > 0 && p.LeaseTimeout > 0 {
+		response.LeaseTimeout = p.LeaseTimeout.String()
+	}
+	for _, quota := range p.Quotas {
+		response.Quotas = append(response.Quotas, quotaResponse{Limit: quota.Limit, Window: quota.Window.String()})
+	}
+	if p.Shadow != nil {
+		shadow := newPolicyResponse(*p.Shadow)
+		response.Shadow = &shadow
+	}
+	return response
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
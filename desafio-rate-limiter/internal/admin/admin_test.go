@@ -0,0 +1,159 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/policy"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adminToken = "secret"
+
+func newTestHandler(t *testing.T) (http.Handler, *limiter.RateLimiter, storage.Storage) {
+	store := storage.NewMemoryStorage(time.Minute)
+	t.Cleanup(func() { store.Close() })
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules:   limiter.Rules{IPPolicy: limiter.Policy{Limit: 10, Window: time.Second}},
+	})
+	defaults := func() policy.Defaults {
+		return policy.Defaults{Algorithm: "gcra", BlockDuration: policy.Duration(5 * time.Minute), TokenLimit: 100}
+	}
+	return NewHandler(rl, store, adminToken, defaults).Routes(), rl, store
+}
+
+func do(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	handler, _, _ := newTestHandler(t)
+
+	for _, authorization := range []string{"", "Bearer wrong", adminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "authorization %q", authorization)
+	}
+
+	assert.Equal(t, http.StatusOK, do(t, handler, http.MethodGet, "/tokens", "").Code)
+}
+
+func TestTokens(t *testing.T) {
+	handler, rl, _ := newTestHandler(t)
+	id := limiter.TokenID("abc123")
+
+	// The token is only sent in the body and completed with the defaults
+	rec := do(t, handler, http.MethodPost, "/tokens", `{"token": "abc123", "limit": 50}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), "abc123")
+	var created tokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, id, created.ID)
+	assert.Equal(t, 50, created.Policy.Limit)
+	assert.Equal(t, "gcra", created.Policy.Algorithm)
+	assert.Equal(t, "5m0s", created.Policy.BlockDuration)
+	assert.True(t, rl.IsTokenRegistered("abc123"))
+
+	rec = do(t, handler, http.MethodPost, "/tokens", `{"token": "xyz"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"limit":100`)
+
+	rec = do(t, handler, http.MethodGet, "/tokens", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "abc123")
+	assert.Contains(t, rec.Body.String(), id)
+
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodPost, "/tokens", `{"limit": 5}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodPost, "/tokens", `{"token": "abc", "limti": 5}`).Code)
+
+	// Tokens are revoked by id
+	assert.Equal(t, http.StatusNoContent, do(t, handler, http.MethodDelete, "/tokens/"+id, "").Code)
+	assert.False(t, rl.IsTokenRegistered("abc123"))
+	assert.Equal(t, http.StatusNotFound, do(t, handler, http.MethodDelete, "/tokens/"+id, "").Code)
+}
+
+func TestBlocks(t *testing.T) {
+	handler, _, store := newTestHandler(t)
+	id := limiter.TokenID("abc123")
+
+	rec := do(t, handler, http.MethodPost, "/blocks", `{"type": "token", "id": "`+id+`", "duration": "10m"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	blocked, err := store.IsBlocked(context.Background(), limiter.Key("token", id))
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	rec = do(t, handler, http.MethodGet, "/blocks", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var blocks []blockResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &blocks))
+	require.Len(t, blocks, 1)
+	assert.Equal(t, limiter.Key("token", id), blocks[0].Key)
+
+	rec = do(t, handler, http.MethodGet, "/keys/token/"+id, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"blocked":true`)
+
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodPost, "/blocks", `{"type": "user", "id": "1", "duration": "1m"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodPost, "/blocks", `{"type": "ip", "id": "10.0.0.1"}`).Code)
+
+	assert.Equal(t, http.StatusNoContent, do(t, handler, http.MethodDelete, "/blocks/token/"+id, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(t, handler, http.MethodDelete, "/blocks/token/"+id, "").Code)
+}
+
+func TestBlocksByKey(t *testing.T) {
+	handler, _, store := newTestHandler(t)
+	ctx := context.Background()
+
+	keys := []string{
+		limiter.Key("ip", "10.0.0.1"),
+		limiter.Key("ip", "2001:db8::/64"),
+		limiter.Key("token", limiter.TokenID("abc123")),
+		limiter.TenantKey("acme", "token", limiter.TokenID("abc123")),
+		limiter.Key("network", "10.0.0.0/24"),
+		limiter.Key("ip", "10.0.0.1") + ":route:POST:/login",
+	}
+	for _, key := range keys[1:] {
+		require.NoError(t, store.SetBlock(ctx, key, time.Minute))
+	}
+	rec := do(t, handler, http.MethodPost, "/blocks", `{"key": "`+keys[0]+`", "duration": "1m"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	// Every block listed can be inspected and removed by its key
+	rec = do(t, handler, http.MethodGet, "/blocks", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var blocks []blockResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &blocks))
+	require.Len(t, blocks, len(keys))
+	for _, block := range blocks {
+		query := "?key=" + url.QueryEscape(block.Key)
+		rec = do(t, handler, http.MethodGet, "/keys"+query, "")
+		require.Equal(t, http.StatusOK, rec.Code, block.Key)
+		assert.Contains(t, rec.Body.String(), `"blocked":true`)
+
+		assert.Equal(t, http.StatusNoContent, do(t, handler, http.MethodDelete, "/blocks"+query, "").Code, block.Key)
+		assert.Equal(t, http.StatusNotFound, do(t, handler, http.MethodDelete, "/blocks"+query, "").Code, block.Key)
+	}
+	blocked, err := store.Blocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, blocked)
+
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodDelete, "/blocks", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodGet, "/keys?key=10.0.0.1", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(t, handler, http.MethodPost, "/blocks", `{"key": "block:x", "duration": "1m"}`).Code)
+}
@@ -0,0 +1,198 @@
+// Package apikey verifies API keys without keeping them in plaintext. A key is
+// presented either as "<id>.<secret>", the secret being checked against the
+// salted hashes registered for the id, or as "<id>.<expiry>.<signature>", an
+// HMAC signature of the id and its expiry made with a signing secret. Both
+// resolve to the id of the key, which selects its policy and names its storage
+// keys, so the secrets never reach the storage.
+package apikey
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashScheme prefixes the hashes, leaving room for other schemes
+const hashScheme = "sha256"
+
+// Hash is a salted hash of the secret of a key
+type Hash struct {
+	// Value is the hash as returned by HashSecret, "sha256:<salt>:<digest>"
+	Value string
+	// Expires ends the validity of the hash, zero never expires it. Rotating a
+	// key registers the hash of its new secret and expires the old one after
+	// an overlap period, giving clients time to switch.
+	Expires time.Time
+}
+
+// SigningKey is a secret used to sign keys. It is rotated like the hashes,
+// by adding the new one and expiring the old one after an overlap period.
+type SigningKey struct {
+	Secret  []byte
+	Expires time.Time
+}
+
+// Keyring resolves API keys to their id
+type Keyring struct {
+	hashes  map[string][]hash
+	signing []SigningKey
+	now     func() time.Time
+}
+
+type hash struct {
+	salt    []byte
+	digest  []byte
+	expires time.Time
+}
+
+// NewKeyring validates the hashes, by key id, and the signing keys
+func NewKeyring(hashes map[string][]Hash, signing []SigningKey) (*Keyring, error) {
+	k := &Keyring{hashes: make(map[string][]hash, len(hashes)), signing: signing, now: time.Now}
+	for id, values := range hashes {
+		if !ValidID(id) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		for _, value := range values {
+			parsed, err := parseHash(value.Value)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", id, err)
+			}
+			parsed.expires = value.Expires
+			k.hashes[id] = append(k.hashes[id], parsed)
+		}
+	}
+	for i, key := range signing {
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("signing key %d: secret must have at least 32 bytes", i)
+		}
+	}
+	return k, nil
+}
+
+// Resolve returns the id of a valid API key
+func (k *Keyring) Resolve(key string) (string, bool) {
+	if k == nil {
+		return "", false
+	}
+	now := k.now()
+	parts := strings.Split(key, ".")
+	if !ValidID(parts[0]) {
+		return "", false
+	}
+
+	switch len(parts) {
+	case 2:
+		secret := []byte(parts[1])
+		for _, h := range k.hashes[parts[0]] {
+			if !h.expires.IsZero() && !now.Before(h.expires) {
+				continue
+			}
+			if subtle.ConstantTimeCompare(digest(h.salt, secret), h.digest) == 1 {
+				return parts[0], true
+			}
+		}
+	case 3:
+		expiry, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || !now.Before(time.Unix(expiry, 0)) {
+			return "", false
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", false
+		}
+		for _, signing := range k.signing {
+			if !signing.Expires.IsZero() && !now.Before(signing.Expires) {
+				continue
+			}
+			if hmac.Equal(sign(signing.Secret, parts[0], parts[1]), signature) {
+				return parts[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+// ValidID reports whether id can name a key: letters, digits, "-" and "_"
+func ValidID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Generate returns a new random key for the id and the hash to register
+func Generate(id string) (key, hashed string, err error) {
+	if !ValidID(id) {
+		return "", "", fmt.Errorf("invalid key id %q", id)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	if hashed, err = HashSecret(encoded); err != nil {
+		return "", "", err
+	}
+	return id + "." + encoded, hashed, nil
+}
+
+// HashSecret returns the salted hash of the secret of a key. The secrets are
+// random, so a single round of SHA-256 is enough, unlike for passwords.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return hashScheme + ":" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(digest(salt, []byte(secret))), nil
+}
+
+// Sign returns a key for the id signed with the secret, valid until expires
+func Sign(secret []byte, id string, expires time.Time) (string, error) {
+	if !ValidID(id) {
+		return "", fmt.Errorf("invalid key id %q", id)
+	}
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return id + "." + expiry + "." + base64.RawURLEncoding.EncodeToString(sign(secret, id, expiry)), nil
+}
+
+func parseHash(value string) (hash, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[0] != hashScheme {
+		return hash{}, errors.New(`hash must be "sha256:<salt>:<digest>"`)
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return hash{}, errors.New("invalid hash salt")
+	}
+	sum, err := hex.DecodeString(parts[2])
+	if err != nil || len(sum) != sha256.Size {
+		return hash{}, errors.New("invalid hash digest")
+	}
+	return hash{salt: salt, digest: sum}, nil
+}
+
+func digest(salt, secret []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+func sign(secret []byte, id, expiry string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "." + expiry))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,103 @@
+package apikey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestResolveHashedKeys(t *testing.T) {
+	oldKey, oldHash, err := Generate("acme")
+	require.NoError(t, err)
+	newKey, newHash, err := Generate("acme")
+	require.NoError(t, err)
+	assert.NotContains(t, oldHash, strings.TrimPrefix(oldKey, "acme."))
+
+	// The old secret stays valid for an overlap period after the rotation
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	keyring, err := NewKeyring(map[string][]Hash{
+		"acme": {{Value: newHash}, {Value: oldHash, Expires: now.Add(time.Hour)}},
+	}, nil)
+	require.NoError(t, err)
+	keyring.now = func() time.Time { return now }
+
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{name: "new key", key: newKey, valid: true},
+		{name: "old key within the overlap", key: oldKey, valid: true},
+		{name: "wrong secret", key: "acme.secret"},
+		{name: "secret of another id", key: "other." + strings.TrimPrefix(newKey, "acme.")},
+		{name: "plaintext", key: "acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, valid := keyring.Resolve(tt.key)
+			assert.Equal(t, tt.valid, valid)
+			if tt.valid {
+				assert.Equal(t, "acme", id)
+			}
+		})
+	}
+
+	keyring.now = func() time.Time { return now.Add(time.Hour) }
+	_, valid := keyring.Resolve(oldKey)
+	assert.False(t, valid)
+	_, valid = keyring.Resolve(newKey)
+	assert.True(t, valid)
+}
+
+func TestResolveSignedKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldSecret := []byte("fedcba9876543210fedcba9876543210")
+	keyring, err := NewKeyring(nil, []SigningKey{{Secret: secret}, {Secret: oldSecret, Expires: now.Add(time.Hour)}})
+	require.NoError(t, err)
+	keyring.now = func() time.Time { return now }
+
+	key, err := Sign(secret, "acme", now.Add(24*time.Hour))
+	require.NoError(t, err)
+	id, valid := keyring.Resolve(key)
+	assert.True(t, valid)
+	assert.Equal(t, "acme", id)
+
+	oldKey, err := Sign(oldSecret, "acme", now.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, valid = keyring.Resolve(oldKey)
+	assert.True(t, valid)
+
+	// Tampering with the id or the expiry breaks the signature
+	parts := strings.Split(key, ".")
+	_, valid = keyring.Resolve("other." + parts[1] + "." + parts[2])
+	assert.False(t, valid)
+	_, valid = keyring.Resolve("acme.9999999999." + parts[2])
+	assert.False(t, valid)
+
+	unknown, err := Sign([]byte("another secret of at least 32 bytes"), "acme", now.Add(time.Hour))
+	require.NoError(t, err)
+	_, valid = keyring.Resolve(unknown)
+	assert.False(t, valid)
+
+	// Keys expire, and so do the keys of an expired signing key
+	keyring.now = func() time.Time { return now.Add(2 * time.Hour) }
+	_, valid = keyring.Resolve(oldKey)
+	assert.False(t, valid)
+	keyring.now = func() time.Time { return now.Add(24 * time.Hour) }
+	_, valid = keyring.Resolve(key)
+	assert.False(t, valid)
+}
+
+func TestNewKeyringRejectsInvalidKeys(t *testing.T) {
+	_, err := NewKeyring(map[string][]Hash{"acme": {{Value: "plaintext"}}}, nil)
+	assert.Error(t, err)
+	_, err = NewKeyring(map[string][]Hash{"acme.v2": nil}, nil)
+	assert.Error(t, err)
+	_, err = NewKeyring(nil, []SigningKey{{Secret: []byte("short")}})
+	assert.Error(t, err)
+}
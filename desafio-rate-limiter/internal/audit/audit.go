@@ -0,0 +1,245 @@
+// Package audit records the denials of the rate limiter and the blocks it
+// creates as structured JSON events, written to a pluggable sink.
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	EventDenied  = "denied"
+	EventBlocked = "blocked"
+)
+
+// Reasons of a denial
+const (
+	ReasonRateLimit    = "rate_limit"
+	ReasonConcurrency  = "concurrency"
+	ReasonInvalidToken = "invalid_token"
+	ReasonNetwork      = "network_denied"
+)
+
+// Event is a denial of a request or the block of a key. The key is hashed with
+// a secret, so tokens and client addresses are not written to the log.
+type Event struct {
+	Time    time.Time `json:"timestamp"`
+	Type    string    `json:"event"`
+	Reason  string    `json:"reason,omitempty"`
+	KeyType string    `json:"key_type"`
+	Key     string    `json:"key"`
+	Policy  string    `json:"policy"`
+	Tenant  string    `json:"tenant,omitempty"`
+	// Limit is the limit of the policy that denied the request. The counter
+	// itself is not reported, the algorithms other than the fixed window don't
+	// keep one.
+	Limit int `json:"limit"`
+	// RetryAfter is set for denials and BlockDuration for blocks
+	RetryAfter    string `json:"retry_after,omitempty"`
+	BlockDuration string `json:"block_duration,omitempty"`
+	Offenses      int64  `json:"offenses,omitempty"`
+	// Route is the method and path of the request, e.g. "POST /login"
+	Route     string `json:"route,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// DryRun reports that the denial was not enforced
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// HashKey returns the HMAC-SHA256 of a storage key with the secret, identifying
+// the key in the events. The same key always has the same hash, so the events
+// of a client can be correlated, while the small space of IP addresses can't
+// be brute forced back from the hashes without the secret.
+func HashKey(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Sink receives the audit events. Write is called on the request path and
+// must be safe for concurrent use.
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+// WriterSink writes the events as JSON lines to a writer, such as os.Stdout
+type WriterSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{enc: json.NewEncoder(w)}
+}
+
+func (s *WriterSink) Write(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(event); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return nil
+}
+
+// Close does not close the writer, which belongs to the caller
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes the events as JSON lines to a file, rotating it once it
+// reaches its maximum size. The rotated files are named after the file with
+// the suffixes .1 (the newest) to .maxBackups, older files being removed.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens the file, appending to it. A non-positive maxBytes never
+// rotates it.
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit file: %w", err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("audit file is closed")
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts the backups, moves the file to the first one and reopens it
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit file: %w", err)
+	}
+	s.file = nil
+
+	if s.maxBackups > 0 {
+		os.Remove(s.backup(s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(s.backup(i), s.backup(i+1))
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return fmt.Errorf("failed to rotate audit file: %w", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("failed to rotate audit file: %w", err)
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ChannelSink hands the events to a consumer through a buffered channel, e.g.
+// to ship them to a log pipeline. Events are dropped rather than slowing
+// requests down when the consumer falls behind.
+type ChannelSink struct {
+	mu      sync.RWMutex
+	events  chan Event
+	closed  bool
+	dropped atomic.Uint64
+}
+
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{events: make(chan Event, size)}
+}
+
+// Events returns the channel of the events, closed when the sink is closed
+func (s *ChannelSink) Events() <-chan Event {
+	return s.events
+}
+
+// Write queues the event. An event that does not fit in the buffer is dropped
+// silently, so that an overloaded consumer does not flood the logs; Dropped
+// counts them.
+func (s *ChannelSink) Write(event Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit channel is closed")
+	}
+	select {
+	case s.events <- event:
+	default:
+		s.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (s *ChannelSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *ChannelSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	return nil
+}
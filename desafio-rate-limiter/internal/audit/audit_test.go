@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	event := Event{
+		Time:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:          EventBlocked,
+		KeyType:       "ip",
+		Key:           HashKey([]byte("secret"), "ratelimit:{ip:192.0.2.1}"),
+		Policy:        "ip",
+		Limit:         10,
+		BlockDuration: "5m0s",
+		Route:         "GET /",
+		RequestID:     "abc",
+	}
+	require.NoError(t, sink.Write(event))
+	require.NoError(t, sink.Close())
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "2024-01-02T03:04:05Z", fields["timestamp"])
+	assert.Equal(t, "blocked", fields["event"])
+	assert.Equal(t, "5m0s", fields["block_duration"])
+	assert.Equal(t, "abc", fields["request_id"])
+	assert.NotContains(t, fields, "retry_after")
+	assert.NotContains(t, fields, "count")
+	assert.NotContains(t, buf.String(), "192.0.2.1")
+}
+
+func TestHashKey(t *testing.T) {
+	secret := []byte("secret")
+	assert.Equal(t, HashKey(secret, "ratelimit:{token:abc}"), HashKey(secret, "ratelimit:{token:abc}"))
+	assert.NotEqual(t, HashKey(secret, "ratelimit:{token:abc}"), HashKey(secret, "ratelimit:{token:abd}"))
+	assert.NotEqual(t, HashKey(secret, "ratelimit:{token:abc}"), HashKey([]byte("other"), "ratelimit:{token:abc}"))
+	assert.Len(t, HashKey(secret, "ratelimit:{token:abc}"), 32)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	event := Event{Type: EventDenied, KeyType: "ip", Key: HashKey([]byte("secret"), "key"), Policy: "ip"}
+	line, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	// Room for two events per file, keeping two rotated files
+	sink, err := NewFileSink(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, sink.Write(event))
+	}
+	require.NoError(t, sink.Close())
+
+	lines := func(name string) int {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return strings.Count(string(data), "\n")
+	}
+	assert.Equal(t, 1, lines(path))
+	assert.Equal(t, 2, lines(path+".1"))
+	assert.Equal(t, 2, lines(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Reopening appends to the current file
+	sink, err = NewFileSink(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(event))
+	require.NoError(t, sink.Close())
+	assert.Equal(t, 2, lines(path))
+	assert.Error(t, sink.Write(event))
+}
+
+func TestChannelSink(t *testing.T) {
+	sink := NewChannelSink(2)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Write(Event{Type: EventDenied}))
+	}
+	assert.Equal(t, uint64(1), sink.Dropped())
+
+	require.NoError(t, sink.Close())
+	assert.Error(t, sink.Write(Event{Type: EventDenied}))
+
+	var received int
+	for range sink.Events() {
+		received++
+	}
+	assert.Equal(t, 2, received)
+}
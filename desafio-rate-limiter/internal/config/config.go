@@ -2,34 +2,153 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Redis         RedisConfig
-	RateLimitIP   int
-	BlockDuration int
-	TokenLimits   map[string]int
+	// StorageBackend selects where the rate limiter state is kept: "redis" or "memory"
+	StorageBackend string
+	Redis          RedisConfig
+	RateLimitIP    int
+	BlockDuration  int
+	// BlockMultiplier multiplies the block duration on every repeated block of
+	// a client within BlockLookback, up to MaxBlockDuration. 1 keeps it fixed.
+	// BlockLookback defaults to 24h with a multiplier above 1, and to zero,
+	// which does not track repeated blocks, otherwise.
+	BlockMultiplier  float64
+	MaxBlockDuration time.Duration
+	BlockLookback    time.Duration
+	TokenLimits      map[string]int
+	// TokenQuotas are the limits enforced on top of the per second limit of
+	// each token, such as 500 per minute and 100000 per day
+	TokenQuotas map[string][]Quota
+	// Algorithm is the default rate limit algorithm, IPAlgorithm and
+	// TokenAlgorithms override it for the IP limit and for single tokens
+	Algorithm       string
+	IPAlgorithm     string
+	TokenAlgorithms map[string]string
+	// APIKeys are the API keys verified by hash or signature, by key id, and
+	// APISigningSecrets the secrets signing keys
+	APIKeys           map[string]APIKey
+	APISigningSecrets []Expiring
+	RouteLimits       []RouteLimit
+	// RouteCosts set how many units of the limits the requests of a route consume
+	RouteCosts []RouteCost
+	// BodyCostBytes charges one unit per started block of this many bytes of
+	// the request body, zero counts every request as one unit. Longer bodies
+	// than BodyMaxBytes are rejected, and bodies of unknown length are charged
+	// as, and cut at, BodyMaxBytes.
+	BodyCostBytes int64
+	BodyMaxBytes  int64
+	// IPConcurrency and TokenConcurrency cap the requests of an IP or token in
+	// flight at once, zero does not cap them. LeaseTimeout frees the slots of
+	// requests never released, such as those of a crashed instance.
+	IPConcurrency    int
+	TokenConcurrency int
+	LeaseTimeout     time.Duration
+	// IPDryRun logs the requests the IP limit would deny instead of denying them
+	IPDryRun bool
+	// IPShadowLimit is a candidate IP limit evaluated in dry-run mode next to
+	// RateLimitIP, which is still enforced. Zero evaluates none.
+	IPShadowLimit int
+	// PolicyFile is a YAML or JSON file with the rate limit policies. When set
+	// it replaces the limits above and is reloaded every PolicyReloadInterval.
+	PolicyFile           string
+	PolicyReloadInterval time.Duration
+	// AdminToken enables the admin API, authenticated with this bearer token
+	AdminToken string
+	// TrustedProxies may report the client IP through forwarding headers
+	TrustedProxies []netip.Prefix
+	// IPv6PrefixLength aggregates IPv6 clients by network, zero disables it
+	IPv6PrefixLength int
+	// AllowedNetworks are never rate limited
+	AllowedNetworks []netip.Prefix
+	// DeniedNetworks are always rejected
+	DeniedNetworks []netip.Prefix
+	// MetricsEnabled exposes Prometheus metrics on /metrics
+	MetricsEnabled bool
+	// FailureMode decides the requests while Redis fails: open, closed or local
+	FailureMode string
+	// CircuitBreakerThreshold consecutive Redis errors open the circuit breaker
+	// for CircuitBreakerCooldown
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+	// RLSAddr is the listen address of the Envoy rate limit service, empty
+	// disables it
+	RLSAddr string
+	// CheckEnabled exposes the decision of any request on /check/*
+	CheckEnabled bool
+	// AuditSink receives the audit events of denials and blocks: stdout, file
+	// or empty to disable them. The file sink writes to AuditFile, rotating it
+	// at AuditFileMaxBytes and keeping AuditFileMaxBackups rotated files.
+	AuditSink           string
+	AuditFile           string
+	AuditFileMaxBytes   int64
+	AuditFileMaxBackups int
+	// KeyPrefix namespaces the storage keys, so that several environments
+	// share one Redis without sharing counters and blocks
+	KeyPrefix string
+	// TokenDefaultLimit is the limit of tokens registered without one
+	TokenDefaultLimit int
+	// MetricsBlocksRefresh is how often the active blocks gauge lists the
+	// blocks of the storage, zero disables the gauge
+	MetricsBlocksRefresh time.Duration
+	// AuditHashKey is the HMAC secret of the keys in the audit events. A random
+	// secret is used when empty.
+	AuditHashKey string
 }
 
-type RedisConfig struct {
-	Host     string
-	Port     string
-	Password string
-	DB       int
+// APIKey is the limit of an API key id and the salted hashes of its secrets.
+// Signed keys need no hashes.
+type APIKey struct {
+	Limit  int
+	Hashes []Expiring
+}
+
+// Expiring is a hash or secret valid until Expires, forever when zero
+type Expiring struct {
+	Value   string
+	Expires time.Time
+}
+
+// Quota is a limit of requests per window
+type Quota struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RouteCost is the cost of the requests matching a method and a path pattern.
+// An empty Method matches every method.
+type RouteCost struct {
+	Method  string
+	Pattern string
+	Cost    int
+}
+
+// RouteLimit is a rate limit applied to the requests matching a method and a
+// path pattern. An empty Method matches every method.
+type RouteLimit struct {
+	Method        string
+	Pattern       string
+	Limit         int
+	Window        time.Duration
+	BlockDuration time.Duration
+	Algorithm     string
 }
 
 func LoadConfig() (*Config, error) {
 	// Load .env file if it exists
 	_ = godotenv.Load()
 
-	redisDB, err := strconv.Atoi(getEnv("REDIS_DB", "0"))
+	redisConfig, err := loadRedisConfig()
 	if err != nil {
-		return nil, fmt.Errorf("invalid REDIS_DB: %w", err)
+		return nil, err
 	}
 
 	rateLimitIP, err := strconv.Atoi(getEnv("RATE_LIMIT_IP", "10"))
@@ -47,32 +166,214 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid BLOCK_DURATION_SECONDS: %w", err)
 	}
 
+	storageBackend := strings.ToLower(getEnv("STORAGE_BACKEND", "redis"))
+	if storageBackend != "redis" && storageBackend != "memory" {
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND: %q, expected redis or memory", storageBackend)
+	}
+
 	config := &Config{
-		Redis: RedisConfig{
-			Host:     getEnv("REDIS_HOST", "localhost"),
-			Port:     getEnv("REDIS_PORT", "6379"),
-			Password: getEnv("REDIS_PASSWORD", ""),
-			DB:       redisDB,
-		},
-		RateLimitIP:   rateLimitIP,
-		BlockDuration: blockDuration,
-		TokenLimits:   make(map[string]int),
-	}
-
-	// Load custom token limits
+		StorageBackend:  storageBackend,
+		Redis:           redisConfig,
+		RateLimitIP:     rateLimitIP,
+		BlockDuration:   blockDuration,
+		TokenLimits:     make(map[string]int),
+		TokenQuotas:     make(map[string][]Quota),
+		Algorithm:       getEnv("RATE_LIMIT_ALGORITHM", "fixed_window"),
+		TokenAlgorithms: make(map[string]string),
+	}
+	config.IPAlgorithm = getEnv("RATE_LIMIT_IP_ALGORITHM", config.Algorithm)
+	config.TokenDefaultLimit = rateLimitTokenDefault
+
+	// Braces would take the Redis Cluster hash tag of the keys
+	config.KeyPrefix = os.Getenv("RATE_LIMIT_KEY_PREFIX")
+	if strings.ContainsAny(config.KeyPrefix, "{} ") {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_KEY_PREFIX: %q, braces and spaces are not allowed", config.KeyPrefix)
+	}
+
+	config.IPDryRun, err = strconv.ParseBool(getEnv("RATE_LIMIT_IP_DRY_RUN", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_IP_DRY_RUN: %q", os.Getenv("RATE_LIMIT_IP_DRY_RUN"))
+	}
+
+	config.IPShadowLimit, err = strconv.Atoi(getEnv("RATE_LIMIT_IP_SHADOW", "0"))
+	if err != nil || config.IPShadowLimit < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_IP_SHADOW: %q", os.Getenv("RATE_LIMIT_IP_SHADOW"))
+	}
+
+	config.BlockMultiplier, err = strconv.ParseFloat(getEnv("BLOCK_MULTIPLIER", "1"), 64)
+	if err != nil || config.BlockMultiplier < 1 {
+		return nil, fmt.Errorf("invalid BLOCK_MULTIPLIER: %q, expected a number of at least 1", os.Getenv("BLOCK_MULTIPLIER"))
+	}
+	maxBlockDuration, err := strconv.Atoi(getEnv("BLOCK_MAX_DURATION_SECONDS", "86400"))
+	if err != nil || maxBlockDuration < 0 {
+		return nil, fmt.Errorf("invalid BLOCK_MAX_DURATION_SECONDS: %q", os.Getenv("BLOCK_MAX_DURATION_SECONDS"))
+	}
+	config.MaxBlockDuration = time.Duration(maxBlockDuration) * time.Second
+	// Repeated blocks are only tracked by default when they escalate
+	defaultBlockLookback := "0"
+	if config.BlockMultiplier > 1 {
+		defaultBlockLookback = "86400"
+	}
+	blockLookback, err := strconv.Atoi(getEnv("BLOCK_LOOKBACK_SECONDS", defaultBlockLookback))
+	if err != nil || blockLookback < 0 {
+		return nil, fmt.Errorf("invalid BLOCK_LOOKBACK_SECONDS: %q", os.Getenv("BLOCK_LOOKBACK_SECONDS"))
+	}
+	config.BlockLookback = time.Duration(blockLookback) * time.Second
+
+	routeLimits, err := parseRouteLimits(os.Getenv("RATE_LIMIT_ROUTES"), time.Duration(blockDuration)*time.Second, config.Algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ROUTES: %w", err)
+	}
+	config.RouteLimits = routeLimits
+
+	routeCosts, err := parseRouteCosts(os.Getenv("RATE_LIMIT_ROUTE_COSTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ROUTE_COSTS: %w", err)
+	}
+	config.RouteCosts = routeCosts
+
+	config.BodyCostBytes, err = strconv.ParseInt(getEnv("RATE_LIMIT_BODY_COST_BYTES", "0"), 10, 64)
+	if err != nil || config.BodyCostBytes < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BODY_COST_BYTES: %q", os.Getenv("RATE_LIMIT_BODY_COST_BYTES"))
+	}
+	config.BodyMaxBytes, err = strconv.ParseInt(getEnv("RATE_LIMIT_BODY_MAX_BYTES", "10485760"), 10, 64)
+	if err != nil || config.BodyMaxBytes <= 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BODY_MAX_BYTES: %q", os.Getenv("RATE_LIMIT_BODY_MAX_BYTES"))
+	}
+
+	config.IPConcurrency, err = strconv.Atoi(getEnv("RATE_LIMIT_IP_CONCURRENCY", "0"))
+	if err != nil || config.IPConcurrency < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_IP_CONCURRENCY: %q", os.Getenv("RATE_LIMIT_IP_CONCURRENCY"))
+	}
+	config.TokenConcurrency, err = strconv.Atoi(getEnv("RATE_LIMIT_TOKEN_CONCURRENCY", "0"))
+	if err != nil || config.TokenConcurrency < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_TOKEN_CONCURRENCY: %q", os.Getenv("RATE_LIMIT_TOKEN_CONCURRENCY"))
+	}
+	config.LeaseTimeout, err = time.ParseDuration(getEnv("RATE_LIMIT_LEASE_TIMEOUT", "1m"))
+	if err != nil || config.LeaseTimeout <= 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_LEASE_TIMEOUT: %q", os.Getenv("RATE_LIMIT_LEASE_TIMEOUT"))
+	}
+
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+
+	config.MetricsEnabled, err = strconv.ParseBool(getEnv("METRICS_ENABLED", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid METRICS_ENABLED: %q", os.Getenv("METRICS_ENABLED"))
+	}
+	config.MetricsBlocksRefresh, err = time.ParseDuration(getEnv("METRICS_BLOCKS_REFRESH", "30s"))
+	if err != nil || config.MetricsBlocksRefresh < 0 {
+		return nil, fmt.Errorf("invalid METRICS_BLOCKS_REFRESH: %q", os.Getenv("METRICS_BLOCKS_REFRESH"))
+	}
+
+	config.RLSAddr = os.Getenv("RLS_ADDR")
+	config.CheckEnabled, err = strconv.ParseBool(getEnv("CHECK_ENABLED", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CHECK_ENABLED: %q", os.Getenv("CHECK_ENABLED"))
+	}
+
+	config.AuditSink = os.Getenv("AUDIT_SINK")
+	if config.AuditSink != "" && config.AuditSink != "stdout" && config.AuditSink != "file" {
+		return nil, fmt.Errorf("invalid AUDIT_SINK: %q (expected stdout or file)", config.AuditSink)
+	}
+	config.AuditFile = getEnv("AUDIT_FILE", "audit.log")
+	auditFileMaxSize, err := strconv.Atoi(getEnv("AUDIT_FILE_MAX_SIZE_MB", "100"))
+	if err != nil || auditFileMaxSize < 0 {
+		return nil, fmt.Errorf("invalid AUDIT_FILE_MAX_SIZE_MB: %q", os.Getenv("AUDIT_FILE_MAX_SIZE_MB"))
+	}
+	config.AuditFileMaxBytes = int64(auditFileMaxSize) << 20
+	config.AuditFileMaxBackups, err = strconv.Atoi(getEnv("AUDIT_FILE_MAX_BACKUPS", "5"))
+	if err != nil || config.AuditFileMaxBackups < 0 {
+		return nil, fmt.Errorf("invalid AUDIT_FILE_MAX_BACKUPS: %q", os.Getenv("AUDIT_FILE_MAX_BACKUPS"))
+	}
+	config.AuditHashKey = os.Getenv("AUDIT_HASH_KEY")
+
+	config.FailureMode = getEnv("RATE_LIMIT_FAILURE_MODE", "open")
+	if config.FailureMode != "open" && config.FailureMode != "closed" && config.FailureMode != "local" {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_FAILURE_MODE: %q (expected open, closed or local)", config.FailureMode)
+	}
+	config.CircuitBreakerThreshold, err = strconv.Atoi(getEnv("CIRCUIT_BREAKER_THRESHOLD", "5"))
+	if err != nil || config.CircuitBreakerThreshold <= 0 {
+		return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_THRESHOLD: %q", os.Getenv("CIRCUIT_BREAKER_THRESHOLD"))
+	}
+	config.CircuitBreakerCooldown, err = time.ParseDuration(getEnv("CIRCUIT_BREAKER_COOLDOWN", "10s"))
+	if err != nil || config.CircuitBreakerCooldown <= 0 {
+		return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_COOLDOWN: %q", os.Getenv("CIRCUIT_BREAKER_COOLDOWN"))
+	}
+
+	config.TrustedProxies, err = parsePrefixes(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	config.IPv6PrefixLength, err = strconv.Atoi(getEnv("IPV6_PREFIX_LENGTH", "0"))
+	if err != nil || config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid IPV6_PREFIX_LENGTH: %q", os.Getenv("IPV6_PREFIX_LENGTH"))
+	}
+
+	config.AllowedNetworks, err = parsePrefixes(os.Getenv("IP_ALLOWLIST"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP_ALLOWLIST: %w", err)
+	}
+	config.DeniedNetworks, err = parsePrefixes(os.Getenv("IP_DENYLIST"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP_DENYLIST: %w", err)
+	}
+
+	config.PolicyFile = os.Getenv("RATE_LIMIT_POLICY_FILE")
+	config.PolicyReloadInterval, err = time.ParseDuration(getEnv("RATE_LIMIT_POLICY_RELOAD_INTERVAL", "5s"))
+	if err != nil || config.PolicyReloadInterval <= 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_POLICY_RELOAD_INTERVAL: %q", os.Getenv("RATE_LIMIT_POLICY_RELOAD_INTERVAL"))
+	}
+
+	config.APISigningSecrets, err = parseExpiring(os.Getenv("API_SIGNING_SECRETS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid API_SIGNING_SECRETS: %w", err)
+	}
+
+	// Load custom token limits and API keys
+	config.APIKeys = make(map[string]APIKey)
 	for _, env := range os.Environ() {
+		// API_KEY_<id>=[<limit>,]<hash>[@<expires>],...
+		if name, value, found := strings.Cut(env, "="); found && strings.HasPrefix(name, "API_KEY_") {
+			key := APIKey{Limit: rateLimitTokenDefault}
+			if limit, hashes, _ := strings.Cut(value, ","); limit != "" && !strings.Contains(limit, ":") {
+				if key.Limit, err = strconv.Atoi(limit); err != nil || key.Limit <= 0 {
+					return nil, fmt.Errorf("invalid %s: invalid limit %q", name, limit)
+				}
+				value = hashes
+			}
+			if key.Hashes, err = parseExpiring(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			config.APIKeys[strings.TrimPrefix(name, "API_KEY_")] = key
+		}
+
 		if strings.HasPrefix(env, "TOKEN_") {
 			parts := strings.SplitN(env, "=", 2)
 			if len(parts) == 2 {
 				token := strings.TrimPrefix(parts[0], "TOKEN_")
+				// Quotas follow the per second limit: <limit>,<limit>/<window>,...
+				if value, quotas, found := strings.Cut(parts[1], ","); found {
+					parsed, err := parseQuotas(quotas)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
+					}
+					parts[1] = value
+					config.TokenQuotas[token] = parsed
+				}
+				// The value may select an algorithm for the token: <limit>:<algorithm>
+				if value, algorithm, found := strings.Cut(parts[1], ":"); found {
+					parts[1] = value
+					config.TokenAlgorithms[token] = algorithm
+				}
 				// If value is empty, use the default RATE_LIMIT_TOKEN_DEFAULT
 				if parts[1] == "" {
 					config.TokenLimits[token] = rateLimitTokenDefault
 				} else {
 					limit, err := strconv.Atoi(parts[1])
-					if err == nil {
-						config.TokenLimits[token] = limit
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
 					}
+					config.TokenLimits[token] = limit
 				}
 			}
 		}
@@ -81,6 +382,191 @@ func LoadConfig() (*Config, error) {
 	return config, nil
 }
 
+// parseRouteLimits parses route limits separated by ";" in the format
+// [METHOD ]PATTERN=LIMIT/WINDOW[/BLOCK[/ALGORITHM]], e.g.
+// "POST /login=5/1m/5m;GET /api/*=100/1s". Omitted block durations and
+// algorithms fall back to the given defaults.
+func parseRouteLimits(value string, defaultBlock time.Duration, defaultAlgorithm string) ([]RouteLimit, error) {
+	var routes []RouteLimit
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route, spec, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("route %q: missing limit", entry)
+		}
+
+		rl := RouteLimit{BlockDuration: defaultBlock, Algorithm: defaultAlgorithm}
+		fields := strings.Fields(route)
+		switch len(fields) {
+		case 1:
+			rl.Pattern = fields[0]
+		case 2:
+			rl.Method = strings.ToUpper(fields[0])
+			rl.Pattern = fields[1]
+		default:
+			return nil, fmt.Errorf("route %q: expected [METHOD ]PATTERN", route)
+		}
+
+		parts := strings.Split(spec, "/")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("route %q: expected LIMIT/WINDOW[/BLOCK[/ALGORITHM]]", route)
+		}
+
+		var err error
+		if rl.Limit, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+			return nil, fmt.Errorf("route %q: invalid limit: %w", route, err)
+		}
+		if rl.Limit <= 0 {
+			return nil, fmt.Errorf("route %q: limit must be positive", route)
+		}
+		if rl.Window, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("route %q: invalid window: %w", route, err)
+		}
+		if rl.Window <= 0 {
+			return nil, fmt.Errorf("route %q: window must be positive", route)
+		}
+		if len(parts) > 2 {
+			if rl.BlockDuration, err = time.ParseDuration(strings.TrimSpace(parts[2])); err != nil {
+				return nil, fmt.Errorf("route %q: invalid block duration: %w", route, err)
+			}
+			if rl.BlockDuration < 0 {
+				return nil, fmt.Errorf("route %q: block duration must not be negative", route)
+			}
+		}
+		if len(parts) > 3 {
+			rl.Algorithm = strings.TrimSpace(parts[3])
+		}
+
+		routes = append(routes, rl)
+	}
+	return routes, nil
+}
+
+// parseRouteCosts parses route costs separated by ";" in the format
+// [METHOD ]PATTERN=COST, e.g. "POST /export=50;POST /bulk/*=10"
+func parseRouteCosts(value string) ([]RouteCost, error) {
+	var costs []RouteCost
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route, cost, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("route %q: missing cost", entry)
+		}
+
+		var rc RouteCost
+		fields := strings.Fields(route)
+		switch len(fields) {
+		case 1:
+			rc.Pattern = fields[0]
+		case 2:
+			rc.Method = strings.ToUpper(fields[0])
+			rc.Pattern = fields[1]
+		default:
+			return nil, fmt.Errorf("route %q: expected [METHOD ]PATTERN", route)
+		}
+
+		var err error
+		if rc.Cost, err = strconv.Atoi(strings.TrimSpace(cost)); err != nil || rc.Cost <= 0 {
+			return nil, fmt.Errorf("route %q: cost must be a positive integer", route)
+		}
+		costs = append(costs, rc)
+	}
+	return costs, nil
+}
+
+// parseQuotas parses quotas separated by "," in the format LIMIT/WINDOW, e.g.
+// "500/1m,100000/1d"
+func parseQuotas(value string) ([]Quota, error) {
+	var quotas []Quota
+	for _, entry := range strings.Split(value, ",") {
+		limit, window, found := strings.Cut(strings.TrimSpace(entry), "/")
+		if !found {
+			return nil, fmt.Errorf("quota %q: expected LIMIT/WINDOW", entry)
+		}
+
+		var quota Quota
+		var err error
+		if quota.Limit, err = strconv.Atoi(limit); err != nil || quota.Limit <= 0 {
+			return nil, fmt.Errorf("quota %q: invalid limit", entry)
+		}
+		if quota.Window, err = ParseDuration(window); err != nil || quota.Window <= 0 {
+			return nil, fmt.Errorf("quota %q: invalid window", entry)
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+// parseExpiring parses values separated by "," in the format VALUE[@EXPIRES],
+// the expiry being an RFC 3339 time, e.g. "abc,def@2024-07-01T00:00:00Z"
+func parseExpiring(value string) ([]Expiring, error) {
+	var values []Expiring
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var parsed Expiring
+		var expires string
+		parsed.Value, expires, _ = strings.Cut(entry, "@")
+		if expires != "" {
+			var err error
+			if parsed.Expires, err = time.Parse(time.RFC3339, expires); err != nil {
+				return nil, fmt.Errorf("%q: invalid expiry", entry)
+			}
+		}
+		values = append(values, parsed)
+	}
+	return values, nil
+}
+
+// ParseDuration parses a Go duration string, also accepting a number of days
+// such as "1d" or "30d"
+func ParseDuration(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// parsePrefixes parses a comma separated list of CIDRs or single IPs
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRouteLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []RouteLimit
+		err   string
+	}{
+		{
+			name:  "routes",
+			value: "POST /login=5/1m; /api/*=100/1s/30s/gcra;",
+			want: []RouteLimit{
+				{Method: "POST", Pattern: "/login", Limit: 5, Window: time.Minute, BlockDuration: time.Minute, Algorithm: "fixed_window"},
+				{Pattern: "/api/*", Limit: 100, Window: time.Second, BlockDuration: 30 * time.Second, Algorithm: "gcra"},
+			},
+		},
+		{name: "missing limit", value: "/login", err: `route "/login": missing limit`},
+		{name: "missing window", value: "/login=5", err: `route "/login": expected LIMIT/WINDOW[/BLOCK[/ALGORITHM]]`},
+		{name: "zero limit", value: "/login=0/1m", err: `route "/login": limit must be positive`},
+		{name: "negative limit", value: "/login=-5/1m", err: `route "/login": limit must be positive`},
+		{name: "zero window", value: "/login=5/0s", err: `route "/login": window must be positive`},
+		{name: "negative block", value: "/login=5/1m/-1m", err: `route "/login": block duration must not be negative`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := parseRouteLimits(tt.value, time.Minute, "fixed_window")
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, routes)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RedisConfig struct {
+	Host     string
+	Port     string
+	Password string
+	DB       int
+
+	// Mode is "standalone", "cluster" or "sentinel"
+	Mode string
+	// Addrs lists the cluster nodes or the sentinels, defaulting to Host:Port
+	Addrs []string
+	// MasterName is the master monitored by the sentinels
+	MasterName string
+	// Username authenticates with Redis ACL users
+	Username         string
+	SentinelUsername string
+	SentinelPassword string
+
+	TLS RedisTLSConfig
+
+	// Pool sizing and timeouts, zero keeps the go-redis defaults
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// RedisTLSConfig enables TLS to Redis. CAFile verifies the server with a
+// private CA, CertFile and KeyFile authenticate the client.
+type RedisTLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func loadRedisConfig() (RedisConfig, error) {
+	redisDB, err := strconv.Atoi(getEnv("REDIS_DB", "0"))
+	if err != nil {
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_DB: %w", err)
+	}
+
+	config := RedisConfig{
+		Host:             getEnv("REDIS_HOST", "localhost"),
+		Port:             getEnv("REDIS_PORT", "6379"),
+		Password:         getEnv("REDIS_PASSWORD", ""),
+		DB:               redisDB,
+		Mode:             strings.ToLower(getEnv("REDIS_MODE", "standalone")),
+		MasterName:       os.Getenv("REDIS_SENTINEL_MASTER"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		SentinelUsername: os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		TLS: RedisTLSConfig{
+			CAFile:     os.Getenv("REDIS_TLS_CA_FILE"),
+			CertFile:   os.Getenv("REDIS_TLS_CERT_FILE"),
+			KeyFile:    os.Getenv("REDIS_TLS_KEY_FILE"),
+			ServerName: os.Getenv("REDIS_TLS_SERVER_NAME"),
+		},
+	}
+
+	switch config.Mode {
+	case "standalone", "cluster":
+	case "sentinel":
+		if config.MasterName == "" {
+			return RedisConfig{}, errors.New("REDIS_SENTINEL_MASTER is required when REDIS_MODE is sentinel")
+		}
+	default:
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_MODE: %q, expected standalone, cluster or sentinel", config.Mode)
+	}
+
+	for _, addr := range strings.Split(os.Getenv("REDIS_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			config.Addrs = append(config.Addrs, addr)
+		}
+	}
+	if len(config.Addrs) == 0 {
+		config.Addrs = []string{config.Host + ":" + config.Port}
+	}
+
+	if config.TLS.Enabled, err = strconv.ParseBool(getEnv("REDIS_TLS_ENABLED", "false")); err != nil {
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_TLS_ENABLED: %q", os.Getenv("REDIS_TLS_ENABLED"))
+	}
+	if config.TLS.InsecureSkipVerify, err = strconv.ParseBool(getEnv("REDIS_TLS_INSECURE_SKIP_VERIFY", "false")); err != nil {
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_TLS_INSECURE_SKIP_VERIFY: %q", os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY"))
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return RedisConfig{}, errors.New("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+
+	if config.PoolSize, err = strconv.Atoi(getEnv("REDIS_POOL_SIZE", "0")); err != nil || config.PoolSize < 0 {
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_POOL_SIZE: %q", os.Getenv("REDIS_POOL_SIZE"))
+	}
+	if config.MinIdleConns, err = strconv.Atoi(getEnv("REDIS_MIN_IDLE_CONNS", "0")); err != nil || config.MinIdleConns < 0 {
+		return RedisConfig{}, fmt.Errorf("invalid REDIS_MIN_IDLE_CONNS: %q", os.Getenv("REDIS_MIN_IDLE_CONNS"))
+	}
+
+	timeouts := []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"REDIS_DIAL_TIMEOUT", &config.DialTimeout},
+		{"REDIS_READ_TIMEOUT", &config.ReadTimeout},
+		{"REDIS_WRITE_TIMEOUT", &config.WriteTimeout},
+	}
+	for _, timeout := range timeouts {
+		value := os.Getenv(timeout.env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return RedisConfig{}, fmt.Errorf("invalid %s: %q", timeout.env, value)
+		}
+		*timeout.value = parsed
+	}
+
+	return config, nil
+}
+
+// TLSConfig builds the TLS configuration of the Redis connection, reading the
+// certificates from disk. It returns nil when TLS is disabled.
+func (c RedisConfig) TLSConfig() (*tls.Config, error) {
+	if !c.TLS.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+
+	if c.TLS.CAFile != "" {
+		ca, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", c.TLS.CAFile)
+		}
+	}
+
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRedisConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want RedisConfig
+		err  string
+	}{
+		{
+			name: "standalone",
+			env:  map[string]string{"REDIS_HOST": "redis", "REDIS_PORT": "6380", "REDIS_DB": "2"},
+			want: RedisConfig{Host: "redis", Port: "6380", DB: 2, Mode: "standalone", Addrs: []string{"redis:6380"}},
+		},
+		{
+			name: "cluster",
+			env: map[string]string{
+				"REDIS_MODE":     "Cluster",
+				"REDIS_ADDRS":    "node1:6379, node2:6379,,node3:6379",
+				"REDIS_USERNAME": "limiter",
+				"REDIS_PASSWORD": "secret",
+			},
+			want: RedisConfig{
+				Host:     "localhost",
+				Port:     "6379",
+				Password: "secret",
+				Mode:     "cluster",
+				Addrs:    []string{"node1:6379", "node2:6379", "node3:6379"},
+				Username: "limiter",
+			},
+		},
+		{
+			name: "sentinel",
+			env: map[string]string{
+				"REDIS_MODE":              "sentinel",
+				"REDIS_ADDRS":             "sentinel1:26379,sentinel2:26379",
+				"REDIS_SENTINEL_MASTER":   "mymaster",
+				"REDIS_SENTINEL_USERNAME": "sentinel",
+				"REDIS_SENTINEL_PASSWORD": "secret",
+				"REDIS_POOL_SIZE":         "20",
+				"REDIS_MIN_IDLE_CONNS":    "5",
+				"REDIS_DIAL_TIMEOUT":      "2s",
+				"REDIS_READ_TIMEOUT":      "500ms",
+			},
+			want: RedisConfig{
+				Host:             "localhost",
+				Port:             "6379",
+				Mode:             "sentinel",
+				Addrs:            []string{"sentinel1:26379", "sentinel2:26379"},
+				MasterName:       "mymaster",
+				SentinelUsername: "sentinel",
+				SentinelPassword: "secret",
+				PoolSize:         20,
+				MinIdleConns:     5,
+				DialTimeout:      2 * time.Second,
+				ReadTimeout:      500 * time.Millisecond,
+			},
+		},
+		{
+			name: "tls",
+			env: map[string]string{
+				"REDIS_TLS_ENABLED":     "true",
+				"REDIS_TLS_CA_FILE":     "/certs/ca.pem",
+				"REDIS_TLS_CERT_FILE":   "/certs/client.pem",
+				"REDIS_TLS_KEY_FILE":    "/certs/client.key",
+				"REDIS_TLS_SERVER_NAME": "redis.internal",
+			},
+			want: RedisConfig{
+				Host:  "localhost",
+				Port:  "6379",
+				Mode:  "standalone",
+				Addrs: []string{"localhost:6379"},
+				TLS: RedisTLSConfig{
+					Enabled:    true,
+					CAFile:     "/certs/ca.pem",
+					CertFile:   "/certs/client.pem",
+					KeyFile:    "/certs/client.key",
+					ServerName: "redis.internal",
+				},
+			},
+		},
+		{
+			name: "unknown mode",
+			env:  map[string]string{"REDIS_MODE": "replicated"},
+			err:  `invalid REDIS_MODE: "replicated", expected standalone, cluster or sentinel`,
+		},
+		{
+			name: "sentinel without master",
+			env:  map[string]string{"REDIS_MODE": "sentinel"},
+			err:  "REDIS_SENTINEL_MASTER is required when REDIS_MODE is sentinel",
+		},
+		{
+			name: "certificate without key",
+			env:  map[string]string{"REDIS_TLS_ENABLED": "true", "REDIS_TLS_CERT_FILE": "/certs/client.pem"},
+			err:  "REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together",
+		},
+		{
+			name: "invalid tls flag",
+			env:  map[string]string{"REDIS_TLS_ENABLED": "yes please"},
+			err:  `invalid REDIS_TLS_ENABLED: "yes please"`,
+		},
+		{
+			name: "negative pool size",
+			env:  map[string]string{"REDIS_POOL_SIZE": "-1"},
+			err:  `invalid REDIS_POOL_SIZE: "-1"`,
+		},
+		{
+			name: "invalid timeout",
+			env:  map[string]string{"REDIS_WRITE_TIMEOUT": "0s"},
+			err:  `invalid REDIS_WRITE_TIMEOUT: "0s"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			config, err := loadRedisConfig()
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, config)
+		})
+	}
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	tlsConfig, err := RedisConfig{}.TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	config := RedisConfig{TLS: RedisTLSConfig{
+		Enabled:    true,
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "redis.internal",
+	}}
+	tlsConfig, err = config.TLSConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "redis.internal", tlsConfig.ServerName)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	// The CA file must hold certificates
+	config.TLS.CAFile = keyFile
+	_, err = config.TLSConfig()
+	assert.ErrorContains(t, err, "no certificates found in Redis CA file")
+
+	config.TLS.CAFile = filepath.Join(dir, "missing.pem")
+	_, err = config.TLSConfig()
+	assert.ErrorContains(t, err, "failed to read Redis CA file")
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.internal"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+	return certFile, keyFile
+}
@@ -0,0 +1,103 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+)
+
+// Algorithm is the strategy used to decide whether a request fits in a limit.
+// Implementations must evaluate the limit atomically against the storage.
+type Algorithm interface {
+	// Name returns the identifier used to select the algorithm in the configuration
+	Name() string
+
+	// Take counts a request for the given key and reports whether it is allowed,
+	// blocking the key for limit.Block when the limit is exceeded
+	Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error)
+}
+
+var (
+	// FixedWindow counts requests in consecutive windows of fixed length.
+	// Clients may burst up to twice the limit across a window boundary.
+	FixedWindow Algorithm = fixedWindow{}
+
+	// SlidingWindowLog keeps the timestamp of every request within the window
+	SlidingWindowLog Algorithm = slidingWindowLog{}
+
+	// SlidingWindowCounter approximates a sliding window by weighting the
+	// previous fixed window counter
+	SlidingWindowCounter Algorithm = slidingWindowCounter{}
+
+	// TokenBucket refills a bucket of Limit tokens continuously over the window
+	TokenBucket Algorithm = tokenBucket{}
+
+	// GCRA is the generic cell rate algorithm, which spaces requests evenly
+	// while allowing bursts of up to Limit requests
+	GCRA Algorithm = gcra{}
+)
+
+var algorithms = map[string]Algorithm{
+	FixedWindow.Name():          FixedWindow,
+	SlidingWindowLog.Name():     SlidingWindowLog,
+	SlidingWindowCounter.Name(): SlidingWindowCounter,
+	TokenBucket.Name():          TokenBucket,
+	GCRA.Name():                 GCRA,
+}
+
+// ParseAlgorithm returns the algorithm registered under the given name.
+// An empty name selects FixedWindow.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return FixedWindow, nil
+	}
+
+	algorithm, exists := algorithms[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", name)
+	}
+	return algorithm, nil
+}
+
+type fixedWindow struct{}
+
+func (fixedWindow) Name() string { return "fixed_window" }
+
+func (fixedWindow) Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error) {
+	return store.FixedWindow(ctx, key, limit)
+}
+
+type slidingWindowLog struct{}
+
+func (slidingWindowLog) Name() string { return "sliding_window_log" }
+
+func (slidingWindowLog) Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error) {
+	return store.SlidingWindowLog(ctx, key, limit)
+}
+
+type slidingWindowCounter struct{}
+
+func (slidingWindowCounter) Name() string { return "sliding_window_counter" }
+
+func (slidingWindowCounter) Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error) {
+	return store.SlidingWindowCounter(ctx, key, limit)
+}
+
+type tokenBucket struct{}
+
+func (tokenBucket) Name() string { return "token_bucket" }
+
+func (tokenBucket) Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error) {
+	return store.TokenBucket(ctx, key, limit)
+}
+
+type gcra struct{}
+
+func (gcra) Name() string { return "gcra" }
+
+func (gcra) Take(ctx context.Context, store storage.Storage, key string, limit storage.Limit) (storage.Result, error) {
+	return store.GCRA(ctx, key, limit)
+}
@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/audit"
+)
+
+// record writes the audit events of a decision: a denial for every request
+// denied, or that a dry-run policy would have denied, followed by a block when
+// the request blocked its key
+func (rl *RateLimiter) record(req Request, decision Decision) {
+	if decision.Allowed && !decision.DryRun {
+		return
+	}
+
+	event := audit.Event{
+		Time:      time.Now().UTC(),
+		Type:      audit.EventDenied,
+		KeyType:   decision.KeyType,
+		Key:       audit.HashKey(rl.auditKey, decision.key),
+		Policy:    decision.Policy,
+		Tenant:    decision.Tenant,
+		Route:     strings.TrimSpace(req.Method + " " + req.Path),
+		RequestID: req.ID,
+		DryRun:    decision.DryRun,
+	}
+	switch {
+	case decision.Forbidden:
+		event.Reason = audit.ReasonInvalidToken
+	case decision.Denied:
+		event.Reason = audit.ReasonNetwork
+	default:
+		event.Reason = audit.ReasonRateLimit
+		if decision.ConcurrencyLimited {
+			event.Reason = audit.ReasonConcurrency
+		}
+		event.Limit = decision.Limit
+		event.RetryAfter = decision.RetryAfter.String()
+	}
+	rl.write(event)
+
+	if decision.Blocked {
+		event.Type = audit.EventBlocked
+		event.Reason = ""
+		event.RetryAfter = ""
+		event.BlockDuration = decision.RetryAfter.String()
+		event.Offenses = decision.Offenses
+		rl.write(event)
+	}
+}
+
+func (rl *RateLimiter) write(event audit.Event) {
+	if err := rl.audit.Write(event); err != nil {
+		log.Printf("Failed to write audit event: %v", err)
+	}
+}
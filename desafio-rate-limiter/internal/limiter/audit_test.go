@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/audit"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	sink := audit.NewChannelSink(10)
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy:      Policy{Limit: 1, Window: time.Minute, BlockDuration: 5 * time.Minute},
+			TokenPolicies: map[string]Policy{"abc123": {Limit: 10, Window: time.Minute}},
+		},
+		Audit:        sink,
+		AuditHashKey: []byte("secret"),
+	})
+	ctx := context.Background()
+
+	requests := []Request{
+		{IP: "192.0.2.1", Method: "GET", Path: "/", ID: "req-1"},
+		{IP: "192.0.2.1", Method: "GET", Path: "/", ID: "req-2"},
+		{IP: "192.0.2.1", Method: "GET", Path: "/", ID: "req-3"},
+		{Token: "abc123", ID: "req-4"},
+		{Token: "unknown", ID: "req-5"},
+	}
+	for _, req := range requests {
+		_, err := rl.Allow(ctx, req)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sink.Close())
+
+	var events []audit.Event
+	for event := range sink.Events() {
+		events = append(events, event)
+	}
+	require.Len(t, events, 4)
+
+	// The request exceeding the limit is denied and blocks the key
+	ipKey := audit.HashKey([]byte("secret"), Key("ip", "192.0.2.1"))
+	assert.Equal(t, audit.EventDenied, events[0].Type)
+	assert.Equal(t, audit.ReasonRateLimit, events[0].Reason)
+	assert.Equal(t, "ip", events[0].KeyType)
+	assert.Equal(t, ipKey, events[0].Key)
+	assert.Equal(t, "ip", events[0].Policy)
+	assert.Equal(t, 1, events[0].Limit)
+	assert.Equal(t, "GET /", events[0].Route)
+	assert.Equal(t, "req-2", events[0].RequestID)
+
+	assert.Equal(t, audit.EventBlocked, events[1].Type)
+	assert.Equal(t, ipKey, events[1].Key)
+	assert.Equal(t, "5m0s", events[1].BlockDuration)
+	assert.Equal(t, "req-2", events[1].RequestID)
+
+	// The requests of the blocked key are only denied
+	assert.Equal(t, audit.EventDenied, events[2].Type)
+	assert.Equal(t, "req-3", events[2].RequestID)
+
+	assert.Equal(t, audit.EventDenied, events[3].Type)
+	assert.Equal(t, audit.ReasonInvalidToken, events[3].Reason)
+	assert.Equal(t, audit.HashKey([]byte("secret"), Key("token", TokenID("unknown"))), events[3].Key)
+	assert.Empty(t, events[3].Route)
+}
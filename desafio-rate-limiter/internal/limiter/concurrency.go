@@ -0,0 +1,93 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+)
+
+// defaultLeaseTimeout bounds how long a request that is never released, such
+// as one of a crashed instance, holds its slot
+const defaultLeaseTimeout = time.Minute
+
+// lease is a slot of a concurrency limit held by a request in flight, kept in
+// the storage that granted it
+type lease struct {
+	store storage.Storage
+	key   string
+	id    string
+}
+
+// acquire takes a slot of the concurrency limit of the policy for the key,
+// denying the decision when every slot is held. Storage errors are decided by
+// the failure mode like the rate limits.
+func (rl *RateLimiter) acquire(ctx context.Context, decision *Decision, key string, policy Policy) error {
+	ttl := policy.LeaseTimeout
+	if ttl <= 0 {
+		ttl = defaultLeaseTimeout
+	}
+	id, err := newLeaseID()
+	if err != nil {
+		return err
+	}
+
+	store := rl.storage
+	result, err := store.Acquire(ctx, key, id, int64(policy.Concurrency), ttl)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		switch {
+		case rl.failureMode == FailClosed:
+			result = storage.Result{}
+		case rl.failureMode == FailLocal && rl.fallback != nil:
+			store = rl.fallback
+			if result, err = store.Acquire(ctx, key, id, int64(policy.Concurrency), ttl); err != nil {
+				return err
+			}
+		case rl.failureMode == FailLocal:
+			return err
+		default:
+			// Fail open, the request runs without holding a slot
+			return nil
+		}
+	}
+
+	if !result.Allowed {
+		decision.Allowed = false
+		decision.ConcurrencyLimited = true
+		decision.RetryAfter = time.Second
+		return nil
+	}
+	decision.leases = append(decision.leases, lease{store: store, key: key, id: id})
+	return nil
+}
+
+// Release frees the slots of the concurrency limits held by an allowed
+// request. It must be called once the request completes, a request that is
+// never released holds its slots until their lease timeout.
+func (rl *RateLimiter) Release(ctx context.Context, decision Decision) {
+	release(ctx, decision.leases)
+}
+
+func release(ctx context.Context, leases []lease) {
+	for _, l := range leases {
+		if err := l.store.Release(ctx, l.key, l.id); err != nil {
+			log.Printf("Failed to release lease of %s, it expires on its own: %v", l.key, err)
+		}
+	}
+}
+
+// newLeaseID returns a random lease id, unique across instances
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lease id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{Limit: 100, Window: time.Minute, Concurrency: 2},
+			RoutePolicies: []RoutePolicy{
+				{Pattern: "/reports/*", Policy: Policy{Limit: 100, Window: time.Minute, Concurrency: 1}},
+			},
+		},
+	})
+	ctx := context.Background()
+	req := Request{IP: "192.0.2.1", Method: "GET", Path: "/"}
+
+	first, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, first.Allowed)
+	second, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, second.Allowed)
+
+	denied, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, denied.Allowed)
+	assert.True(t, denied.ConcurrencyLimited)
+	assert.Equal(t, time.Second, denied.RetryAfter)
+
+	// A completed request frees its slot
+	rl.Release(ctx, first)
+	report, err := rl.Allow(ctx, Request{IP: "192.0.2.1", Method: "GET", Path: "/reports/daily"})
+	require.NoError(t, err)
+	assert.True(t, report.Allowed)
+
+	// A request denied by its route does not keep the slot of the IP
+	rl.Release(ctx, second)
+	denied, err = rl.Allow(ctx, Request{IP: "192.0.2.1", Method: "GET", Path: "/reports/monthly"})
+	require.NoError(t, err)
+	assert.True(t, denied.ConcurrencyLimited)
+	assert.Equal(t, "route", denied.KeyType)
+	decision, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	// The report holds the slots of both the IP and the route
+	rl.Release(ctx, report)
+	state, err := store.Inspect(ctx, Key("ip", "192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), state.InFlight)
+}
+
+// downLeaseStorage fails every lease acquisition
+type downLeaseStorage struct {
+	storage.Storage
+}
+
+func (downLeaseStorage) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestConcurrencyFailureModes(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rules := Rules{IPPolicy: Policy{Limit: 100, Window: time.Minute, Concurrency: 1}}
+	req := Request{IP: "192.0.2.1"}
+
+	tests := []struct {
+		name    string
+		mode    FailureMode
+		allowed bool
+	}{
+		{name: "open", mode: FailOpen, allowed: true},
+		{name: "closed", mode: FailClosed, allowed: false},
+		{name: "local", mode: FailLocal, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := storage.NewMemoryStorage(time.Minute)
+			defer fallback.Close()
+			rl := NewRateLimiter(Config{Storage: downLeaseStorage{store}, Rules: rules, FailureMode: tt.mode, Fallback: fallback})
+
+			decision, err := rl.Allow(context.Background(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, decision.Allowed)
+			rl.Release(context.Background(), decision)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+)
+
+// FailureMode decides the requests that could not be checked because the
+// storage failed
+type FailureMode int
+
+const (
+	// FailOpen allows the requests, keeping the API available without limits
+	FailOpen FailureMode = iota
+	// FailClosed rejects the requests
+	FailClosed
+	// FailLocal enforces the policies with the fallback storage of the instance,
+	// so each instance limits the requests it receives on its own
+	FailLocal
+)
+
+var failureModes = map[string]FailureMode{
+	"open":   FailOpen,
+	"closed": FailClosed,
+	"local":  FailLocal,
+}
+
+// ParseFailureMode returns the failure mode with the given name: "open",
+// "closed" or "local". An empty name selects FailOpen.
+func ParseFailureMode(name string) (FailureMode, error) {
+	if name == "" {
+		return FailOpen, nil
+	}
+	mode, exists := failureModes[name]
+	if !exists {
+		return FailOpen, fmt.Errorf("unknown failure mode %q", name)
+	}
+	return mode, nil
+}
+
+func (m FailureMode) String() string {
+	for name, mode := range failureModes {
+		if mode == m {
+			return name
+		}
+	}
+	return fmt.Sprintf("FailureMode(%d)", int(m))
+}
+
+// fail decides a request the storage failed to check according to the failure
+// mode. The error is returned when the request was canceled or the fallback
+// storage fails too.
+func (rl *RateLimiter) fail(ctx context.Context, take func(store storage.Storage) (storage.Result, error), limit storage.Limit, cause error) (storage.Result, error) {
+	if ctx.Err() != nil {
+		return storage.Result{}, cause
+	}
+
+	switch rl.failureMode {
+	case FailClosed:
+		return storage.Result{RetryAfter: limit.Period, ResetAfter: limit.Period}, nil
+	case FailLocal:
+		if rl.fallback == nil {
+			return storage.Result{}, cause
+		}
+		result, err := take(rl.fallback)
+		if err != nil {
+			return storage.Result{}, fmt.Errorf("%w (fallback: %v)", cause, err)
+		}
+		return result, nil
+	default:
+		return storage.Result{Allowed: true, Remaining: limit.Rate, ResetAfter: limit.Period}, nil
+	}
+}
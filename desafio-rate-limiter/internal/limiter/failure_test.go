@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downStorage fails every rate limit check
+type downStorage struct {
+	storage.Storage
+}
+
+func (downStorage) FixedWindow(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestFailureModes(t *testing.T) {
+	rules := Rules{IPPolicy: Policy{Limit: 2, Window: time.Minute}}
+	req := Request{IP: "192.0.2.1"}
+
+	t.Run("open allows the requests", func(t *testing.T) {
+		rl := NewRateLimiter(Config{Storage: downStorage{}, Rules: rules, FailureMode: FailOpen})
+
+		decision, err := rl.Allow(context.Background(), req)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(2), decision.Remaining)
+	})
+
+	t.Run("closed rejects the requests", func(t *testing.T) {
+		rl := NewRateLimiter(Config{Storage: downStorage{}, Rules: rules, FailureMode: FailClosed})
+
+		decision, err := rl.Allow(context.Background(), req)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, time.Minute, decision.RetryAfter)
+	})
+
+	t.Run("local enforces the policies with the fallback storage", func(t *testing.T) {
+		fallback := storage.NewMemoryStorage(time.Minute)
+		defer fallback.Close()
+		rl := NewRateLimiter(Config{Storage: downStorage{}, Rules: rules, FailureMode: FailLocal, Fallback: fallback})
+
+		for i := 0; i < 2; i++ {
+			decision, err := rl.Allow(context.Background(), req)
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+		}
+		decision, err := rl.Allow(context.Background(), req)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+	})
+
+	t.Run("canceled requests return the error", func(t *testing.T) {
+		rl := NewRateLimiter(Config{Storage: downStorage{}, Rules: rules, FailureMode: FailOpen})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := rl.Allow(ctx, req)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseFailureMode(t *testing.T) {
+	mode, err := ParseFailureMode("local")
+	require.NoError(t, err)
+	assert.Equal(t, FailLocal, mode)
+	assert.Equal(t, "local", mode.String())
+
+	mode, err = ParseFailureMode("")
+	require.NoError(t, err)
+	assert.Equal(t, FailOpen, mode)
+
+	_, err = ParseFailureMode("maybe")
+	assert.Error(t, err)
+}
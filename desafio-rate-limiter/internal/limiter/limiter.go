@@ -2,108 +2,624 @@ package limiter
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/audit"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
 )
 
-type Config struct {
-	Storage       storage.Storage
-	IPLimit       int
+// Policy defines how many requests are allowed per window, the algorithm used
+// to enforce it and for how long a key is blocked once it exceeds the limit.
+// A zero BlockDuration only rejects the requests above the limit.
+type Policy struct {
+	Limit         int
+	Window        time.Duration
+	Algorithm     Algorithm
 	BlockDuration time.Duration
-	TokenLimits   map[string]int
+	// BlockMultiplier multiplies BlockDuration on every repeated block of a key
+	// within BlockLookback, up to MaxBlockDuration when positive. Values up to 1
+	// keep the block fixed. A zero BlockLookback does not track repeated blocks.
+	BlockMultiplier  float64
+	MaxBlockDuration time.Duration
+	BlockLookback    time.Duration
+	// Quotas are enforced atomically together with Limit, e.g. 500 requests per
+	// minute and 100000 per day on top of 10 per second. Policies with quotas
+	// count every window as a fixed window, whatever their Algorithm, and only
+	// exceeding Limit blocks the key.
+	Quotas []Quota
+	// Concurrency caps the requests of a key in flight at once, zero does not
+	// cap them. An allowed request holds a lease until it is released, or for
+	// at most LeaseTimeout (a minute by default) if it never is.
+	Concurrency  int
+	LeaseTimeout time.Duration
+	// DryRun evaluates the policy without enforcing it: the requests the
+	// policy denies are allowed and reported as dry-run denials. Dry-run
+	// policies count requests apart from enforced ones, under the key prefixed
+	// with "shadow:", and never block keys, so they only report the requests
+	// above their limits.
+	DryRun bool
+	// Shadow is a candidate policy evaluated in dry-run mode next to the
+	// policy, which is still enforced, e.g. a tighter limit to roll out. Only
+	// the requests the policy allows are evaluated by the shadow.
+	Shadow *Policy
+}
+
+// Quota is an additional limit of requests per window
+type Quota struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Request identifies the client and the route of a request
+type Request struct {
+	IP     string
+	Token  string
+	Method string
+	Path   string
+	// Cost is the number of units of the limits the request consumes, such as
+	// one unit per megabyte of its body. Zero counts as one unit.
+	Cost int
+	// ID identifies the request in the audit events, e.g. its X-Request-Id
+	ID string
+	// Tenant is the tenant the request claims, e.g. its X-Tenant-ID, and must
+	// only be set when the claim comes from a trusted source. It is ignored
+	// when the token of the request belongs to a tenant or when the tenant is
+	// not registered, and only adds the limit of the tenant: the client is
+	// counted with the same keys as without it.
+	Tenant string
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed bool
+	// Forbidden reports that the request carried a token that is not registered
+	Forbidden bool
+	// Denied reports that the client network is denylisted
+	Denied bool
+	// Exempt reports that the client network is allowlisted and the request
+	// was allowed without being counted
+	Exempt bool
+	// KeyType is the kind of key the decision was taken for: "ip", "token",
+	// "network", "tenant" or "route"
+	KeyType string
+	// Policy names the policy that took the decision: "ip", "token", the
+	// network of a network policy, the name of a tenant or of a route policy
+	Policy string
+	// Tenant is the tenant the request was counted in, if any
+	Tenant string
+	// Limit and Window are those of the tightest quota when the policy has quotas
+	Limit  int
+	Window time.Duration
+	// Remaining is the number of requests still available in the window
+	Remaining int64
+	// ResetAfter is the time until the limit is fully restored
+	ResetAfter time.Duration
+	// RetryAfter is the time until the next request may be allowed, including
+	// the remaining block duration of a blocked key
+	RetryAfter time.Duration
+	// Offenses is the number of times the key was blocked within the lookback
+	// of the policy, set when the request blocked the key
+	Offenses int64
+	// Blocked reports that the request blocked the key for RetryAfter
+	Blocked bool
+	// ConcurrencyLimited reports that the request was denied because the key
+	// already had Concurrency requests in flight
+	ConcurrencyLimited bool
+	// CostExceeded reports that the request was denied because its cost is
+	// above the limit or one of its quotas, so that it is never allowed
+	CostExceeded bool
+	// DryRun reports that the request was allowed only because the policy
+	// that denied it runs in dry-run mode
+	DryRun bool
+
+	// leases are the concurrency slots held by the allowed request
+	leases []lease
+	// key is the storage key the decision was taken for
+	key string
+}
+
+// Rules are the policies enforced by the rate limiter. They are replaced as a
+// whole with RateLimiter.SetRules, so every request is checked against a
+// consistent set of policies.
+type Rules struct {
+	IPPolicy Policy
+	// TokenPolicies are the policies of plaintext tokens, counted in the
+	// storage under their hash
+	TokenPolicies map[string]Policy
+	// APIKeys resolves hashed and signed API keys to their id, whose policy is
+	// in KeyPolicies. The keys are counted in the storage under their id.
+	APIKeys     *apikey.Keyring
+	KeyPolicies map[string]Policy
+	// NetworkPolicies allow, deny or override the IP policy for the addresses
+	// they contain. The most specific network applies.
+	NetworkPolicies []NetworkPolicy
+	// RoutePolicies are enforced on top of the IP or token policy for the
+	// requests matching them. The first matching route applies.
+	RoutePolicies []RoutePolicy
+	// RouteCosts set the cost of the requests matching them, replacing the
+	// cost of the request. The first matching route applies.
+	RouteCosts []RouteCost
+	// Tenants are limited in aggregate on top of the policies of their
+	// clients, which are counted within their tenant
+	Tenants map[string]Tenant
+
+	// networks indexes NetworkPolicies, built by SetRules
+	networks *networkTrie
+	// tenants indexes the tokens and API keys of Tenants, built by SetRules
+	tenants map[string]string
+}
+
+// Observer is notified of every decision taken by the rate limiter
+type Observer interface {
+	ObserveDecision(decision Decision)
+}
+
+type Config struct {
+	Storage storage.Storage
+	Rules   Rules
+	// Observer is optional
+	Observer Observer
+	// FailureMode decides the requests checked while Storage fails. FailLocal
+	// requires a Fallback storage, without it the error is returned.
+	FailureMode FailureMode
+	Fallback    storage.Storage
+	// Audit receives an event for every denial and block, it is optional
+	Audit audit.Sink
+	// AuditHashKey is the secret of the hashes of the keys in the audit events
+	AuditHashKey []byte
 }
 
 type RateLimiter struct {
-	config Config
+	storage     storage.Storage
+	rules       atomic.Pointer[Rules]
+	observer    Observer
+	failureMode FailureMode
+	fallback    storage.Storage
+	audit       audit.Sink
+	auditKey    []byte
+	// blockLog logs the blocks of repeat offenders and dryRunLog the requests
+	// dry-run policies would have denied
+	blockLog  logLimiter
+	dryRunLog logLimiter
+
+	// mu serializes the updates of the rules. overrides are the tokens
+	// registered or revoked at runtime, by token id, applied on top of every
+	// rules set with SetRules so that they survive policy reloads.
+	mu        sync.Mutex
+	overrides map[string]tokenOverride
+}
+
+// tokenOverride is a token registered or revoked at runtime
+type tokenOverride struct {
+	token   string
+	policy  Policy
+	revoked bool
 }
 
 func NewRateLimiter(cfg Config) *RateLimiter {
-	return &RateLimiter{
-		config: cfg,
+	rl := &RateLimiter{
+		storage:     cfg.Storage,
+		observer:    cfg.Observer,
+		failureMode: cfg.FailureMode,
+		fallback:    cfg.Fallback,
+		audit:       cfg.Audit,
+		auditKey:    cfg.AuditHashKey,
+	}
+	rl.SetRules(cfg.Rules)
+	return rl
+}
+
+// Rules returns the rules currently enforced. They must not be modified.
+func (rl *RateLimiter) Rules() *Rules {
+	return rl.rules.Load()
+}
+
+// SetRules atomically replaces the enforced rules. Requests being checked
+// finish with the rules they started with. Tokens registered or revoked with
+// SetTokenPolicy and RemoveToken keep their runtime state.
+func (rl *RateLimiter) SetRules(rules Rules) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.store(rules)
+}
+
+// store applies the runtime token overrides to the rules and enforces them.
+// rl.mu must be held.
+func (rl *RateLimiter) store(rules Rules) {
+	if len(rl.overrides) > 0 {
+		tokens := make(map[string]Policy, len(rules.TokenPolicies)+len(rl.overrides))
+		for token, policy := range rules.TokenPolicies {
+			if override, exists := rl.overrides[TokenID(token)]; !exists || !override.revoked {
+				tokens[token] = policy
+			}
+		}
+		for _, override := range rl.overrides {
+			if !override.revoked {
+				tokens[override.token] = override.policy
+			}
+		}
+		rules.TokenPolicies = tokens
+	}
+	rules.networks = newNetworkTrie(rules.NetworkPolicies)
+	rules.tenants = newTenantIndex(rules.Tenants)
+	rl.rules.Store(&rules)
+}
+
+// Allow checks if a request should be allowed based on IP or token and on the
+// policy of its route. An allowed request may hold slots of concurrency limits,
+// which must be freed with Release once it completes.
+func (rl *RateLimiter) Allow(ctx context.Context, req Request) (Decision, error) {
+	decision, err := rl.allow(ctx, req)
+	if err != nil {
+		return decision, err
+	}
+	if rl.observer != nil {
+		rl.observer.ObserveDecision(decision)
+	}
+	if rl.audit != nil {
+		rl.record(req, decision)
+	}
+	return decision, nil
+}
+
+func (rl *RateLimiter) allow(ctx context.Context, req Request) (Decision, error) {
+	rules := rl.rules.Load()
+
+	// Token takes precedence over IP. Only the tenant a token belongs to
+	// scopes the keys of the client, a claimed tenant is checked on top of
+	// the keys of the client
+	var keyType, id string
+	var policy Policy
+	var registered bool
+	client := "ip:" + req.IP
+	if req.Token != "" {
+		keyType, id, policy, registered = rules.resolveToken(req.Token)
+		client = keyType + ":" + id
+	}
+	tenant, member := rules.resolveTenant(client, req.Tenant)
+	scope := ""
+	if member {
+		scope = tenant
+		client = "tenant:" + tenant + ":" + client
+	}
+
+	// Allowlisted and denylisted networks are resolved before any counting
+	network, inNetwork := rules.matchNetwork(req.IP)
+	if inNetwork {
+		switch network.Action {
+		case NetworkAllow:
+			return Decision{Allowed: true, Exempt: true, KeyType: "network", Policy: network.Prefix.String(), Tenant: tenant}, nil
+		case NetworkDeny:
+			return Decision{Denied: true, KeyType: "network", Policy: network.Prefix.String(), Tenant: tenant, key: network.key(req.IP)}, nil
+		}
+	}
+
+	// Every limit the request is checked against spends its cost
+	cost := int64(max(req.Cost, 1))
+	if routeCost, matched := rules.matchRouteCost(req.Method, req.Path); matched {
+		cost = int64(routeCost.Cost)
+	}
+
+	// The client is checked first, then its tenant and the route of the
+	// request. Route limits are counted per client.
+	var decision Decision
+	var err error
+	if req.Token != "" {
+		decision, err = rl.checkToken(ctx, TenantKey(scope, keyType, id), policy, registered, cost)
+	} else {
+		decision, err = rl.checkIP(ctx, rules, req.IP, network, inNetwork, cost)
+	}
+	if err == nil && decision.Allowed && tenant != "" {
+		tenantDecision, tenantErr := rl.checkTenant(ctx, tenant, rules.Tenants[tenant], cost)
+		decision, err = combine(ctx, decision, tenantDecision, tenantErr)
+	}
+	if err == nil && decision.Allowed {
+		if route, matched := rules.matchRoute(req.Method, req.Path); matched {
+			routeDecision, routeErr := rl.checkRoute(ctx, route, client, cost)
+			decision, err = combine(ctx, decision, routeDecision, routeErr)
+		}
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+	decision.Tenant = tenant
+	return decision, nil
+}
+
+// combine returns the decision of an allowed request checked against another
+// limit. A denial of the other limit denies the request, releasing its
+// leases. Otherwise the tightest of both limits is reported, a dry-run denial
+// being tighter than any allowed request, and the request holds the leases of
+// both.
+func combine(ctx context.Context, decision, other Decision, err error) (Decision, error) {
+	if err != nil {
+		release(ctx, decision.leases)
+		return Decision{}, err
+	}
+	if !other.Allowed {
+		release(ctx, decision.leases)
+		return other, nil
 	}
+
+	leases := append(decision.leases, other.leases...)
+	if other.DryRun || (!decision.DryRun && other.Remaining < decision.Remaining) {
+		decision = other
+	}
+	decision.leases = leases
+	return decision, nil
 }
 
-// Allow checks if a request should be allowed based on IP or token
-func (rl *RateLimiter) Allow(ctx context.Context, ip string, token string) (bool, error) {
-	// Token takes precedence over IP
-	if token != "" {
-		return rl.checkToken(ctx, token)
+// SetTokenPolicy registers the token or replaces its policy. The policy
+// overrides the one of the token in the rules set later with SetRules, until
+// the process restarts.
+func (rl *RateLimiter) SetTokenPolicy(token string, policy Policy) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.overrides == nil {
+		rl.overrides = make(map[string]tokenOverride)
+	}
+	rl.overrides[TokenID(token)] = tokenOverride{token: token, policy: policy}
+	rl.store(*rl.rules.Load())
+}
+
+// RemoveToken revokes the token with the id, see TokenID, and reports whether
+// it was registered. The token stays revoked in the rules set later with
+// SetRules, until the process restarts or it is registered again.
+func (rl *RateLimiter) RemoveToken(id string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	registered := false
+	for token := range rl.rules.Load().TokenPolicies {
+		if TokenID(token) == id {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return false
 	}
+	if rl.overrides == nil {
+		rl.overrides = make(map[string]tokenOverride)
+	}
+	rl.overrides[id] = tokenOverride{revoked: true}
+	rl.store(*rl.rules.Load())
+	return true
+}
+
+// Key returns the storage key of an IP or token, e.g. Key("ip", "10.0.0.1")
+// returns "ratelimit:{ip:10.0.0.1}". The client is a Redis hash tag, so every
+// key derived from it lands on the same Redis Cluster slot.
+func Key(keyType, id string) string {
+	return "ratelimit:{" + keyType + ":" + id + "}"
+}
 
-	return rl.checkIP(ctx, ip)
+// shadowKey returns the key counting the requests of the given key for dry-run
+// policies, e.g. "shadow:ratelimit:{ip:10.0.0.1}", keeping its hash tag
+func shadowKey(key string) string {
+	return "shadow:" + key
 }
 
-// IsTokenRegistered checks if a token is registered in the configuration
+// TokenID returns the id of a plaintext token in the storage keys, a hash of
+// the token, so that the token itself is not written to the storage
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// IsTokenRegistered checks if a token is registered in the configuration,
+// either in plaintext or as a valid API key
 func (rl *RateLimiter) IsTokenRegistered(token string) bool {
-	_, exists := rl.config.TokenLimits[token]
-	return exists
+	_, _, _, registered := rl.rules.Load().resolveToken(token)
+	return registered
+}
+
+// resolveToken returns the storage key type and id of a token, and its policy
+// when it is registered. Plaintext tokens are counted as "token" under their
+// hash and API keys as "key" under their id.
+func (r *Rules) resolveToken(token string) (keyType, id string, policy Policy, registered bool) {
+	if policy, exists := r.TokenPolicies[token]; exists {
+		return "token", TokenID(token), policy, true
+	}
+	if id, valid := r.APIKeys.Resolve(token); valid {
+		if policy, exists := r.KeyPolicies[id]; exists {
+			return "key", id, policy, true
+		}
+	}
+	return "token", TokenID(token), Policy{}, false
 }
 
-func (rl *RateLimiter) checkIP(ctx context.Context, ip string) (bool, error) {
-	key := fmt.Sprintf("ratelimit:ip:%s", ip)
+// checkIP applies the policy of the network of the IP, if any, or the IP policy
+func (rl *RateLimiter) checkIP(ctx context.Context, rules *Rules, ip string, network NetworkPolicy, inNetwork bool, cost int64) (Decision, error) {
+	key, keyType, name, policy := Key("ip", ip), "ip", "ip", rules.IPPolicy
+	if inNetwork {
+		key, keyType, name, policy = network.key(ip), "network", network.Prefix.String(), network.Policy
+	}
 
-	// Check if IP is blocked
-	blocked, err := rl.config.Storage.IsBlocked(ctx, key)
+	decision, err := rl.check(ctx, key, keyType, name, policy, cost)
 	if err != nil {
-		return false, fmt.Errorf("failed to check if IP is blocked: %w", err)
+		return Decision{}, fmt.Errorf("failed to check IP rate limit: %w", err)
+	}
+	return decision, nil
+}
+
+func (rl *RateLimiter) checkToken(ctx context.Context, key string, policy Policy, registered bool, cost int64) (Decision, error) {
+	if !registered {
+		// Token not registered, deny access
+		return Decision{Forbidden: true, KeyType: "token", Policy: "token", key: key}, nil
 	}
-	if blocked {
-		return false, nil
+
+	decision, err := rl.check(ctx, key, "token", "token", policy, cost)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to check token rate limit: %w", err)
 	}
+	return decision, nil
+}
 
-	// Increment counter
-	count, err := rl.config.Storage.Increment(ctx, key, 1*time.Second)
+func (rl *RateLimiter) checkRoute(ctx context.Context, route RoutePolicy, client string, cost int64) (Decision, error) {
+	decision, err := rl.check(ctx, route.key(client), "route", route.Name(), route.Policy, cost)
 	if err != nil {
-		return false, fmt.Errorf("failed to increment IP counter: %w", err)
+		return Decision{}, fmt.Errorf("failed to check route rate limit: %w", err)
 	}
+	return decision, nil
+}
 
-	// Check if limit exceeded
-	if count > int64(rl.config.IPLimit) {
-		// Block the IP
-		if err := rl.config.Storage.SetBlock(ctx, key, rl.config.BlockDuration); err != nil {
-			return false, fmt.Errorf("failed to block IP: %w", err)
+// matchNetwork returns the most specific network policy containing the IP or
+// the IPv6 network of the client
+func (r *Rules) matchNetwork(ip string) (NetworkPolicy, bool) {
+	// Aggregated IPv6 clients are identified by their network, e.g. "2001:db8::/64"
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return NetworkPolicy{}, false
 		}
-		return false, nil
+		addr = prefix.Addr()
 	}
+	addr = addr.Unmap()
 
-	return true, nil
+	if r.networks == nil {
+		return NetworkPolicy{}, false
+	}
+	return r.networks.lookup(addr)
 }
 
-func (rl *RateLimiter) checkToken(ctx context.Context, token string) (bool, error) {
-	// Check if token exists in the configured tokens
-	limit, exists := rl.config.TokenLimits[token]
-	if !exists {
-		// Token not registered, deny access
-		return false, nil
+// check applies the policy to the key, followed by its shadow policy when the
+// request is allowed
+func (rl *RateLimiter) check(ctx context.Context, key, keyType, name string, policy Policy, cost int64) (Decision, error) {
+	decision, err := rl.evaluate(ctx, key, keyType, name, policy, cost)
+	if err != nil || !decision.Allowed || policy.Shadow == nil {
+		return decision, err
 	}
 
-	key := fmt.Sprintf("ratelimit:token:%s", token)
-
-	// Check if token is blocked
-	blocked, err := rl.config.Storage.IsBlocked(ctx, key)
+	shadow := *policy.Shadow
+	shadow.DryRun = true
+	shadowDecision, err := rl.evaluate(ctx, key, keyType, name, shadow, cost)
 	if err != nil {
-		return false, fmt.Errorf("failed to check if token is blocked: %w", err)
+		// The shadow policy is not enforced, so neither are its errors
+		rl.dryRunLog.Printf("Dry run: failed to check %s policy %s for %s: %v", keyType, name, key, err)
+		return decision, nil
+	}
+
+	// The shadow policy is only reported when it would have denied the request
+	leases := append(decision.leases, shadowDecision.leases...)
+	if shadowDecision.DryRun {
+		decision = shadowDecision
+	}
+	decision.leases = leases
+	return decision, nil
+}
+
+// evaluate applies the policy to the key, spending cost units of its limits.
+// Checking the block, counting the request and blocking the key once the limit
+// is exceeded happen in a single storage call. Dry-run policies count the
+// request under the shadow key, without blocking it.
+func (rl *RateLimiter) evaluate(ctx context.Context, key, keyType, name string, policy Policy, cost int64) (Decision, error) {
+	storageKey := key
+	if policy.DryRun {
+		storageKey = shadowKey(key)
+		policy.BlockDuration = 0
+	}
+
+	algorithm := policy.Algorithm
+	if algorithm == nil {
+		algorithm = FixedWindow
+	}
+	window := policy.Window
+	if window <= 0 {
+		window = time.Second
+	}
+
+	decision := Decision{
+		KeyType: keyType,
+		Policy:  name,
+		Limit:   policy.Limit,
+		Window:  window,
+		key:     key,
+	}
+
+	// A non-positive limit denies every request, as does a cost that can never
+	// fit in the limit or in one of its quotas, which is reported
+	decision.CostExceeded = policy.Limit > 0 && cost > int64(policy.Limit)
+	for _, quota := range policy.Quotas {
+		if policy.Limit > 0 && !decision.CostExceeded && cost > int64(quota.Limit) {
+			decision.CostExceeded = true
+			decision.Limit, decision.Window = quota.Limit, quota.Window
+		}
 	}
-	if blocked {
-		return false, nil
+	if policy.Limit <= 0 || decision.CostExceeded {
+		decision.RetryAfter = decision.Window
+		decision.ResetAfter = decision.Window
+		return rl.dryRun(decision, key, policy), nil
+	}
+
+	limit := storage.Limit{
+		Rate:            int64(policy.Limit),
+		Period:          window,
+		Block:           policy.BlockDuration,
+		Cost:            cost,
+		BlockLookback:   policy.BlockLookback,
+		BlockMultiplier: policy.BlockMultiplier,
+		MaxBlock:        policy.MaxBlockDuration,
+	}
+	operation, take := algorithm.Name(), func(store storage.Storage) (storage.Result, error) {
+		return algorithm.Take(ctx, store, storageKey, limit)
+	}
+	limits := []storage.Limit{limit}
+	if len(policy.Quotas) > 0 {
+		for _, quota := range policy.Quotas {
+			limits = append(limits, storage.Limit{Rate: int64(quota.Limit), Period: quota.Window, Cost: cost})
+		}
+		operation, take = "quotas", func(store storage.Storage) (storage.Result, error) {
+			return store.Quotas(ctx, storageKey, limits)
+		}
 	}
 
-	// Increment counter
-	count, err := rl.config.Storage.Increment(ctx, key, 1*time.Second)
+	result, err := take(rl.storage)
 	if err != nil {
-		return false, fmt.Errorf("failed to increment token counter: %w", err)
+		result, err = rl.fail(ctx, take, limit, err)
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to apply %s: %w", operation, err)
+		}
 	}
 
-	// Check if limit exceeded
-	if count > int64(limit) {
-		// Block the token
-		if err := rl.config.Storage.SetBlock(ctx, key, rl.config.BlockDuration); err != nil {
-			return false, fmt.Errorf("failed to block token: %w", err)
+	// Report the quota the storage evaluated as the tightest
+	if result.Index > 0 && result.Index < len(limits) {
+		decision.Limit = int(limits[result.Index].Rate)
+		decision.Window = limits[result.Index].Period
+	}
+	decision.Allowed = result.Allowed
+	decision.Remaining = result.Remaining
+	decision.ResetAfter = result.ResetAfter
+	decision.RetryAfter = result.RetryAfter
+	decision.Offenses = result.Offenses
+	decision.Blocked = result.Blocked
+	if result.Offenses > 0 {
+		rl.blockLog.Printf("Blocked %s for %s (offense %d within %s)", key, result.RetryAfter, result.Offenses, policy.BlockLookback)
+	}
+
+	if decision.Allowed && policy.Concurrency > 0 {
+		if err := rl.acquire(ctx, &decision, storageKey, policy); err != nil {
+			return Decision{}, fmt.Errorf("failed to acquire lease: %w", err)
 		}
-		return false, nil
 	}
+	return rl.dryRun(decision, key, policy), nil
+}
 
-	return true, nil
+// dryRun allows a request denied by a dry-run policy, logging the denial it
+// would have been
+func (rl *RateLimiter) dryRun(decision Decision, key string, policy Policy) Decision {
+	if decision.Allowed || !policy.DryRun {
+		return decision
+	}
+	rl.dryRunLog.Printf("Dry run: %s policy %s would have denied %s (retry after %s)", decision.KeyType, decision.Policy, key, decision.RetryAfter)
+	decision.Allowed = true
+	decision.DryRun = true
+	return decision
 }
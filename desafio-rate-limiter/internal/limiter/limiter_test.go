@@ -0,0 +1,318 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowDecision(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy:      Policy{Limit: 2, Window: 10 * time.Second, BlockDuration: time.Minute},
+			TokenPolicies: map[string]Policy{"abc123": {Limit: 5, Window: time.Second}},
+		},
+	})
+	ctx := context.Background()
+	req := Request{IP: "192.0.2.1"}
+
+	for _, remaining := range []int64{1, 0} {
+		decision, err := rl.Allow(ctx, req)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "ip", decision.KeyType)
+		assert.Equal(t, "ip", decision.Policy)
+		assert.Equal(t, 2, decision.Limit)
+		assert.Equal(t, 10*time.Second, decision.Window)
+		assert.Equal(t, remaining, decision.Remaining)
+		assert.Positive(t, decision.ResetAfter)
+		assert.Zero(t, decision.RetryAfter)
+	}
+
+	// The request exceeding the limit blocks the IP for the block duration
+	decision, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.True(t, decision.Blocked)
+	assert.Equal(t, time.Minute, decision.RetryAfter)
+
+	// The next requests retry after the remaining block
+	decision, err = rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.False(t, decision.Blocked)
+	assert.InDelta(t, time.Minute, decision.RetryAfter, float64(time.Second))
+	assert.Zero(t, decision.Remaining)
+
+	// A token has its own limit, whatever the IP
+	decision, err = rl.Allow(ctx, Request{IP: "192.0.2.1", Token: "abc123"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "token", decision.KeyType)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, int64(4), decision.Remaining)
+}
+
+func TestDryRun(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{Limit: 2, Window: time.Minute, BlockDuration: time.Minute, BlockMultiplier: 2, BlockLookback: time.Hour, DryRun: true},
+			RoutePolicies: []RoutePolicy{
+				{Pattern: "/login", Policy: Policy{Limit: 100, Window: time.Minute}},
+			},
+		},
+	})
+	ctx := context.Background()
+	req := Request{IP: "192.0.2.1", Method: "POST", Path: "/login"}
+
+	for i := 0; i < 2; i++ {
+		decision, err := rl.Allow(ctx, req)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.False(t, decision.DryRun)
+	}
+
+	// Requests above the limit are let through and reported as dry-run
+	// denials, even though the route has more requests remaining
+	for i := 0; i < 2; i++ {
+		decision, err := rl.Allow(ctx, req)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.True(t, decision.DryRun)
+		assert.False(t, decision.Blocked)
+		assert.Equal(t, "ip", decision.Policy)
+		assert.Positive(t, decision.RetryAfter)
+	}
+
+	// The requests are counted under the shadow key, which is never blocked
+	for _, key := range []string{Key("ip", "192.0.2.1"), shadowKey(Key("ip", "192.0.2.1"))} {
+		state, err := store.Inspect(ctx, key)
+		require.NoError(t, err)
+		assert.False(t, state.Blocked, key)
+		assert.Zero(t, state.Offenses, key)
+	}
+	count, err := store.Get(ctx, shadowKey(Key("ip", "192.0.2.1")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	// Enforcing the policy starts counting from scratch
+	rules := *rl.Rules()
+	rules.IPPolicy.DryRun = false
+	rl.SetRules(rules)
+	decision, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.False(t, decision.DryRun)
+}
+
+func TestShadowPolicy(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{
+				Limit:         3,
+				Window:        time.Minute,
+				BlockDuration: time.Minute,
+				Shadow:        &Policy{Limit: 1, Window: time.Minute, BlockDuration: time.Hour},
+			},
+		},
+	})
+	ctx := context.Background()
+	req := Request{IP: "192.0.2.1"}
+
+	decision, err := rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.False(t, decision.DryRun)
+	assert.Equal(t, 3, decision.Limit)
+	assert.Equal(t, int64(2), decision.Remaining)
+
+	// The shadow policy would deny the requests the enforced policy allows
+	for i := 0; i < 2; i++ {
+		decision, err = rl.Allow(ctx, req)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.True(t, decision.DryRun)
+		assert.Equal(t, 1, decision.Limit)
+	}
+
+	// The enforced policy still denies and blocks the key
+	decision, err = rl.Allow(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.False(t, decision.DryRun)
+	assert.True(t, decision.Blocked)
+
+	blocks, err := store.Blocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, Key("ip", "192.0.2.1"), blocks[0].Key)
+}
+
+func TestAPIKeys(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	key, hash, err := apikey.Generate("acme")
+	require.NoError(t, err)
+	keyring, err := apikey.NewKeyring(map[string][]apikey.Hash{"acme": {{Value: hash}}}, nil)
+	require.NoError(t, err)
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy:      Policy{Limit: 1, Window: time.Minute},
+			TokenPolicies: map[string]Policy{"abc123": {Limit: 5, Window: time.Minute}},
+			APIKeys:       keyring,
+			KeyPolicies:   map[string]Policy{"acme": {Limit: 1, Window: time.Minute, BlockDuration: time.Minute}},
+		},
+	})
+	ctx := context.Background()
+
+	decision, err := rl.Allow(ctx, Request{Token: key})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "token", decision.KeyType)
+	decision, err = rl.Allow(ctx, Request{Token: key})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	// The key is counted under its id and plaintext tokens under their hash
+	blocked, err := store.IsBlocked(ctx, Key("key", "acme"))
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	_, err = rl.Allow(ctx, Request{Token: "abc123"})
+	require.NoError(t, err)
+	count, err := store.Get(ctx, Key("token", TokenID("abc123")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// A wrong secret or a bare id is not registered
+	for _, token := range []string{"acme.wrong", "acme"} {
+		decision, err = rl.Allow(ctx, Request{Token: token})
+		require.NoError(t, err)
+		assert.True(t, decision.Forbidden)
+	}
+	assert.True(t, rl.IsTokenRegistered(key))
+}
+
+func TestTenants(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{Limit: 10, Window: time.Minute},
+			TokenPolicies: map[string]Policy{
+				"web":    {Limit: 2, Window: time.Minute},
+				"mobile": {Limit: 10, Window: time.Minute},
+			},
+			Tenants: map[string]Tenant{
+				"acme": {Policy: Policy{Limit: 3, Window: time.Minute}, Tokens: []string{"web", "mobile"}},
+			},
+		},
+	})
+	ctx := context.Background()
+
+	// Each token is limited by its own policy and the tenant in aggregate
+	for _, token := range []string{"web", "web", "mobile"} {
+		decision, err := rl.Allow(ctx, Request{Token: token})
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "acme", decision.Tenant)
+	}
+	decision, err := rl.Allow(ctx, Request{Token: "mobile"})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "tenant", decision.KeyType)
+	assert.Equal(t, "acme", decision.Policy)
+
+	// The token of a tenant is counted within the tenant, whatever the
+	// request claims
+	count, err := store.Get(ctx, TenantKey("acme", "token", TokenID("web")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	decision, err = rl.Allow(ctx, Request{Token: "web", Tenant: "other"})
+	require.NoError(t, err)
+	assert.Equal(t, "acme", decision.Tenant)
+
+	// Anonymous requests join the registered tenant they claim, limited by the
+	// tenant on top of their IP, which is counted as without a tenant
+	decision, err = rl.Allow(ctx, Request{IP: "192.0.2.1", Tenant: "acme"})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "tenant", decision.KeyType)
+	decision, err = rl.Allow(ctx, Request{IP: "192.0.2.1", Tenant: "unknown"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, decision.Tenant)
+	count, err = store.Get(ctx, Key("ip", "192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestTenantsDontBypassIPLimit(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	tenants := map[string]Tenant{}
+	for _, name := range []string{"a", "b", "c"} {
+		tenants[name] = Tenant{Policy: Policy{Limit: 100, Window: time.Minute}}
+	}
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{Limit: 2, Window: time.Minute, BlockDuration: time.Minute},
+			Tenants:  tenants,
+		},
+	})
+	ctx := context.Background()
+
+	// Switching tenants neither resets the count of the IP nor escapes its
+	// block
+	for i, tenant := range []string{"a", "b", "c", "a", ""} {
+		decision, err := rl.Allow(ctx, Request{IP: "192.0.2.1", Tenant: tenant})
+		require.NoError(t, err)
+		assert.Equal(t, i < 2, decision.Allowed, "request %d with tenant %q", i, tenant)
+		if i >= 2 {
+			assert.Equal(t, "ip", decision.KeyType)
+		}
+	}
+	blocked, err := store.IsBlocked(ctx, Key("ip", "192.0.2.1"))
+	require.NoError(t, err)
+	assert.True(t, blocked)
+}
+
+func TestTokenOverridesSurviveReloads(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rules := Rules{
+		IPPolicy:      Policy{Limit: 1, Window: time.Minute},
+		TokenPolicies: map[string]Policy{"file": {Limit: 5, Window: time.Minute}},
+	}
+	rl := NewRateLimiter(Config{Storage: store, Rules: rules})
+
+	rl.SetTokenPolicy("runtime", Policy{Limit: 7, Window: time.Minute})
+	assert.True(t, rl.RemoveToken(TokenID("file")))
+	assert.False(t, rl.RemoveToken(TokenID("unknown")))
+
+	// Reloading the same rules keeps the runtime changes
+	rl.SetRules(rules)
+	assert.True(t, rl.IsTokenRegistered("runtime"))
+	assert.False(t, rl.IsTokenRegistered("file"))
+
+	// Registering a revoked token again restores it
+	rl.SetTokenPolicy("file", Policy{Limit: 3, Window: time.Minute})
+	rl.SetRules(rules)
+	assert.Equal(t, 3, rl.Rules().TokenPolicies["file"].Limit)
+}
@@ -0,0 +1,48 @@
+package limiter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// logBurst is the number of lines a logLimiter writes per second
+const logBurst = 10
+
+// logLimiter writes at most logBurst lines per second, so that a flood of
+// requests does not flood the log with a line per request. The lines dropped
+// are counted in the next line written. The zero value is ready to use.
+type logLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	second  time.Time
+	written int
+	dropped int
+}
+
+func (l *logLimiter) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if now.Sub(l.second) >= time.Second {
+		l.second, l.written = now, 0
+	}
+	if l.written >= logBurst {
+		l.dropped++
+		l.mu.Unlock()
+		return
+	}
+	l.written++
+	dropped := l.dropped
+	l.dropped = 0
+	l.mu.Unlock()
+
+	line := fmt.Sprintf(format, args...)
+	if dropped > 0 {
+		line += fmt.Sprintf(" (%d similar lines dropped)", dropped)
+	}
+	log.Print(line)
+}
@@ -0,0 +1,36 @@
+package limiter
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	now := time.Unix(1700000000, 0)
+	logger := logLimiter{now: func() time.Time { return now }}
+	for i := 0; i < 3*logBurst; i++ {
+		logger.Printf("Blocked %d", i)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, logBurst)
+
+	// The next second logs again, counting the lines dropped
+	out.Reset()
+	now = now.Add(time.Second)
+	logger.Printf("Blocked %d", 3*logBurst)
+	assert.Equal(t, "Blocked 30 (20 similar lines dropped)\n", out.String())
+}
@@ -0,0 +1,117 @@
+package limiter
+
+import (
+	"net/netip"
+)
+
+// NetworkAction is what happens to the requests coming from a network
+type NetworkAction int
+
+const (
+	// NetworkLimit enforces the network policy instead of the IP policy
+	NetworkLimit NetworkAction = iota
+	// NetworkAllow always allows the requests, without counting them
+	NetworkAllow
+	// NetworkDeny always rejects the requests, even with a registered token
+	NetworkDeny
+)
+
+func (a NetworkAction) String() string {
+	switch a {
+	case NetworkAllow:
+		return "allow"
+	case NetworkDeny:
+		return "deny"
+	default:
+		return "limit"
+	}
+}
+
+// NetworkPolicy applies an action to the addresses of a network. With the
+// NetworkLimit action each address is limited with its own counter, unless
+// Shared is set and the whole network shares a single one.
+type NetworkPolicy struct {
+	Prefix netip.Prefix
+	Action NetworkAction
+	Policy Policy
+	Shared bool
+}
+
+// key returns the storage key counting the requests of the IP
+func (n NetworkPolicy) key(ip string) string {
+	if n.Shared {
+		return Key("network", n.Prefix.String())
+	}
+	return Key("ip", ip)
+}
+
+// networkTrie indexes network policies by prefix, one binary trie per address
+// family, so that the most specific network of an address is found in at most
+// 32 or 128 steps regardless of the number of policies
+type networkTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	policy   *NetworkPolicy
+}
+
+func newNetworkTrie(policies []NetworkPolicy) *networkTrie {
+	t := &networkTrie{v4: &trieNode{}, v6: &trieNode{}}
+	for i := range policies {
+		t.insert(&policies[i])
+	}
+	return t
+}
+
+func (t *networkTrie) insert(policy *NetworkPolicy) {
+	prefix := policy.Prefix.Masked()
+	addr := prefix.Addr()
+	bytes := addr.AsSlice()
+
+	node := t.root(addr)
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bitAt(bytes, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.policy = policy
+}
+
+// lookup returns the most specific network policy containing the address
+func (t *networkTrie) lookup(addr netip.Addr) (NetworkPolicy, bool) {
+	bytes := addr.AsSlice()
+
+	node := t.root(addr)
+	match := node.policy
+	for i := 0; i < addr.BitLen(); i++ {
+		node = node.children[bitAt(bytes, i)]
+		if node == nil {
+			break
+		}
+		if node.policy != nil {
+			match = node.policy
+		}
+	}
+
+	if match == nil {
+		return NetworkPolicy{}, false
+	}
+	return *match, true
+}
+
+func (t *networkTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// bitAt returns the i-th most significant bit of an address
+func bitAt(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkTrieLookup(t *testing.T) {
+	trie := newNetworkTrie([]NetworkPolicy{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: NetworkAllow},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Action: NetworkDeny},
+		{Prefix: netip.MustParsePrefix("10.1.2.0/24"), Policy: Policy{Limit: 500}},
+		{Prefix: netip.MustParsePrefix("192.0.2.7/32"), Action: NetworkDeny},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), Action: NetworkAllow},
+	})
+
+	tests := []struct {
+		addr    string
+		want    string
+		matched bool
+	}{
+		{addr: "10.200.0.1", want: "10.0.0.0/8", matched: true},
+		{addr: "10.1.9.9", want: "10.1.0.0/16", matched: true},
+		{addr: "10.1.2.3", want: "10.1.2.0/24", matched: true},
+		{addr: "192.0.2.7", want: "192.0.2.7/32", matched: true},
+		{addr: "192.0.2.8", matched: false},
+		{addr: "11.0.0.1", matched: false},
+		{addr: "2001:db8:1::1", want: "2001:db8::/32", matched: true},
+		{addr: "2001:db9::1", matched: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, matched := trie.lookup(netip.MustParseAddr(tt.addr))
+			require.Equal(t, tt.matched, matched)
+			if matched {
+				assert.Equal(t, tt.want, network.Prefix.String())
+			}
+		})
+	}
+}
+
+func TestAllowNetworkActions(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy:      Policy{Limit: 1, Window: time.Minute},
+			TokenPolicies: map[string]Policy{"abc": {Limit: 10, Window: time.Minute}},
+			NetworkPolicies: []NetworkPolicy{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: NetworkAllow},
+				{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: NetworkDeny},
+				{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Policy: Policy{Limit: 3, Window: time.Minute}, Shared: true},
+			},
+		},
+	})
+	ctx := context.Background()
+
+	t.Run("allowlisted network is never limited", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			decision, err := rl.Allow(ctx, Request{IP: "10.1.2.3"})
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.True(t, decision.Exempt)
+		}
+	})
+
+	t.Run("denylisted network is rejected even with a token", func(t *testing.T) {
+		decision, err := rl.Allow(ctx, Request{IP: "203.0.113.9", Token: "abc"})
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.True(t, decision.Denied)
+		assert.Equal(t, "203.0.113.0/24", decision.Policy)
+	})
+
+	t.Run("shared network counts all addresses together", func(t *testing.T) {
+		for i, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+			decision, err := rl.Allow(ctx, Request{IP: ip})
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, int64(2-i), decision.Remaining)
+		}
+
+		decision, err := rl.Allow(ctx, Request{IP: "198.51.100.4"})
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, "198.51.100.0/24", decision.Policy)
+	})
+
+	t.Run("other addresses use the IP policy", func(t *testing.T) {
+		decision, err := rl.Allow(ctx, Request{IP: "192.0.2.1"})
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "ip", decision.Policy)
+	})
+}
@@ -0,0 +1,75 @@
+package limiter
+
+import "strings"
+
+// RoutePolicy limits the requests whose method and path match the route.
+// Pattern is either an exact path or a prefix followed by "*", such as
+// "/api/*". An empty Method matches every method.
+type RoutePolicy struct {
+	Method  string
+	Pattern string
+	Policy  Policy
+}
+
+// Name identifies the route in decisions, e.g. "POST /login"
+func (rp RoutePolicy) Name() string {
+	if rp.Method == "" {
+		return rp.Pattern
+	}
+	return rp.Method + " " + rp.Pattern
+}
+
+func (rp RoutePolicy) matches(method, path string) bool {
+	return routeMatches(rp.Method, rp.Pattern, method, path)
+}
+
+// RouteCost is the number of units of the limits consumed by each request
+// matching the route, e.g. 50 for a bulk export. Method and Pattern match the
+// requests like those of a RoutePolicy.
+type RouteCost struct {
+	Method  string
+	Pattern string
+	Cost    int
+}
+
+// routeMatches reports whether the request matches the method and pattern of a route
+func routeMatches(routeMethod, pattern, method, path string) bool {
+	if routeMethod != "" && !strings.EqualFold(routeMethod, method) {
+		return false
+	}
+
+	if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == pattern
+}
+
+// key returns the storage key counting the requests of a client on the route,
+// hash tagged by the client like the keys returned by Key
+func (rp RoutePolicy) key(client string) string {
+	method := strings.ToUpper(rp.Method)
+	if method == "" {
+		method = "*"
+	}
+	return "ratelimit:{" + client + "}:route:" + method + ":" + rp.Pattern
+}
+
+// matchRoute returns the first route policy matching the request
+func (r *Rules) matchRoute(method, path string) (RoutePolicy, bool) {
+	for _, route := range r.RoutePolicies {
+		if route.matches(method, path) {
+			return route, true
+		}
+	}
+	return RoutePolicy{}, false
+}
+
+// matchRouteCost returns the first route cost matching the request
+func (r *Rules) matchRouteCost(method, path string) (RouteCost, bool) {
+	for _, cost := range r.RouteCosts {
+		if routeMatches(cost.Method, cost.Pattern, method, path) {
+			return cost, true
+		}
+	}
+	return RouteCost{}, false
+}
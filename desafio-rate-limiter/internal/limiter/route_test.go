@@ -0,0 +1,173 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestCost(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy: Policy{Limit: 100, Window: time.Minute},
+			RouteCosts: []RouteCost{
+				{Method: "POST", Pattern: "/export", Cost: 50},
+				{Pattern: "/huge", Cost: 500},
+			},
+		},
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		req       Request
+		allowed   bool
+		remaining int64
+	}{
+		{name: "default cost", req: Request{Method: "GET", Path: "/"}, allowed: true, remaining: 99},
+		{name: "request cost", req: Request{Method: "PUT", Path: "/upload", Cost: 9}, allowed: true, remaining: 90},
+		{name: "route cost replaces the request cost", req: Request{Method: "POST", Path: "/export", Cost: 9}, allowed: true, remaining: 40},
+		{name: "cost above the remaining units", req: Request{Method: "POST", Path: "/export"}, allowed: false},
+		{name: "remaining units are kept", req: Request{Method: "GET", Path: "/", Cost: 40}, allowed: true, remaining: 0},
+		{name: "cost above the limit", req: Request{Method: "GET", Path: "/huge"}, allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.IP = "192.0.2.1"
+			decision, err := rl.Allow(ctx, tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, decision.Allowed)
+			if tt.allowed {
+				assert.Equal(t, tt.remaining, decision.Remaining)
+			}
+		})
+	}
+}
+
+func TestRequestCostAboveQuota(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			TokenPolicies: map[string]Policy{"abc123": {
+				Limit:  100,
+				Window: time.Second,
+				Quotas: []Quota{{Limit: 1000, Window: time.Minute}, {Limit: 10, Window: time.Hour}},
+			}},
+		},
+	})
+	ctx := context.Background()
+
+	// The request fits in the limit but never in the hourly quota, which is
+	// reported without counting the request
+	decision, err := rl.Allow(ctx, Request{Token: "abc123", Cost: 20})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.True(t, decision.CostExceeded)
+	assert.Equal(t, 10, decision.Limit)
+	assert.Equal(t, time.Hour, decision.Window)
+	state, err := store.Inspect(ctx, Key("token", TokenID("abc123")))
+	require.NoError(t, err)
+	assert.Empty(t, state.Counters)
+
+	decision, err = rl.Allow(ctx, Request{Token: "abc123", Cost: 10})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestRouteMatches(t *testing.T) {
+	rules := Rules{RoutePolicies: []RoutePolicy{
+		{Method: "POST", Pattern: "/login"},
+		{Method: "get", Pattern: "/api/*"},
+		{Pattern: "/api/admin"},
+		{Pattern: "/*"},
+	}}
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"POST", "/login", "POST /login"},
+		{"GET", "/login", "/*"},
+		{"GET", "/api/users", "get /api/*"},
+		{"GET", "/api/admin", "get /api/*"},
+		{"DELETE", "/api/admin", "/api/admin"},
+		{"POST", "/api", "/*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			route, matched := rules.matchRoute(tt.method, tt.path)
+			require.True(t, matched)
+			assert.Equal(t, tt.want, route.Name())
+		})
+	}
+
+	_, matched := (&Rules{RoutePolicies: rules.RoutePolicies[:3]}).matchRoute("GET", "/")
+	assert.False(t, matched)
+}
+
+func TestRoutePolicies(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := NewRateLimiter(Config{
+		Storage: store,
+		Rules: Rules{
+			IPPolicy:      Policy{Limit: 100, Window: time.Minute},
+			TokenPolicies: map[string]Policy{"abc123": {Limit: 100, Window: time.Minute}},
+			RoutePolicies: []RoutePolicy{
+				{Method: "POST", Pattern: "/login", Policy: Policy{Limit: 2, Window: time.Minute, BlockDuration: time.Minute}},
+			},
+		},
+	})
+	ctx := context.Background()
+	login := Request{IP: "192.0.2.1", Method: "POST", Path: "/login"}
+
+	for i := 0; i < 2; i++ {
+		decision, err := rl.Allow(ctx, login)
+		require.NoError(t, err)
+		require.True(t, decision.Allowed)
+		// The route has fewer requests remaining than the IP
+		assert.Equal(t, "route", decision.KeyType)
+		assert.Equal(t, "POST /login", decision.Policy)
+	}
+	decision, err := rl.Allow(ctx, login)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.True(t, decision.Blocked)
+	assert.Equal(t, "POST /login", decision.Policy)
+
+	// The block only covers the route of the client
+	state, err := store.Inspect(ctx, Key("ip", "192.0.2.1")+":route:POST:/login")
+	require.NoError(t, err)
+	assert.True(t, state.Blocked)
+
+	tests := []struct {
+		name string
+		req  Request
+	}{
+		{"other method", Request{IP: "192.0.2.1", Method: "GET", Path: "/login"}},
+		{"other path", Request{IP: "192.0.2.1", Method: "POST", Path: "/logout"}},
+		{"other IP", Request{IP: "192.0.2.2", Method: "POST", Path: "/login"}},
+		{"token of the IP", Request{IP: "192.0.2.1", Token: "abc123", Method: "POST", Path: "/login"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := rl.Allow(ctx, tt.req)
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+		})
+	}
+	count, err := store.Get(ctx, Key("token", TokenID("abc123"))+":route:POST:/login")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
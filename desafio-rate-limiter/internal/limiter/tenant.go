@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tenant groups the clients of a customer, limited in aggregate by Policy on
+// top of the policy of each client. The tokens and API keys of the tenant
+// always belong to it and are counted within it. Other requests join it only
+// when they name it, e.g. with the X-Tenant-ID header of a trusted gateway,
+// and are still counted by their IP like requests without a tenant, so that
+// claiming tenants never resets the limit of a client.
+type Tenant struct {
+	Policy Policy
+	// Tokens are plaintext tokens and Keys the ids of API keys
+	Tokens []string
+	Keys   []string
+}
+
+// TenantKey returns the storage key of a token or API key within a tenant,
+// e.g. TenantKey("acme", "token", id) returns "ratelimit:{tenant:acme:token:<id>}",
+// or Key without a tenant
+func TenantKey(tenant, keyType, id string) string {
+	if tenant == "" {
+		return Key(keyType, id)
+	}
+	return Key("tenant", tenant+":"+keyType+":"+id)
+}
+
+// newTenantIndex maps the clients of the tenants, as "token:<id>" or
+// "key:<id>", to their tenant
+func newTenantIndex(tenants map[string]Tenant) map[string]string {
+	if len(tenants) == 0 {
+		return nil
+	}
+	index := make(map[string]string)
+	for name, tenant := range tenants {
+		for _, token := range tenant.Tokens {
+			index["token:"+TokenID(token)] = name
+		}
+		for _, id := range tenant.Keys {
+			index["key:"+id] = name
+		}
+	}
+	return index
+}
+
+// resolveTenant returns the tenant of the client and true when the client
+// belongs to it, or else the requested tenant when it is registered
+func (r *Rules) resolveTenant(client, requested string) (string, bool) {
+	if tenant, exists := r.tenants[client]; exists {
+		return tenant, true
+	}
+	if _, exists := r.Tenants[requested]; exists {
+		return requested, false
+	}
+	return "", false
+}
+
+func (rl *RateLimiter) checkTenant(ctx context.Context, name string, tenant Tenant, cost int64) (Decision, error) {
+	decision, err := rl.check(ctx, Key("tenant", name), "tenant", name, tenant.Policy, cost)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to check tenant rate limit: %w", err)
+	}
+	return decision, nil
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ratelimiter"
+
+// Metrics collects the Prometheus metrics of the rate limiter in its own
+// registry, together with the Go runtime and process metrics
+type Metrics struct {
+	registry         *prometheus.Registry
+	decisions        *prometheus.CounterVec
+	storageDurations *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decisions_total",
+			Help:      "Rate limit decisions by key type, policy and outcome (allowed, denied, forbidden or dry_run).",
+		}, []string{"key_type", "policy", "outcome"}),
+		storageDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_duration_seconds",
+			Help:      "Latency of the storage calls by operation and status (ok or error).",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "status"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.decisions,
+		m.storageDurations,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format. Metrics that
+// fail to be collected, such as the blocks while the storage is down, are left
+// out instead of failing the whole scrape.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+}
+
+// ObserveDecision counts a decision of the rate limiter. Denylisted networks
+// and unregistered tokens are counted as forbidden, and the requests a dry-run
+// policy would have denied as dry_run.
+func (m *Metrics) ObserveDecision(decision limiter.Decision) {
+	outcome := "allowed"
+	switch {
+	case decision.Forbidden || decision.Denied:
+		outcome = "forbidden"
+	case decision.DryRun:
+		outcome = "dry_run"
+	case !decision.Allowed:
+		outcome = "denied"
+	}
+	m.decisions.WithLabelValues(decision.KeyType, decision.Policy, outcome).Inc()
+}
+
+// RegisterBlocks exports the number of active blocks by key type, read from the
+// storage at most once per refresh interval. Listing the blocks scans the whole
+// keyspace, so scrapes in between reuse the last result.
+func (m *Metrics) RegisterBlocks(store storage.Storage, refresh time.Duration) {
+	m.registry.MustRegister(&blocksCollector{
+		storage: store,
+		refresh: refresh,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_blocks"),
+			"Keys currently blocked by key type.",
+			[]string{"key_type"}, nil,
+		),
+	})
+}
+
+// blocksCollector lists the blocks of the storage when scraped, so the gauge
+// is shared by every instance using the same Redis
+type blocksCollector struct {
+	storage storage.Storage
+	refresh time.Duration
+	desc    *prometheus.Desc
+
+	// mu serializes the scrapes, so that concurrent scrapes list the blocks
+	// once, and guards the cached counts
+	mu        sync.Mutex
+	counts    map[string]int
+	err       error
+	updatedAt time.Time
+}
+
+func (c *blocksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *blocksCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Errors are cached too, so that scrapes don't retry a failing storage
+	if c.updatedAt.IsZero() || time.Since(c.updatedAt) >= c.refresh {
+		c.counts, c.err = c.count()
+		c.updatedAt = time.Now()
+	}
+
+	if c.err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, c.err)
+		return
+	}
+	for keyType, count := range c.counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), keyType)
+	}
+}
+
+func (c *blocksCollector) count() (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	blocks, err := c.storage.Blocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{"ip": 0, "token": 0}
+	for _, block := range blocks {
+		counts[keyType(block.Key)]++
+	}
+	return counts, nil
+}
+
+// keyType returns the type of a limiter key, e.g. "ip" for "ratelimit:{ip:10.0.0.1}"
+// and "route" for "ratelimit:{ip:10.0.0.1}:route:POST:/login"
+func keyType(key string) string {
+	tag, rest, found := strings.Cut(strings.TrimPrefix(key, "ratelimit:{"), "}")
+	if !found {
+		return "unknown"
+	}
+	if strings.HasPrefix(rest, ":route:") {
+		return "route"
+	}
+	keyType, _, _ := strings.Cut(tag, ":")
+	return keyType
+}
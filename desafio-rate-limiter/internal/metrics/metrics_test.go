@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveDecision(t *testing.T) {
+	m := NewMetrics()
+
+	m.ObserveDecision(limiter.Decision{Allowed: true, KeyType: "ip", Policy: "ip"})
+	m.ObserveDecision(limiter.Decision{Allowed: true, KeyType: "ip", Policy: "ip"})
+	m.ObserveDecision(limiter.Decision{KeyType: "route", Policy: "POST /login"})
+	m.ObserveDecision(limiter.Decision{Forbidden: true, KeyType: "token", Policy: "token"})
+	m.ObserveDecision(limiter.Decision{Denied: true, KeyType: "network", Policy: "203.0.113.0/24"})
+	m.ObserveDecision(limiter.Decision{Allowed: true, DryRun: true, KeyType: "ip", Policy: "ip"})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.decisions.WithLabelValues("ip", "ip", "allowed")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("route", "POST /login", "denied")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("token", "token", "forbidden")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("network", "203.0.113.0/24", "forbidden")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("ip", "ip", "dry_run")))
+}
+
+func TestInstrumentStorageAndBlocks(t *testing.T) {
+	m := NewMetrics()
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	m.RegisterBlocks(store, time.Minute)
+
+	instrumented := m.InstrumentStorage(store)
+	ctx := context.Background()
+
+	_, err := instrumented.FixedWindow(ctx, "ratelimit:{ip:10.0.0.1}", storage.Limit{Rate: 1, Period: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, instrumented.SetBlock(ctx, "ratelimit:{ip:10.0.0.2}", time.Minute))
+	require.NoError(t, instrumented.SetBlock(ctx, "ratelimit:{token:abc}", time.Minute))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.storageDurations))
+
+	assert.Equal(t, map[string]float64{"ip": 1, "token": 1}, gatherBlocks(t, m))
+
+	// Scrapes within the refresh interval don't list the blocks again
+	require.NoError(t, store.SetBlock(ctx, "ratelimit:{ip:10.0.0.3}", time.Minute))
+	assert.Equal(t, map[string]float64{"ip": 1, "token": 1}, gatherBlocks(t, m))
+}
+
+func gatherBlocks(t *testing.T, m *Metrics) map[string]float64 {
+	families, err := m.registry.Gather()
+	require.NoError(t, err)
+	blocks := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "ratelimiter_active_blocks" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			blocks[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	return blocks
+}
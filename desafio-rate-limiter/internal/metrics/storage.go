@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+)
+
+// instrumentedStorage records the latency of every call to the wrapped storage
+type instrumentedStorage struct {
+	storage storage.Storage
+	metrics *Metrics
+}
+
+// InstrumentStorage wraps the storage to record the latency of its calls
+func (m *Metrics) InstrumentStorage(store storage.Storage) storage.Storage {
+	return &instrumentedStorage{storage: store, metrics: m}
+}
+
+func (s *instrumentedStorage) observe(operation string, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	s.metrics.storageDurations.WithLabelValues(operation, status).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	start := time.Now()
+	count, err := s.storage.Increment(ctx, key, expiration)
+	s.observe("increment", start, err)
+	return count, err
+}
+
+func (s *instrumentedStorage) Get(ctx context.Context, key string) (int64, error) {
+	start := time.Now()
+	count, err := s.storage.Get(ctx, key)
+	s.observe("get", start, err)
+	return count, err
+}
+
+func (s *instrumentedStorage) SetBlock(ctx context.Context, key string, expiration time.Duration) error {
+	start := time.Now()
+	err := s.storage.SetBlock(ctx, key, expiration)
+	s.observe("set_block", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	blocked, err := s.storage.IsBlocked(ctx, key)
+	s.observe("is_blocked", start, err)
+	return blocked, err
+}
+
+func (s *instrumentedStorage) Unblock(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	unblocked, err := s.storage.Unblock(ctx, key)
+	s.observe("unblock", start, err)
+	return unblocked, err
+}
+
+func (s *instrumentedStorage) Blocks(ctx context.Context) ([]storage.Block, error) {
+	start := time.Now()
+	blocks, err := s.storage.Blocks(ctx)
+	s.observe("blocks", start, err)
+	return blocks, err
+}
+
+func (s *instrumentedStorage) Inspect(ctx context.Context, key string) (storage.KeyState, error) {
+	start := time.Now()
+	state, err := s.storage.Inspect(ctx, key)
+	s.observe("inspect", start, err)
+	return state, err
+}
+
+func (s *instrumentedStorage) FixedWindow(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.FixedWindow(ctx, key, limit)
+	s.observe("fixed_window", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) SlidingWindowLog(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.SlidingWindowLog(ctx, key, limit)
+	s.observe("sliding_window_log", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) SlidingWindowCounter(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.SlidingWindowCounter(ctx, key, limit)
+	s.observe("sliding_window_counter", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) TokenBucket(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.TokenBucket(ctx, key, limit)
+	s.observe("token_bucket", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GCRA(ctx context.Context, key string, limit storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.GCRA(ctx, key, limit)
+	s.observe("gcra", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) Quotas(ctx context.Context, key string, limits []storage.Limit) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.Quotas(ctx, key, limits)
+	s.observe("quotas", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.Acquire(ctx, key, id, limit, ttl)
+	s.observe("acquire", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) Release(ctx context.Context, key, id string) error {
+	start := time.Now()
+	err := s.storage.Release(ctx, key, id)
+	s.observe("release", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) Close() error {
+	return s.storage.Close()
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPExtractor determines the client IP of a request. Forwarding headers are
+// only honored when the request comes from a trusted proxy, otherwise any
+// client could spoof its address to bypass the IP limit.
+type IPExtractor struct {
+	// TrustedProxies are the networks of the proxies allowed to report the
+	// client address through the Forwarded, X-Forwarded-For or X-Real-IP headers
+	TrustedProxies []netip.Prefix
+
+	// IPv6PrefixLength aggregates IPv6 clients by network, e.g. 64 so that a
+	// client cannot rotate addresses within the /64 it is usually assigned.
+	// Zero keeps the full address.
+	IPv6PrefixLength int
+}
+
+// ClientIP returns the client address of the request. The forwarding chain is
+// walked from right to left, skipping trusted proxies, and the first untrusted
+// address is the client. IPv6 networks are written in CIDR notation when
+// aggregated, e.g. "2001:db8::/64".
+func (e IPExtractor) ClientIP(r *http.Request) string {
+	remote, ok := parseNode(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !e.trusted(remote) {
+		return e.normalize(remote)
+	}
+
+	// Forwarded (RFC 7239) takes precedence over the de facto headers
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = forwardedChain(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(chain) == 0 {
+		if ip, ok := parseNode(r.Header.Get("X-Real-IP")); ok {
+			return e.normalize(ip)
+		}
+		return e.normalize(remote)
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, ok := parseNode(chain[i])
+		if !ok {
+			// Unknown or obfuscated hop, the last trusted proxy is the best we know
+			break
+		}
+		client = ip
+		if !e.trusted(ip) {
+			break
+		}
+	}
+	return e.normalize(client)
+}
+
+// FromTrustedProxy reports whether the request comes directly from a trusted
+// proxy, whose headers describing the client can be believed
+func (e IPExtractor) FromTrustedProxy(r *http.Request) bool {
+	remote, ok := parseNode(r.RemoteAddr)
+	return ok && e.trusted(remote)
+}
+
+func (e IPExtractor) trusted(ip netip.Addr) bool {
+	for _, prefix := range e.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e IPExtractor) normalize(ip netip.Addr) string {
+	if ip.Is6() && e.IPv6PrefixLength > 0 && e.IPv6PrefixLength < 128 {
+		return netip.PrefixFrom(ip, e.IPv6PrefixLength).Masked().String()
+	}
+	return ip.String()
+}
+
+// forwardedChain splits X-Forwarded-For headers into the addresses they list
+func forwardedChain(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	return chain
+}
+
+// forwardedFor extracts the "for" parameter of every element of Forwarded
+// headers, e.g. `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					chain = append(chain, val)
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseNode parses an address with an optional port, such as "192.0.2.1",
+// "192.0.2.1:80", "2001:db8::1", "[2001:db8::1]" or "[2001:db8::1]:80".
+// IPv4-mapped IPv6 addresses are returned as IPv4 and zones are dropped.
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(node)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = addrPort.Addr()
+	}
+	return ip.Unmap().WithZone(""), true
+}
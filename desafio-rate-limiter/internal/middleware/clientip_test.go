@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPExtractorClientIP(t *testing.T) {
+	extractor := IPExtractor{
+		TrustedProxies: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("fd00::/8"),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores forwarding headers",
+			remoteAddr: "203.0.113.7:4321",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:4321",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "rightmost untrusted address of X-Forwarded-For",
+			remoteAddr: "10.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "all hops trusted uses the leftmost address",
+			remoteAddr: "10.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "unknown hop stops at the last trusted proxy",
+			remoteAddr: "10.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "X-Real-IP from trusted peer",
+			remoteAddr: "10.0.0.1:4321",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "Forwarded takes precedence over X-Forwarded-For",
+			remoteAddr: "10.0.0.1:4321",
+			headers: map[string]string{
+				"Forwarded":       `for=198.51.100.1;proto=https, for="[2001:db8::17]:4711";by=10.0.0.2`,
+				"X-Forwarded-For": "192.0.2.1",
+			},
+			want: "2001:db8::17",
+		},
+		{
+			name:       "Forwarded IPv4 with port",
+			remoteAddr: "10.0.0.1:4321",
+			headers:    map[string]string{"Forwarded": `For="198.51.100.1:8080"`},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "IPv6 remote address",
+			remoteAddr: "[2001:db8::1]:4321",
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "IPv6 remote address with zone",
+			remoteAddr: "[fe80::1%eth0]:4321",
+			want:       "fe80::1",
+		},
+		{
+			name:       "IPv4-mapped IPv6 remote address",
+			remoteAddr: "[::ffff:203.0.113.7]:4321",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[fd00::1]:4321",
+			headers:    map[string]string{"X-Forwarded-For": "2001:db8::5"},
+			want:       "2001:db8::5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			assert.Equal(t, tt.want, extractor.ClientIP(req))
+		})
+	}
+}
+
+func TestIPExtractorIPv6Aggregation(t *testing.T) {
+	extractor := IPExtractor{IPv6PrefixLength: 64}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[2001:db8:1:2:aaaa::1]:4321"
+	assert.Equal(t, "2001:db8:1:2::/64", extractor.ClientIP(req))
+
+	req.RemoteAddr = "[2001:db8:1:2:bbbb::9]:4321"
+	assert.Equal(t, "2001:db8:1:2::/64", extractor.ClientIP(req))
+
+	req.RemoteAddr = "203.0.113.7:4321"
+	assert.Equal(t, "203.0.113.7", extractor.ClientIP(req))
+}
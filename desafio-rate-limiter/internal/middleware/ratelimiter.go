@@ -1,47 +1,145 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
 )
 
+// TenantHeader names the tenant of the requests without a token of a tenant.
+// It is only honored on requests from trusted proxies, since any client could
+// otherwise claim the tenant of another customer.
+const TenantHeader = "X-Tenant-ID"
+
 type RateLimiterMiddleware struct {
-	limiter *limiter.RateLimiter
+	limiter     *limiter.RateLimiter
+	ipExtractor IPExtractor
+	cost        CostFunc
+}
+
+// CostFunc returns the number of units of the limits a request consumes. An
+// error rejects the request with 413 Request Entity Too Large without counting
+// it.
+type CostFunc func(r *http.Request) (int, error)
+
+// ErrBodyTooLarge is returned by BodyCost for bodies longer than its maxBytes
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// BodyCost charges one unit per started block of unit bytes of the request
+// body, so that a 3 MB upload costs 3 units with a unit of 1 MB. Requests
+// without a body cost one unit. Bodies longer than maxBytes are rejected, and
+// bodies of unknown length, such as chunked uploads, are charged as maxBytes
+// and cut at maxBytes, so that they can't send more than they paid for.
+func BodyCost(unit, maxBytes int64) CostFunc {
+	return func(r *http.Request) (int, error) {
+		length := r.ContentLength
+		if length > maxBytes {
+			return 0, ErrBodyTooLarge
+		}
+		if length < 0 {
+			r.Body = http.MaxBytesReader(nil, r.Body, maxBytes)
+			length = maxBytes
+		}
+		if length == 0 {
+			return 1, nil
+		}
+		return int((length + unit - 1) / unit), nil
+	}
 }
 
-func NewRateLimiterMiddleware(limiter *limiter.RateLimiter) *RateLimiterMiddleware {
+// NewRateLimiterMiddleware creates the middleware. A nil cost counts every
+// request as one unit.
+func NewRateLimiterMiddleware(limiter *limiter.RateLimiter, ipExtractor IPExtractor, cost CostFunc) *RateLimiterMiddleware {
 	return &RateLimiterMiddleware{
-		limiter: limiter,
+		limiter:     limiter,
+		ipExtractor: ipExtractor,
+		cost:        cost,
 	}
 }
 
 func (m *RateLimiterMiddleware) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract IP address
-		ip := extractIP(r)
+		ip := m.ipExtractor.ClientIP(r)
 
 		// Extract token from header
 		token := r.Header.Get("API_KEY")
 
+		req := limiter.Request{
+			IP:     ip,
+			Token:  token,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			// Set by the chi RequestID middleware, if used
+			ID: chimiddleware.GetReqID(r.Context()),
+		}
+		if m.ipExtractor.FromTrustedProxy(r) {
+			req.Tenant = r.Header.Get(TenantHeader)
+		}
+		if m.cost != nil {
+			cost, err := m.cost(r)
+			if err != nil {
+				writeTooLarge(w)
+				return
+			}
+			req.Cost = cost
+		}
+
 		// Check rate limit
-		allowed, err := m.limiter.Allow(r.Context(), ip, token)
+		decision, err := m.limiter.Allow(r.Context(), req)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		// Free the concurrency slots once the handler completes, even if the
+		// client went away
+		defer m.limiter.Release(context.WithoutCancel(r.Context()), decision)
+
+		// If token was provided but is invalid or not registered
+		if decision.Forbidden {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "invalid API key"}`))
+			return
+		}
 
-		if !allowed {
+		// If the client network is denylisted
+		if decision.Denied {
 			w.Header().Set("Content-Type", "application/json")
-			// If token was provided but is invalid or not registered
-			if token != "" && !m.limiter.IsTokenRegistered(token) {
-				w.WriteHeader(http.StatusForbidden)
-				w.Write([]byte(`{"error": "invalid API key"}`))
-			} else {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte(`{"error": "you have reached the maximum number of requests or actions allowed within a certain time frame"}`))
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "access denied"}`))
+			return
+		}
+
+		// Allowlisted networks are not limited
+		if decision.Exempt {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Retrying a request costing more than the limit never succeeds
+		if !decision.Allowed && decision.CostExceeded {
+			writeTooLarge(w)
+			return
+		}
+
+		SetRateLimitHeaders(w.Header(), decision)
+
+		if !decision.Allowed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			if decision.ConcurrencyLimited {
+				w.Write([]byte(`{"error": "too many concurrent requests"}`))
+				return
 			}
+			w.Write([]byte(`{"error": "you have reached the maximum number of requests or actions allowed within a certain time frame"}`))
 			return
 		}
 
@@ -49,25 +147,36 @@ func (m *RateLimiterMiddleware) Handle(next http.Handler) http.Handler {
 	})
 }
 
-func extractIP(r *http.Request) string {
-	// Try to get real IP from headers (in case of proxy/load balancer)
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// X-Forwarded-For can contain multiple IPs, get the first one
-		if idx := strings.Index(ip, ","); idx != -1 {
-			return strings.TrimSpace(ip[:idx])
-		}
-		return strings.TrimSpace(ip)
-	}
+func writeTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(`{"error": "request too large"}`))
+}
 
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return strings.TrimSpace(ip)
-	}
+// SetRateLimitHeaders describes the limit applied to the request using both the
+// de facto X-RateLimit-* headers and the IETF RateLimit-Policy/RateLimit fields,
+// plus Retry-After when the request is denied and X-RateLimit-Dry-Run naming
+// the dry-run policy that would have denied it. Reset values are the number of
+// seconds until the limit is fully restored.
+func SetRateLimitHeaders(h http.Header, decision limiter.Decision) {
+	limit := strconv.Itoa(decision.Limit)
+	remaining := strconv.FormatInt(decision.Remaining, 10)
+	reset := strconv.FormatInt(seconds(decision.ResetAfter), 10)
 
-	// Fall back to RemoteAddr
-	ip := r.RemoteAddr
-	if idx := strings.LastIndex(ip, ":"); idx != -1 {
-		ip = ip[:idx]
+	h.Set("X-RateLimit-Limit", limit)
+	h.Set("X-RateLimit-Remaining", remaining)
+	h.Set("X-RateLimit-Reset", reset)
+	h.Set("RateLimit-Policy", fmt.Sprintf("%q;q=%s;w=%d", decision.Policy, limit, seconds(decision.Window)))
+	h.Set("RateLimit", fmt.Sprintf("%q;r=%s;t=%s", decision.Policy, remaining, reset))
+	if !decision.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(seconds(decision.RetryAfter), 10))
 	}
+	if decision.DryRun {
+		h.Set("X-RateLimit-Dry-Run", decision.Policy)
+	}
+}
 
-	return ip
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
 }
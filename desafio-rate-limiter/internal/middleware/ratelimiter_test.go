@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyCost(t *testing.T) {
+	cost := BodyCost(100, 1000)
+
+	tests := []struct {
+		name   string
+		length int64
+		want   int
+		err    error
+	}{
+		{"no body", 0, 1, nil},
+		{"one unit", 100, 1, nil},
+		{"started unit", 101, 2, nil},
+		{"max bytes", 1000, 10, nil},
+		{"above max bytes", 1001, 0, ErrBodyTooLarge},
+		{"unknown length", -1, 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 2000)))
+			r.ContentLength = tt.length
+			got, err := cost(r)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// A body of unknown length can't send more than it was charged for
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 2000)))
+	r.ContentLength = -1
+	cost(r)
+	body, err := io.ReadAll(r.Body)
+	assert.Error(t, err)
+	assert.Len(t, body, 1000)
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules:   limiter.Rules{IPPolicy: limiter.Policy{Limit: 5, Window: time.Minute}},
+	})
+	handler := NewRateLimiterMiddleware(rl, IPExtractor{}, BodyCost(100, 1000)).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		length int
+		status int
+	}{
+		{"within the limit", 500, http.StatusOK},
+		{"cost above the limit", 600, http.StatusRequestEntityTooLarge},
+		{"body above max bytes", 1001, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", tt.length)))
+			r.RemoteAddr = "192.0.2.1:1234"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Empty(t, rec.Header().Get("Retry-After"))
+		})
+	}
+
+	// Only the allowed request was counted
+	count, err := store.Get(context.Background(), limiter.Key("ip", "192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), count)
+}
+
+func TestTenantHeaderFromTrustedProxies(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules: limiter.Rules{
+			IPPolicy: limiter.Policy{Limit: 10, Window: time.Minute},
+			Tenants:  map[string]limiter.Tenant{"acme": {Policy: limiter.Policy{Limit: 10, Window: time.Minute}}},
+		},
+	})
+	ipExtractor := IPExtractor{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	handler := NewRateLimiterMiddleware(rl, ipExtractor, nil).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		count      int64
+	}{
+		{"ignored from clients", "192.0.2.1:1234", 0},
+		{"honored from trusted proxies", "10.0.0.1:1234", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set(TenantHeader, "acme")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			count, err := store.Get(r.Context(), limiter.Key("tenant", "acme"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.count, count)
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules:   limiter.Rules{IPPolicy: limiter.Policy{Limit: 2, Window: 10 * time.Second, BlockDuration: time.Minute}},
+	})
+	handler := NewRateLimiterMiddleware(rl, IPExtractor{}, nil).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := serve()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "10", rec.Header().Get("X-RateLimit-Reset"))
+	assert.Equal(t, `"ip";q=2;w=10`, rec.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, `"ip";r=1;t=10`, rec.Header().Get("RateLimit"))
+	assert.Empty(t, rec.Header().Get("Retry-After"))
+
+	serve()
+	// The request exceeding the limit blocks the IP, and the next ones are
+	// told to retry once the block expires
+	for i := 0; i < 2; i++ {
+		rec = serve()
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision limiter.Decision
+		want     http.Header
+	}{
+		{
+			name:     "allowed",
+			decision: limiter.Decision{Allowed: true, Policy: "token", Limit: 100, Window: time.Minute, Remaining: 99, ResetAfter: 1500 * time.Millisecond},
+			want: http.Header{
+				"X-Ratelimit-Limit":     {"100"},
+				"X-Ratelimit-Remaining": {"99"},
+				"X-Ratelimit-Reset":     {"2"},
+				"Ratelimit-Policy":      {`"token";q=100;w=60`},
+				"Ratelimit":             {`"token";r=99;t=2`},
+			},
+		},
+		{
+			name:     "denied",
+			decision: limiter.Decision{Policy: "POST /login", Limit: 5, Window: time.Minute, ResetAfter: time.Minute, RetryAfter: 4*time.Minute + 100*time.Millisecond},
+			want: http.Header{
+				"X-Ratelimit-Limit":     {"5"},
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {"60"},
+				"Ratelimit-Policy":      {`"POST /login";q=5;w=60`},
+				"Ratelimit":             {`"POST /login";r=0;t=60`},
+				"Retry-After":           {"241"},
+			},
+		},
+		{
+			name:     "dry run",
+			decision: limiter.Decision{Allowed: true, DryRun: true, Policy: "ip", Limit: 10, Window: time.Second, RetryAfter: time.Second},
+			want: http.Header{
+				"X-Ratelimit-Limit":     {"10"},
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {"0"},
+				"Ratelimit-Policy":      {`"ip";q=10;w=1`},
+				"Ratelimit":             {`"ip";r=0;t=0`},
+				"X-Ratelimit-Dry-Run":   {"ip"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			SetRateLimitHeaders(header, tt.decision)
+			assert.Equal(t, tt.want, header)
+		})
+	}
+}
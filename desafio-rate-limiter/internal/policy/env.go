@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/config"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+)
+
+// EnvDefaults returns the defaults of the policies built from the environment
+// configuration, applied to the tokens registered through the admin API
+func EnvDefaults(cfg *config.Config) Defaults {
+	return Defaults{
+		Window:           Duration(time.Second),
+		Algorithm:        cfg.Algorithm,
+		BlockDuration:    Duration(time.Duration(cfg.BlockDuration) * time.Second),
+		BlockMultiplier:  cfg.BlockMultiplier,
+		MaxBlockDuration: Duration(cfg.MaxBlockDuration),
+		BlockLookback:    Duration(cfg.BlockLookback),
+		TokenLimit:       cfg.TokenDefaultLimit,
+	}
+}
+
+// FromConfig builds the rules from the environment configuration, used when
+// no policy file is configured
+func FromConfig(cfg *config.Config) (limiter.Rules, error) {
+	blockDuration := time.Duration(cfg.BlockDuration) * time.Second
+
+	// Repeated blocks escalate the same way for every policy
+	escalate := func(policy limiter.Policy) limiter.Policy {
+		policy.BlockMultiplier = cfg.BlockMultiplier
+		policy.MaxBlockDuration = cfg.MaxBlockDuration
+		policy.BlockLookback = cfg.BlockLookback
+		return policy
+	}
+
+	ipAlgorithm, err := limiter.ParseAlgorithm(cfg.IPAlgorithm)
+	if err != nil {
+		return limiter.Rules{}, fmt.Errorf("invalid IP rate limit algorithm: %w", err)
+	}
+
+	tokenPolicies := make(map[string]limiter.Policy, len(cfg.TokenLimits))
+	for token, limit := range cfg.TokenLimits {
+		name, exists := cfg.TokenAlgorithms[token]
+		if !exists {
+			name = cfg.Algorithm
+		}
+		algorithm, err := limiter.ParseAlgorithm(name)
+		if err != nil {
+			return limiter.Rules{}, fmt.Errorf("invalid rate limit algorithm for token %s: %w", token, err)
+		}
+		policy := escalate(limiter.Policy{Limit: limit, Window: time.Second, Algorithm: algorithm, BlockDuration: blockDuration})
+		policy.Concurrency, policy.LeaseTimeout = cfg.TokenConcurrency, cfg.LeaseTimeout
+
+		// Quotas are counted in fixed windows
+		if quotas := cfg.TokenQuotas[token]; len(quotas) > 0 {
+			if exists && algorithm != limiter.FixedWindow {
+				return limiter.Rules{}, fmt.Errorf("invalid quotas for token %s: quotas require the %s algorithm", token, limiter.FixedWindow.Name())
+			}
+			specs := make([]QuotaSpec, len(quotas))
+			for i, quota := range quotas {
+				specs[i] = QuotaSpec{Limit: quota.Limit, Window: Duration(quota.Window)}
+			}
+			if policy.Quotas, err = newQuotas(specs, policy.Window); err != nil {
+				return limiter.Rules{}, fmt.Errorf("invalid quotas for token %s: %w", token, err)
+			}
+			policy.Algorithm = limiter.FixedWindow
+		}
+		tokenPolicies[token] = policy
+	}
+
+	// API keys use the default algorithm and no quotas
+	defaultAlgorithm, err := limiter.ParseAlgorithm(cfg.Algorithm)
+	if err != nil {
+		return limiter.Rules{}, fmt.Errorf("invalid rate limit algorithm: %w", err)
+	}
+	keyPolicies := make(map[string]limiter.Policy, len(cfg.APIKeys))
+	hashes := make(map[string][]apikey.Hash, len(cfg.APIKeys))
+	for id, key := range cfg.APIKeys {
+		policy := escalate(limiter.Policy{Limit: key.Limit, Window: time.Second, Algorithm: defaultAlgorithm, BlockDuration: blockDuration})
+		policy.Concurrency, policy.LeaseTimeout = cfg.TokenConcurrency, cfg.LeaseTimeout
+		keyPolicies[id] = policy
+		for _, hash := range key.Hashes {
+			hashes[id] = append(hashes[id], apikey.Hash{Value: hash.Value, Expires: hash.Expires})
+		}
+	}
+	signing := make([]apikey.SigningKey, len(cfg.APISigningSecrets))
+	for i, secret := range cfg.APISigningSecrets {
+		signing[i] = apikey.SigningKey{Secret: []byte(secret.Value), Expires: secret.Expires}
+	}
+	keyring, err := newKeyring(keyPolicies, hashes, signing)
+	if err != nil {
+		return limiter.Rules{}, fmt.Errorf("invalid API keys: %w", err)
+	}
+
+	networkPolicies := make([]limiter.NetworkPolicy, 0, len(cfg.AllowedNetworks)+len(cfg.DeniedNetworks))
+	seen := make(map[netip.Prefix]bool, cap(networkPolicies))
+	for _, prefix := range cfg.AllowedNetworks {
+		networkPolicies = append(networkPolicies, limiter.NetworkPolicy{Prefix: prefix, Action: limiter.NetworkAllow})
+		seen[prefix] = true
+	}
+	for _, prefix := range cfg.DeniedNetworks {
+		if seen[prefix] {
+			return limiter.Rules{}, fmt.Errorf("network %s is both allowed and denied", prefix)
+		}
+		networkPolicies = append(networkPolicies, limiter.NetworkPolicy{Prefix: prefix, Action: limiter.NetworkDeny})
+	}
+
+	routePolicies := make([]limiter.RoutePolicy, 0, len(cfg.RouteLimits))
+	for _, route := range cfg.RouteLimits {
+		algorithm, err := limiter.ParseAlgorithm(route.Algorithm)
+		if err != nil {
+			return limiter.Rules{}, fmt.Errorf("invalid rate limit algorithm for route %s %s: %w", route.Method, route.Pattern, err)
+		}
+		routePolicies = append(routePolicies, limiter.RoutePolicy{
+			Method:  route.Method,
+			Pattern: route.Pattern,
+			Policy: escalate(limiter.Policy{
+				Limit:         route.Limit,
+				Window:        route.Window,
+				Algorithm:     algorithm,
+				BlockDuration: route.BlockDuration,
+			}),
+		})
+	}
+
+	routeCosts := make([]limiter.RouteCost, 0, len(cfg.RouteCosts))
+	for _, cost := range cfg.RouteCosts {
+		routeCosts = append(routeCosts, limiter.RouteCost{Method: cost.Method, Pattern: cost.Pattern, Cost: cost.Cost})
+	}
+
+	ipPolicy := escalate(limiter.Policy{Limit: cfg.RateLimitIP, Window: time.Second, Algorithm: ipAlgorithm, BlockDuration: blockDuration})
+	ipPolicy.Concurrency, ipPolicy.LeaseTimeout = cfg.IPConcurrency, cfg.LeaseTimeout
+	ipPolicy.DryRun = cfg.IPDryRun
+	if cfg.IPShadowLimit > 0 {
+		ipPolicy.Shadow = &limiter.Policy{Limit: cfg.IPShadowLimit, Window: time.Second, Algorithm: ipAlgorithm, DryRun: true}
+	}
+
+	return limiter.Rules{
+		IPPolicy:        ipPolicy,
+		TokenPolicies:   tokenPolicies,
+		APIKeys:         keyring,
+		KeyPolicies:     keyPolicies,
+		NetworkPolicies: networkPolicies,
+		RoutePolicies:   routePolicies,
+		RouteCosts:      routeCosts,
+	}, nil
+}
@@ -0,0 +1,581 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/config"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the structured policy file of the rate limiter, written in YAML or JSON
+type File struct {
+	Defaults Defaults        `json:"defaults" yaml:"defaults"`
+	IP       Spec            `json:"ip" yaml:"ip"`
+	Tokens   map[string]Spec `json:"tokens" yaml:"tokens"`
+	Networks []NetworkSpec   `json:"networks" yaml:"networks"`
+	Routes   []RouteSpec     `json:"routes" yaml:"routes"`
+	Costs    []CostSpec      `json:"costs" yaml:"costs"`
+	// Keys are the API keys verified by hash or signature, by key id
+	Keys        map[string]KeySpec `json:"keys" yaml:"keys"`
+	SigningKeys []SigningKeySpec   `json:"signing_keys" yaml:"signing_keys"`
+	// Tenants limit the requests of their tokens and keys in aggregate, by name
+	Tenants map[string]TenantSpec `json:"tenants" yaml:"tenants"`
+}
+
+// Defaults are applied to every policy that does not set the field
+type Defaults struct {
+	Window        Duration `json:"window" yaml:"window"`
+	Algorithm     string   `json:"algorithm" yaml:"algorithm"`
+	BlockDuration Duration `json:"block_duration" yaml:"block_duration"`
+	// BlockMultiplier multiplies the block duration on every repeated block of
+	// a key within BlockLookback (default 24h with a multiplier above 1, none
+	// otherwise), up to MaxBlockDuration (default 24h). Unset or 1 keeps the
+	// block fixed.
+	BlockMultiplier  float64  `json:"block_multiplier" yaml:"block_multiplier"`
+	MaxBlockDuration Duration `json:"max_block_duration" yaml:"max_block_duration"`
+	BlockLookback    Duration `json:"block_lookback" yaml:"block_lookback"`
+	// TokenLimit is the limit of tokens registered without one
+	TokenLimit int `json:"token_limit" yaml:"token_limit"`
+}
+
+// defaultBlockEscalation is the default lookback of repeated blocks and cap of
+// escalated blocks
+const defaultBlockEscalation = 24 * time.Hour
+
+// Spec describes a single policy. Unset fields take their value from Defaults.
+type Spec struct {
+	Limit         int       `json:"limit" yaml:"limit"`
+	Window        Duration  `json:"window" yaml:"window"`
+	Algorithm     string    `json:"algorithm" yaml:"algorithm"`
+	BlockDuration *Duration `json:"block_duration" yaml:"block_duration"`
+	// BlockMultiplier, MaxBlockDuration and BlockLookback escalate the block of
+	// repeat offenders, see Defaults
+	BlockMultiplier  float64  `json:"block_multiplier" yaml:"block_multiplier"`
+	MaxBlockDuration Duration `json:"max_block_duration" yaml:"max_block_duration"`
+	BlockLookback    Duration `json:"block_lookback" yaml:"block_lookback"`
+	// Quotas are enforced together with Limit, in fixed windows
+	Quotas []QuotaSpec `json:"quotas" yaml:"quotas"`
+	// Concurrency caps the requests in flight, each holding a lease released
+	// when it completes or after LeaseTimeout
+	Concurrency  int      `json:"concurrency" yaml:"concurrency"`
+	LeaseTimeout Duration `json:"lease_timeout" yaml:"lease_timeout"`
+	// DryRun logs and counts the requests the policy would deny, letting them
+	// through
+	DryRun bool `json:"dry_run" yaml:"dry_run"`
+	// Shadow is a candidate policy evaluated in dry-run mode next to this one,
+	// which is still enforced. Its unset fields take the value of this policy,
+	// so a tighter limit to roll out only needs its limit.
+	Shadow *Spec `json:"shadow" yaml:"shadow"`
+}
+
+// QuotaSpec is an additional limit of requests per window, such as 100000
+// requests per day
+type QuotaSpec struct {
+	Limit  int      `json:"limit" yaml:"limit"`
+	Window Duration `json:"window" yaml:"window"`
+}
+
+// NetworkSpec allows, denies or overrides the IP policy for the addresses of a
+// CIDR. Action is "limit" (the default), "allow" or "deny". Limited networks
+// count each address separately unless Shared is set.
+type NetworkSpec struct {
+	CIDR   string `json:"cidr" yaml:"cidr"`
+	Action string `json:"action" yaml:"action"`
+	Shared bool   `json:"shared" yaml:"shared"`
+	Spec   `yaml:",inline"`
+}
+
+// RouteSpec limits the requests matching a method and a path pattern
+type RouteSpec struct {
+	Method string `json:"method" yaml:"method"`
+	Path   string `json:"path" yaml:"path"`
+	Spec   `yaml:",inline"`
+}
+
+// KeySpec is the policy of an API key id and the salted hashes of its secrets.
+// Keys signed with a signing key are accepted for any id with a spec, even
+// without hashes.
+type KeySpec struct {
+	Hashes []HashSpec `json:"hashes" yaml:"hashes"`
+	Spec   `yaml:",inline"`
+}
+
+// HashSpec is the hash of a secret of an API key, valid until Expires when set
+type HashSpec struct {
+	Hash    string    `json:"hash" yaml:"hash"`
+	Expires time.Time `json:"expires" yaml:"expires"`
+}
+
+// SigningKeySpec is a secret signing API keys, read from the environment
+// variable SecretEnv so that it is not written in the file, and valid until
+// Expires when set
+type SigningKeySpec struct {
+	SecretEnv string    `json:"secret_env" yaml:"secret_env"`
+	Expires   time.Time `json:"expires" yaml:"expires"`
+}
+
+// TenantSpec is the aggregate policy of a tenant and its members, plaintext
+// tokens and API key ids registered in the file. A token or key belongs to at
+// most one tenant.
+type TenantSpec struct {
+	Tokens []string `json:"tokens" yaml:"tokens"`
+	Keys   []string `json:"keys" yaml:"keys"`
+	Spec   `yaml:",inline"`
+}
+
+// CostSpec sets the number of units of the limits consumed by the requests
+// matching a method and a path pattern
+type CostSpec struct {
+	Method string `json:"method" yaml:"method"`
+	Path   string `json:"path" yaml:"path"`
+	Cost   int    `json:"cost" yaml:"cost"`
+}
+
+// Duration is a time.Duration written as a Go duration string, such as "1m30s",
+// or as a number of days, such as "30d"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := config.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Load reads and validates the policy file at path. Files ending in ".json"
+// are decoded as JSON, any other file as YAML.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	file, err := Parse(data, isJSON(path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// Parse decodes and validates a policy file. Unknown fields are rejected so
+// that typos do not silently fall back to defaults.
+func Parse(data []byte, isJSON bool) (*File, error) {
+	var file File
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&file); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&file); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := file.Rules(); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Rules validates the file and builds the rules enforced by the rate limiter
+func (f *File) Rules() (limiter.Rules, error) {
+	var errs []error
+
+	ipPolicy, err := f.Defaults.policy(f.IP, 0)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ip: %w", err))
+	}
+
+	tokenPolicies := make(map[string]limiter.Policy, len(f.Tokens))
+	for token, spec := range f.Tokens {
+		if token == "" {
+			errs = append(errs, errors.New("tokens: empty token"))
+			continue
+		}
+		policy, err := f.Defaults.TokenPolicy(spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("token %s: %w", token, err))
+			continue
+		}
+		tokenPolicies[token] = policy
+	}
+
+	keyPolicies := make(map[string]limiter.Policy, len(f.Keys))
+	hashes := make(map[string][]apikey.Hash, len(f.Keys))
+	for id, spec := range f.Keys {
+		policy, err := f.Defaults.TokenPolicy(spec.Spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", id, err))
+			continue
+		}
+		keyPolicies[id] = policy
+		for _, hash := range spec.Hashes {
+			hashes[id] = append(hashes[id], apikey.Hash{Value: hash.Hash, Expires: hash.Expires})
+		}
+	}
+	signing := make([]apikey.SigningKey, 0, len(f.SigningKeys))
+	for i, key := range f.SigningKeys {
+		secret := os.Getenv(key.SecretEnv)
+		if key.SecretEnv == "" || secret == "" {
+			errs = append(errs, fmt.Errorf("signing_keys[%d]: secret_env must name a set environment variable", i))
+			continue
+		}
+		signing = append(signing, apikey.SigningKey{Secret: []byte(secret), Expires: key.Expires})
+	}
+	keyring, err := newKeyring(keyPolicies, hashes, signing)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("keys: %w", err))
+	}
+
+	tenants, tenantErrs := f.tenants()
+	errs = append(errs, tenantErrs...)
+
+	networkPolicies := make([]limiter.NetworkPolicy, 0, len(f.Networks))
+	seen := make(map[netip.Prefix]bool, len(f.Networks))
+	for i, network := range f.Networks {
+		prefix, err := netip.ParsePrefix(network.CIDR)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("networks[%d]: %w", i, err))
+			continue
+		}
+		prefix = prefix.Masked()
+		if seen[prefix] {
+			errs = append(errs, fmt.Errorf("networks[%d]: duplicate network %s", i, prefix))
+			continue
+		}
+		seen[prefix] = true
+
+		networkPolicy, err := f.Defaults.networkPolicy(prefix, network)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", prefix, err))
+			continue
+		}
+		networkPolicies = append(networkPolicies, networkPolicy)
+	}
+
+	routePolicies := make([]limiter.RoutePolicy, 0, len(f.Routes))
+	for i, route := range f.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			errs = append(errs, fmt.Errorf("routes[%d]: path %q must start with /", i, route.Path))
+			continue
+		}
+		if route.Method != "" && !isMethod(route.Method) {
+			errs = append(errs, fmt.Errorf("routes[%d]: unknown method %q", i, route.Method))
+			continue
+		}
+
+		policy, err := f.Defaults.policy(route.Spec, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("routes[%d]: %w", i, err))
+			continue
+		}
+		routePolicies = append(routePolicies, limiter.RoutePolicy{
+			Method:  strings.ToUpper(route.Method),
+			Pattern: route.Path,
+			Policy:  policy,
+		})
+	}
+
+	routeCosts := make([]limiter.RouteCost, 0, len(f.Costs))
+	for i, cost := range f.Costs {
+		switch {
+		case !strings.HasPrefix(cost.Path, "/"):
+			errs = append(errs, fmt.Errorf("costs[%d]: path %q must start with /", i, cost.Path))
+		case cost.Method != "" && !isMethod(cost.Method):
+			errs = append(errs, fmt.Errorf("costs[%d]: unknown method %q", i, cost.Method))
+		case cost.Cost <= 0:
+			errs = append(errs, fmt.Errorf("costs[%d]: cost must be positive", i))
+		default:
+			routeCosts = append(routeCosts, limiter.RouteCost{
+				Method:  strings.ToUpper(cost.Method),
+				Pattern: cost.Path,
+				Cost:    cost.Cost,
+			})
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return limiter.Rules{}, err
+	}
+
+	return limiter.Rules{
+		IPPolicy:        ipPolicy,
+		TokenPolicies:   tokenPolicies,
+		APIKeys:         keyring,
+		KeyPolicies:     keyPolicies,
+		NetworkPolicies: networkPolicies,
+		RoutePolicies:   routePolicies,
+		RouteCosts:      routeCosts,
+		Tenants:         tenants,
+	}, nil
+}
+
+// tenants validates the tenants and their members and builds their policies
+func (f *File) tenants() (map[string]limiter.Tenant, []error) {
+	var errs []error
+	tenants := make(map[string]limiter.Tenant, len(f.Tenants))
+	members := make(map[string]string)
+	member := func(name, kind, id string) {
+		if tenant, exists := members[kind+" "+id]; exists {
+			errs = append(errs, fmt.Errorf("tenant %s: %s %s already belongs to tenant %s", name, kind, id, tenant))
+		}
+		members[kind+" "+id] = name
+	}
+
+	for name, spec := range f.Tenants {
+		if !apikey.ValidID(name) {
+			errs = append(errs, fmt.Errorf("invalid tenant name %q: only letters, digits, \"-\" and \"_\" are allowed", name))
+			continue
+		}
+		policy, err := f.Defaults.policy(spec.Spec, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", name, err))
+			continue
+		}
+		for _, token := range spec.Tokens {
+			if _, exists := f.Tokens[token]; !exists {
+				errs = append(errs, fmt.Errorf("tenant %s: token %s is not registered", name, token))
+			}
+			member(name, "token", token)
+		}
+		for _, id := range spec.Keys {
+			if _, exists := f.Keys[id]; !exists {
+				errs = append(errs, fmt.Errorf("tenant %s: key %s is not registered", name, id))
+			}
+			member(name, "key", id)
+		}
+		tenants[name] = limiter.Tenant{Policy: policy, Tokens: spec.Tokens, Keys: spec.Keys}
+	}
+	return tenants, errs
+}
+
+// TokenPolicy validates a token spec and builds its policy, completing it with
+// the defaults
+func (d Defaults) TokenPolicy(spec Spec) (limiter.Policy, error) {
+	return d.policy(spec, d.TokenLimit)
+}
+
+// newKeyring builds the keyring resolving the API keys to their id, nil when no
+// key is registered
+func newKeyring(policies map[string]limiter.Policy, hashes map[string][]apikey.Hash, signing []apikey.SigningKey) (*apikey.Keyring, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	for id := range policies {
+		if !apikey.ValidID(id) {
+			return nil, fmt.Errorf("invalid key id %q: only letters, digits, \"-\" and \"_\" are allowed", id)
+		}
+	}
+	return apikey.NewKeyring(hashes, signing)
+}
+
+// networkPolicy validates a network spec and builds its policy. Allowed and
+// denied networks are not counted, so they must not set a policy.
+func (d Defaults) networkPolicy(prefix netip.Prefix, spec NetworkSpec) (limiter.NetworkPolicy, error) {
+	switch strings.ToLower(spec.Action) {
+	case "", "limit":
+		policy, err := d.policy(spec.Spec, 0)
+		if err != nil {
+			return limiter.NetworkPolicy{}, err
+		}
+		return limiter.NetworkPolicy{Prefix: prefix, Action: limiter.NetworkLimit, Policy: policy, Shared: spec.Shared}, nil
+	case "allow", "deny":
+		if spec.Limit != 0 || spec.Window != 0 || spec.Algorithm != "" || spec.BlockDuration != nil || spec.BlockMultiplier != 0 ||
+			spec.MaxBlockDuration != 0 || spec.BlockLookback != 0 || len(spec.Quotas) > 0 || spec.Shared || spec.Shadow != nil {
+			return limiter.NetworkPolicy{}, fmt.Errorf("%s networks do not take a limit", spec.Action)
+		}
+		action := limiter.NetworkAllow
+		if strings.EqualFold(spec.Action, "deny") {
+			action = limiter.NetworkDeny
+		}
+		return limiter.NetworkPolicy{Prefix: prefix, Action: action}, nil
+	}
+	return limiter.NetworkPolicy{}, fmt.Errorf("unknown action %q", spec.Action)
+}
+
+// policy builds a limiter policy from a spec, completing it with the defaults
+func (d Defaults) policy(spec Spec, defaultLimit int) (limiter.Policy, error) {
+	limit := spec.Limit
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	if limit <= 0 {
+		return limiter.Policy{}, errors.New("limit must be positive")
+	}
+
+	window := time.Duration(spec.Window)
+	if window == 0 {
+		window = time.Duration(d.Window)
+	}
+	if window == 0 {
+		window = time.Second
+	}
+	if window < 0 {
+		return limiter.Policy{}, errors.New("window must be positive")
+	}
+
+	name := spec.Algorithm
+	if name == "" {
+		name = d.Algorithm
+	}
+	algorithm, err := limiter.ParseAlgorithm(name)
+	if err != nil {
+		return limiter.Policy{}, err
+	}
+	// Quotas are counted in fixed windows, overriding the default algorithm
+	if len(spec.Quotas) > 0 && algorithm != limiter.FixedWindow {
+		if spec.Algorithm != "" {
+			return limiter.Policy{}, fmt.Errorf("quotas require the %s algorithm", limiter.FixedWindow.Name())
+		}
+		log.Printf("Counting a policy with quotas with the %s algorithm instead of the default %s", limiter.FixedWindow.Name(), algorithm.Name())
+		algorithm = limiter.FixedWindow
+	}
+
+	quotas, err := newQuotas(spec.Quotas, window)
+	if err != nil {
+		return limiter.Policy{}, err
+	}
+
+	blockDuration := time.Duration(d.BlockDuration)
+	if spec.BlockDuration != nil {
+		blockDuration = time.Duration(*spec.BlockDuration)
+	}
+	if blockDuration < 0 {
+		return limiter.Policy{}, errors.New("block duration must not be negative")
+	}
+
+	multiplier := firstNonZero(spec.BlockMultiplier, d.BlockMultiplier, 1)
+	maxBlock := time.Duration(firstNonZero(spec.MaxBlockDuration, d.MaxBlockDuration, Duration(defaultBlockEscalation)))
+	lookback := time.Duration(firstNonZero(spec.BlockLookback, d.BlockLookback))
+	if lookback == 0 && multiplier > 1 {
+		lookback = defaultBlockEscalation
+	}
+	switch {
+	case multiplier < 1:
+		return limiter.Policy{}, errors.New("block multiplier must be at least 1")
+	case maxBlock < 0:
+		return limiter.Policy{}, errors.New("max block duration must not be negative")
+	case lookback < 0:
+		return limiter.Policy{}, errors.New("block lookback must not be negative")
+	case spec.Concurrency < 0:
+		return limiter.Policy{}, errors.New("concurrency must not be negative")
+	case spec.LeaseTimeout < 0:
+		return limiter.Policy{}, errors.New("lease timeout must not be negative")
+	}
+
+	policy := limiter.Policy{
+		Limit:            limit,
+		Window:           window,
+		Algorithm:        algorithm,
+		BlockDuration:    blockDuration,
+		BlockMultiplier:  multiplier,
+		MaxBlockDuration: maxBlock,
+		BlockLookback:    lookback,
+		Quotas:           quotas,
+		Concurrency:      spec.Concurrency,
+		LeaseTimeout:     time.Duration(spec.LeaseTimeout),
+		DryRun:           spec.DryRun,
+	}
+	if spec.Shadow != nil {
+		if policy.Shadow, err = d.shadow(spec, defaultLimit); err != nil {
+			return limiter.Policy{}, err
+		}
+	}
+	return policy, nil
+}
+
+// shadow builds the shadow policy of a spec, whose unset fields take the value
+// of the spec
+func (d Defaults) shadow(spec Spec, defaultLimit int) (*limiter.Policy, error) {
+	shadow := *spec.Shadow
+	if shadow.Shadow != nil {
+		return nil, errors.New("shadow policies cannot have a shadow")
+	}
+	shadow.Limit = firstNonZero(shadow.Limit, spec.Limit)
+	shadow.Window = firstNonZero(shadow.Window, spec.Window)
+	shadow.Algorithm = firstNonZero(shadow.Algorithm, spec.Algorithm)
+	shadow.Concurrency = firstNonZero(shadow.Concurrency, spec.Concurrency)
+	shadow.LeaseTimeout = firstNonZero(shadow.LeaseTimeout, spec.LeaseTimeout)
+	if shadow.Quotas == nil {
+		shadow.Quotas = spec.Quotas
+	}
+
+	policy, err := d.policy(shadow, defaultLimit)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: %w", err)
+	}
+	policy.DryRun = true
+	return &policy, nil
+}
+
+// firstNonZero returns the first value that is not zero
+func firstNonZero[T comparable](values ...T) T {
+	var zero T
+	for _, value := range values {
+		if value != zero {
+			return value
+		}
+	}
+	return zero
+}
+
+// newQuotas validates the quotas of a policy with the given window. Every quota
+// needs its own window, since the window identifies its counter.
+func newQuotas(specs []QuotaSpec, window time.Duration) ([]limiter.Quota, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	quotas := make([]limiter.Quota, 0, len(specs))
+	windows := map[time.Duration]bool{window: true}
+	for i, spec := range specs {
+		quotaWindow := time.Duration(spec.Window)
+		switch {
+		case spec.Limit <= 0:
+			return nil, fmt.Errorf("quotas[%d]: limit must be positive", i)
+		case quotaWindow <= 0:
+			return nil, fmt.Errorf("quotas[%d]: window must be positive", i)
+		case windows[quotaWindow]:
+			return nil, fmt.Errorf("quotas[%d]: duplicate window %s", i, quotaWindow)
+		}
+		windows[quotaWindow] = true
+		quotas = append(quotas, limiter.Quota{Limit: spec.Limit, Window: quotaWindow})
+	}
+	return quotas, nil
+}
+
+// isJSON reports whether the policy file at path is written in JSON
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+func isMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
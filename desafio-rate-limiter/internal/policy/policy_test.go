@@ -0,0 +1,310 @@
+package policy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/apikey"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseYAML(t *testing.T) {
+	data := []byte(`
+defaults:
+  window: 1s
+  block_duration: 5m
+  token_limit: 15
+ip:
+  limit: 5
+tokens:
+  abc123:
+    limit: 10
+    algorithm: gcra
+  teste: {}
+networks:
+  - cidr: 10.1.2.3/8
+    limit: 100
+    block_duration: 0s
+  - cidr: 198.51.100.0/24
+    limit: 500
+    shared: true
+  - cidr: 203.0.113.0/24
+    action: deny
+routes:
+  - method: post
+    path: /login
+    limit: 5
+    window: 1m
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	assert.Equal(t, limiter.Policy{
+		Limit: 5, Window: time.Second, Algorithm: limiter.FixedWindow, BlockDuration: 5 * time.Minute,
+		BlockMultiplier: 1, MaxBlockDuration: 24 * time.Hour,
+	}, rules.IPPolicy)
+	assert.Equal(t, limiter.Policy{
+		Limit: 10, Window: time.Second, Algorithm: limiter.GCRA, BlockDuration: 5 * time.Minute,
+		BlockMultiplier: 1, MaxBlockDuration: 24 * time.Hour,
+	}, rules.TokenPolicies["abc123"])
+	assert.Equal(t, 15, rules.TokenPolicies["teste"].Limit)
+
+	require.Len(t, rules.NetworkPolicies, 3)
+	assert.Equal(t, "10.0.0.0/8", rules.NetworkPolicies[0].Prefix.String())
+	assert.Equal(t, limiter.NetworkLimit, rules.NetworkPolicies[0].Action)
+	assert.Zero(t, rules.NetworkPolicies[0].Policy.BlockDuration)
+	assert.True(t, rules.NetworkPolicies[1].Shared)
+	assert.Equal(t, limiter.NetworkDeny, rules.NetworkPolicies[2].Action)
+
+	require.Len(t, rules.RoutePolicies, 1)
+	assert.Equal(t, "POST /login", rules.RoutePolicies[0].Name())
+	assert.Equal(t, time.Minute, rules.RoutePolicies[0].Policy.Window)
+}
+
+func TestParseBlockEscalation(t *testing.T) {
+	data := []byte(`
+defaults:
+  block_duration: 1m
+  block_multiplier: 2
+  max_block_duration: 1h
+ip:
+  limit: 5
+tokens:
+  abc123:
+    limit: 10
+    block_multiplier: 1
+    block_lookback: 1h
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	assert.Equal(t, 2.0, rules.IPPolicy.BlockMultiplier)
+	assert.Equal(t, time.Hour, rules.IPPolicy.MaxBlockDuration)
+	assert.Equal(t, 24*time.Hour, rules.IPPolicy.BlockLookback)
+	assert.Equal(t, 1.0, rules.TokenPolicies["abc123"].BlockMultiplier)
+	assert.Equal(t, time.Hour, rules.TokenPolicies["abc123"].BlockLookback)
+}
+
+func TestParseShadow(t *testing.T) {
+	data := []byte(`
+ip:
+  limit: 10
+  window: 1m
+  algorithm: gcra
+  shadow:
+    limit: 5
+routes:
+  - path: /upload
+    limit: 10
+    dry_run: true
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	// The shadow takes the unset fields of the enforced policy
+	assert.False(t, rules.IPPolicy.DryRun)
+	require.NotNil(t, rules.IPPolicy.Shadow)
+	shadow := rules.IPPolicy.Shadow
+	assert.Equal(t, 5, shadow.Limit)
+	assert.Equal(t, time.Minute, shadow.Window)
+	assert.Equal(t, limiter.GCRA, shadow.Algorithm)
+	assert.True(t, shadow.DryRun)
+	assert.True(t, rules.RoutePolicies[0].Policy.DryRun)
+}
+
+func TestParseQuotas(t *testing.T) {
+	data := []byte(`
+defaults:
+  algorithm: gcra
+ip:
+  limit: 5
+tokens:
+  premium:
+    limit: 10
+    quotas:
+      - limit: 500
+        window: 1m
+      - limit: 100000
+        window: 1d
+  basic:
+    limit: 5
+    algorithm: Fixed_Window
+    quotas:
+      - limit: 100
+        window: 1h
+`)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	// Overriding the default algorithm is logged
+	assert.Contains(t, out.String(), "Counting a policy with quotas with the fixed_window algorithm instead of the default gcra")
+	assert.Equal(t, limiter.FixedWindow, rules.TokenPolicies["basic"].Algorithm)
+
+	premium := rules.TokenPolicies["premium"]
+	assert.Equal(t, limiter.FixedWindow, premium.Algorithm)
+	assert.Equal(t, []limiter.Quota{{Limit: 500, Window: time.Minute}, {Limit: 100000, Window: 24 * time.Hour}}, premium.Quotas)
+	assert.Equal(t, limiter.GCRA, rules.IPPolicy.Algorithm)
+}
+
+func TestParseCosts(t *testing.T) {
+	data := []byte(`
+ip:
+  limit: 100
+costs:
+  - method: post
+    path: /export
+    cost: 50
+  - path: /bulk/*
+    cost: 10
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	assert.Equal(t, []limiter.RouteCost{
+		{Method: "POST", Pattern: "/export", Cost: 50},
+		{Pattern: "/bulk/*", Cost: 10},
+	}, rules.RouteCosts)
+}
+
+func TestParseKeys(t *testing.T) {
+	t.Setenv("SIGNING_SECRET", "0123456789abcdef0123456789abcdef")
+	key, hash, err := apikey.Generate("acme")
+	require.NoError(t, err)
+	data := []byte(`
+ip:
+  limit: 5
+keys:
+  acme:
+    limit: 50
+    hashes:
+      - hash: ` + hash + `
+      - hash: sha256:00:` + strings.Repeat("00", 32) + `
+        expires: 2024-01-01T00:00:00Z
+signing_keys:
+  - secret_env: SIGNING_SECRET
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	assert.Equal(t, 50, rules.KeyPolicies["acme"].Limit)
+	id, valid := rules.APIKeys.Resolve(key)
+	assert.True(t, valid)
+	assert.Equal(t, "acme", id)
+
+	signed, err := apikey.Sign([]byte("0123456789abcdef0123456789abcdef"), "acme", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, valid = rules.APIKeys.Resolve(signed)
+	assert.True(t, valid)
+}
+
+func TestParseTenants(t *testing.T) {
+	data := []byte(`
+ip:
+  limit: 5
+tokens:
+  abc123:
+    limit: 10
+keys:
+  acme-web:
+    limit: 50
+tenants:
+  acme:
+    limit: 100
+    window: 1m
+    tokens: [abc123]
+    keys: [acme-web]
+`)
+
+	file, err := Parse(data, false)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	tenant := rules.Tenants["acme"]
+	assert.Equal(t, 100, tenant.Policy.Limit)
+	assert.Equal(t, time.Minute, tenant.Policy.Window)
+	assert.Equal(t, []string{"abc123"}, tenant.Tokens)
+	assert.Equal(t, []string{"acme-web"}, tenant.Keys)
+}
+
+func TestParseJSON(t *testing.T) {
+	data := []byte(`{"ip": {"limit": 5, "window": "10s"}, "routes": [{"path": "/api/*", "limit": 100}]}`)
+
+	file, err := Parse(data, true)
+	require.NoError(t, err)
+	rules, err := file.Rules()
+	require.NoError(t, err)
+
+	assert.Equal(t, 10*time.Second, rules.IPPolicy.Window)
+	assert.Equal(t, "/api/*", rules.RoutePolicies[0].Name())
+}
+
+func TestParseRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unknown field", data: "ip:\n  limit: 5\n  limti: 10\n"},
+		{name: "missing IP limit", data: "ip: {}\n"},
+		{name: "token without limit", data: "ip:\n  limit: 5\ntokens:\n  abc: {}\n"},
+		{name: "unknown algorithm", data: "ip:\n  limit: 5\n  algorithm: leaky\n"},
+		{name: "invalid duration", data: "ip:\n  limit: 5\n  window: soon\n"},
+		{name: "invalid CIDR", data: "ip:\n  limit: 5\nnetworks:\n  - cidr: 10.0.0.0/33\n    limit: 1\n"},
+		{name: "duplicate network", data: "ip:\n  limit: 5\nnetworks:\n  - cidr: 10.0.0.0/8\n    limit: 1\n  - cidr: 10.1.0.0/8\n    limit: 2\n"},
+		{name: "unknown network action", data: "ip:\n  limit: 5\nnetworks:\n  - cidr: 10.0.0.0/8\n    action: block\n"},
+		{name: "allowed network with limit", data: "ip:\n  limit: 5\nnetworks:\n  - cidr: 10.0.0.0/8\n    action: allow\n    limit: 1\n"},
+		{name: "quota without window", data: "ip:\n  limit: 5\n  quotas:\n    - limit: 100\n"},
+		{name: "duplicate quota window", data: "ip:\n  limit: 5\n  quotas:\n    - limit: 100\n      window: 1s\n"},
+		{name: "quotas with another algorithm", data: "ip:\n  limit: 5\n  algorithm: gcra\n  quotas:\n    - limit: 100\n      window: 1m\n"},
+		{name: "cost without path", data: "ip:\n  limit: 5\ncosts:\n  - cost: 10\n"},
+		{name: "non-positive cost", data: "ip:\n  limit: 5\ncosts:\n  - path: /export\n    cost: 0\n"},
+		{name: "block multiplier below 1", data: "ip:\n  limit: 5\n  block_multiplier: 0.5\n"},
+		{name: "negative concurrency", data: "ip:\n  limit: 5\n  concurrency: -1\n"},
+		{name: "invalid shadow", data: "ip:\n  limit: 5\n  shadow:\n    window: -1s\n"},
+		{name: "shadow of a shadow", data: "ip:\n  limit: 5\n  shadow:\n    limit: 2\n    shadow:\n      limit: 1\n"},
+		{name: "allowed network with shadow", data: "ip:\n  limit: 5\nnetworks:\n  - cidr: 10.0.0.0/8\n    action: allow\n    shadow:\n      limit: 1\n"},
+		{name: "relative route", data: "ip:\n  limit: 5\nroutes:\n  - path: login\n    limit: 1\n"},
+		{name: "invalid key hash", data: "ip:\n  limit: 5\nkeys:\n  acme:\n    limit: 1\n    hashes:\n      - hash: secret\n"},
+		{name: "invalid key id", data: "ip:\n  limit: 5\nkeys:\n  acme.v2:\n    limit: 1\n"},
+		{name: "unset signing secret", data: "ip:\n  limit: 5\nsigning_keys:\n  - secret_env: UNSET_SIGNING_SECRET\n"},
+		{name: "unknown method", data: "ip:\n  limit: 5\nroutes:\n  - method: FETCH\n    path: /login\n    limit: 1\n"},
+		{name: "tenant without limit", data: "ip:\n  limit: 5\ntenants:\n  acme: {}\n"},
+		{name: "invalid tenant name", data: "ip:\n  limit: 5\ntenants:\n  acme:prod:\n    limit: 1\n"},
+		{name: "unregistered tenant token", data: "ip:\n  limit: 5\ntenants:\n  acme:\n    limit: 1\n    tokens: [abc]\n"},
+		{name: "token of two tenants", data: "ip:\n  limit: 5\ntokens:\n  abc:\n    limit: 1\ntenants:\n  a:\n    limit: 1\n    tokens: [abc]\n  b:\n    limit: 1\n    tokens: [abc]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data), false)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+)
+
+// Watcher polls a policy file and swaps the rules of a rate limiter whenever
+// the file content changes. Invalid files are rejected and logged, keeping the
+// rules currently enforced.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	limiter  *limiter.RateLimiter
+	checksum [sha256.Size]byte
+	// defaults are those of the file currently applied
+	defaults atomic.Pointer[Defaults]
+}
+
+// NewWatcher loads the policy file, applies its rules to the rate limiter and
+// returns a watcher for later changes. It fails if the file is invalid.
+func NewWatcher(path string, interval time.Duration, rl *limiter.RateLimiter) (*Watcher, error) {
+	w := &Watcher{
+		path:     path,
+		interval: interval,
+		limiter:  rl,
+	}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run watches the file until the context is canceled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := w.reload()
+			if err != nil {
+				log.Printf("Rejected policy reload: %v", err)
+				continue
+			}
+			if changed {
+				log.Printf("Reloaded rate limit policies from %s", w.path)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload applies the file if its content changed since the last reload
+func (w *Watcher) reload() (bool, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, err
+	}
+
+	checksum := sha256.Sum256(data)
+	if checksum == w.checksum {
+		return false, nil
+	}
+	// Remember the checksum of rejected files too, so they are reported once
+	w.checksum = checksum
+
+	file, err := Parse(data, isJSON(w.path))
+	if err != nil {
+		return false, err
+	}
+	rules, err := file.Rules()
+	if err != nil {
+		return false, err
+	}
+
+	w.limiter.SetRules(rules)
+	w.defaults.Store(&file.Defaults)
+	return true, nil
+}
+
+// Defaults returns the defaults of the policy file currently applied
+func (w *Watcher) Defaults() Defaults {
+	return *w.defaults.Load()
+}
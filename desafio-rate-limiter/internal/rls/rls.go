@@ -0,0 +1,221 @@
+// Package rls exposes the rate limiter as an Envoy rate limit service, so that
+// proxies and services written in other languages share the same policies and
+// storage as the embedded middleware.
+package rls
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Descriptor entry keys describing the request. Envoy fills remote_address
+// with the remote_address action; the others come from request_headers
+// actions, e.g. the ":path" header with the "path" descriptor key and the
+// "x-request-id" header with the "request_id" key for the audit events.
+const (
+	RemoteAddressKey = "remote_address"
+	APIKeyKey        = "api_key"
+	MethodKey        = "method"
+	PathKey          = "path"
+	RequestIDKey     = "request_id"
+	TenantKey        = "tenant"
+)
+
+// Server implements the ShouldRateLimit method of the Envoy rate limit
+// service. The descriptors of each client are checked as one request with the
+// limiter.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	limiter     *limiter.RateLimiter
+	ipExtractor middleware.IPExtractor
+}
+
+// NewServer creates the service. The IP extractor normalizes the remote
+// addresses of the descriptors, e.g. aggregating IPv6 networks.
+func NewServer(limiter *limiter.RateLimiter, ipExtractor middleware.IPExtractor) *Server {
+	return &Server{
+		limiter:     limiter,
+		ipExtractor: ipExtractor,
+	}
+}
+
+// ShouldRateLimit checks every descriptor of the request, charging each client
+// once however many descriptors name it. The call is over the limit when any
+// descriptor is, and the response headers describe the denied
+// descriptor or else the one with the fewest remaining requests. Descriptors
+// without a remote address or an API key are not limited. The domain is
+// ignored, all descriptors share the policies of the limiter.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	resp := &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OK,
+		Statuses:    make([]*rlsv3.RateLimitResponse_DescriptorStatus, 0, len(req.GetDescriptors())),
+	}
+
+	// reported is the decision described by the response headers
+	var reported *limiter.Decision
+	overLimit := func(body string, decision *limiter.Decision) {
+		if resp.OverallCode == rlsv3.RateLimitResponse_OK {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			resp.RawBody = []byte(body)
+			reported = decision
+		}
+	}
+
+	// Descriptors naming the same client are checked as a single request, so
+	// that the client is charged once per call. owners maps every descriptor
+	// to the first descriptor of its client, which carries the merged request.
+	descriptors := req.GetDescriptors()
+	requests := make([]limiter.Request, len(descriptors))
+	owners := make([]int, len(descriptors))
+	first := make(map[client]int)
+	for i, descriptor := range descriptors {
+		r := s.request(descriptor, int(req.GetHitsAddend()))
+		owner, seen := first[client{r.IP, r.Token, r.Tenant}]
+		if !seen {
+			first[client{r.IP, r.Token, r.Tenant}] = i
+			owner, requests[i] = i, r
+		}
+		owners[i] = owner
+		merged := &requests[owner]
+		if merged.Method == "" && merged.Path == "" {
+			merged.Method, merged.Path = r.Method, r.Path
+		}
+		if merged.ID == "" {
+			merged.ID = r.ID
+		}
+	}
+
+	decisions := make(map[int]limiter.Decision)
+	for i := range descriptors {
+		r := requests[owners[i]]
+		if r.IP == "" && r.Token == "" {
+			resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+			continue
+		}
+
+		decision, checked := decisions[owners[i]]
+		if !checked {
+			var err error
+			decision, err = s.limiter.Allow(ctx, r)
+			if err != nil {
+				return nil, status.Error(codes.Internal, "internal server error")
+			}
+			// The service is not told when the request completes, so concurrency
+			// limits only reject requests while other requests hold every slot
+			s.limiter.Release(ctx, decision)
+			decisions[owners[i]] = decision
+		}
+		resp.Statuses = append(resp.Statuses, descriptorStatus(decision))
+		if checked {
+			continue
+		}
+
+		switch {
+		case decision.Forbidden:
+			overLimit(`{"error": "invalid API key"}`, nil)
+		case decision.Denied:
+			overLimit(`{"error": "access denied"}`, nil)
+		case decision.Exempt:
+			// Allowlisted networks are not limited
+		case !decision.Allowed && decision.ConcurrencyLimited:
+			overLimit(`{"error": "too many concurrent requests"}`, &decision)
+		case !decision.Allowed:
+			overLimit(`{"error": "you have reached the maximum number of requests or actions allowed within a certain time frame"}`, &decision)
+		case resp.OverallCode == rlsv3.RateLimitResponse_OK && (reported == nil || decision.Remaining < reported.Remaining):
+			reported = &decision
+		}
+	}
+
+	if reported != nil {
+		header := http.Header{}
+		middleware.SetRateLimitHeaders(header, *reported)
+		for name := range header {
+			resp.ResponseHeadersToAdd = append(resp.ResponseHeadersToAdd, &corev3.HeaderValue{Key: name, Value: header.Get(name)})
+		}
+		sort.Slice(resp.ResponseHeadersToAdd, func(i, j int) bool {
+			return resp.ResponseHeadersToAdd[i].Key < resp.ResponseHeadersToAdd[j].Key
+		})
+	}
+	return resp, nil
+}
+
+// client identifies the client a descriptor is charged to
+type client struct {
+	ip, token, tenant string
+}
+
+// request reads the request described by the entries of a descriptor
+func (s *Server) request(descriptor *ratelimitv3.RateLimitDescriptor, cost int) limiter.Request {
+	r := limiter.Request{Cost: cost}
+	for _, entry := range descriptor.GetEntries() {
+		switch entry.GetKey() {
+		case RemoteAddressKey:
+			r.IP = s.ipExtractor.ClientIP(&http.Request{RemoteAddr: entry.GetValue()})
+		case APIKeyKey:
+			r.Token = entry.GetValue()
+		case MethodKey:
+			r.Method = entry.GetValue()
+		case PathKey:
+			r.Path = entry.GetValue()
+		case RequestIDKey:
+			r.ID = entry.GetValue()
+		case TenantKey:
+			r.Tenant = entry.GetValue()
+		}
+	}
+	return r
+}
+
+// descriptorStatus describes the decision of a descriptor
+func descriptorStatus(decision limiter.Decision) *rlsv3.RateLimitResponse_DescriptorStatus {
+	if decision.Forbidden || decision.Denied {
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OVER_LIMIT}
+	}
+	if decision.Exempt {
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+	}
+
+	code := rlsv3.RateLimitResponse_OK
+	if !decision.Allowed {
+		code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+	return &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code: code,
+		CurrentLimit: &rlsv3.RateLimitResponse_RateLimit{
+			Name:            decision.Policy,
+			RequestsPerUnit: uint32(decision.Limit),
+			Unit:            unit(decision.Window),
+		},
+		LimitRemaining:     uint32(decision.Remaining),
+		DurationUntilReset: durationpb.New(decision.ResetAfter),
+	}
+}
+
+// unit returns the Envoy unit of a window, UNKNOWN when the window is not
+// exactly one unit long
+func unit(window time.Duration) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch window {
+	case time.Second:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	default:
+		return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+	}
+}
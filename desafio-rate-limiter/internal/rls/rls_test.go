@@ -0,0 +1,166 @@
+package rls
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/limiter"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/middleware"
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	store := storage.NewMemoryStorage(time.Minute)
+	defer store.Close()
+	rl := limiter.NewRateLimiter(limiter.Config{
+		Storage: store,
+		Rules: limiter.Rules{
+			IPPolicy:      limiter.Policy{Limit: 2, Window: time.Second},
+			TokenPolicies: map[string]limiter.Policy{"abc123": {Limit: 10, Window: time.Minute}},
+			NetworkPolicies: []limiter.NetworkPolicy{
+				{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: limiter.NetworkDeny},
+			},
+			RoutePolicies: []limiter.RoutePolicy{
+				{Method: "POST", Pattern: "/login", Policy: limiter.Policy{Limit: 1, Window: time.Minute}},
+			},
+		},
+	})
+	server := NewServer(rl, middleware.IPExtractor{})
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		descriptors []*ratelimitv3.RateLimitDescriptor
+		hits        uint32
+		code        rlsv3.RateLimitResponse_Code
+		statuses    []rlsv3.RateLimitResponse_Code
+		remaining   string
+	}{
+		{
+			name:        "IP within the limit",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(RemoteAddressKey, "192.0.2.1")},
+			code:        rlsv3.RateLimitResponse_OK,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK},
+			remaining:   "1",
+		},
+		{
+			name:        "hits addend above the remaining requests",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(RemoteAddressKey, "192.0.2.1")},
+			hits:        2,
+			code:        rlsv3.RateLimitResponse_OVER_LIMIT,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OVER_LIMIT},
+			remaining:   "0",
+		},
+		{
+			name:        "API key overrides the IP limit",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(RemoteAddressKey, "192.0.2.1", APIKeyKey, "abc123")},
+			code:        rlsv3.RateLimitResponse_OK,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK},
+			remaining:   "9",
+		},
+		{
+			name:        "unknown API key",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(APIKeyKey, "unknown")},
+			code:        rlsv3.RateLimitResponse_OVER_LIMIT,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			name:        "denied network",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(RemoteAddressKey, "203.0.113.9")},
+			code:        rlsv3.RateLimitResponse_OVER_LIMIT,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			name:        "descriptors without client are not limited",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("generic_key", "anything")},
+			code:        rlsv3.RateLimitResponse_OK,
+			statuses:    []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK},
+		},
+		{
+			name: "descriptors of the same client are charged once",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(RemoteAddressKey, "192.0.2.2"),
+				descriptor(RemoteAddressKey, "192.0.2.2", MethodKey, "GET", PathKey, "/api"),
+			},
+			code:      rlsv3.RateLimitResponse_OK,
+			statuses:  []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK, rlsv3.RateLimitResponse_OK},
+			remaining: "1",
+		},
+		{
+			name: "route of the same client",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(RemoteAddressKey, "192.0.2.3"),
+				descriptor(RemoteAddressKey, "192.0.2.3", MethodKey, "POST", PathKey, "/login"),
+			},
+			code:      rlsv3.RateLimitResponse_OK,
+			statuses:  []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK, rlsv3.RateLimitResponse_OK},
+			remaining: "0",
+		},
+		{
+			name: "any descriptor over the limit",
+			descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(RemoteAddressKey, "192.0.2.4", MethodKey, "POST", PathKey, "/login"),
+				descriptor(RemoteAddressKey, "192.0.2.3", MethodKey, "POST", PathKey, "/login"),
+			},
+			code: rlsv3.RateLimitResponse_OVER_LIMIT,
+			statuses: []rlsv3.RateLimitResponse_Code{
+				rlsv3.RateLimitResponse_OK,
+				rlsv3.RateLimitResponse_OVER_LIMIT,
+			},
+			remaining: "0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := server.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+				Domain:      "edge",
+				Descriptors: tt.descriptors,
+				HitsAddend:  tt.hits,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, resp.OverallCode)
+
+			codes := make([]rlsv3.RateLimitResponse_Code, len(resp.Statuses))
+			for i, status := range resp.Statuses {
+				codes[i] = status.Code
+			}
+			assert.Equal(t, tt.statuses, codes)
+
+			var remaining string
+			for _, header := range resp.ResponseHeadersToAdd {
+				if header.Key == "X-Ratelimit-Remaining" {
+					remaining = header.Value
+				}
+			}
+			assert.Equal(t, tt.remaining, remaining)
+			if tt.code == rlsv3.RateLimitResponse_OVER_LIMIT {
+				assert.NotEmpty(t, resp.RawBody)
+			}
+		})
+	}
+}
+
+func TestDescriptorStatusLimit(t *testing.T) {
+	status := descriptorStatus(limiter.Decision{Allowed: true, Policy: "ip", Limit: 100, Window: time.Minute, Remaining: 42, ResetAfter: 30 * time.Second})
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, status.Code)
+	assert.Equal(t, "ip", status.CurrentLimit.Name)
+	assert.Equal(t, uint32(100), status.CurrentLimit.RequestsPerUnit)
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_MINUTE, status.CurrentLimit.Unit)
+	assert.Equal(t, uint32(42), status.LimitRemaining)
+	assert.Equal(t, 30*time.Second, status.DurationUntilReset.AsDuration())
+}
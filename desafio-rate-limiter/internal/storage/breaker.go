@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the storage while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker wraps a storage and stops calling it after a number of
+// consecutive errors, failing fast with ErrCircuitOpen instead of waiting for
+// every call to time out. Once the cooldown elapses a single call probes the
+// storage: its success closes the circuit, its failure opens it again.
+type CircuitBreaker struct {
+	storage   Storage
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(storage Storage, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		storage:   storage,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a call may reach the storage
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		// Let this call probe the storage, the others keep failing fast
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the state with the outcome of a call
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The caller giving up says nothing about the storage, a canceled probe is
+	// retried by the next call
+	if errors.Is(err, context.Canceled) {
+		if b.state == circuitHalfOpen {
+			b.state = circuitOpen
+		}
+		return
+	}
+
+	if err == nil {
+		if b.state != circuitClosed {
+			log.Printf("Storage circuit breaker closed, storage recovered")
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state == circuitClosed {
+			log.Printf("Storage circuit breaker opened after %d consecutive errors: %v", b.failures, err)
+		}
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// call runs fn through the circuit breaker
+func call[T any](b *CircuitBreaker, fn func() (T, error)) (T, error) {
+	if !b.allow() {
+		var zero T
+		return zero, ErrCircuitOpen
+	}
+	result, err := fn()
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return call(b, func() (int64, error) { return b.storage.Increment(ctx, key, expiration) })
+}
+
+func (b *CircuitBreaker) Get(ctx context.Context, key string) (int64, error) {
+	return call(b, func() (int64, error) { return b.storage.Get(ctx, key) })
+}
+
+func (b *CircuitBreaker) SetBlock(ctx context.Context, key string, expiration time.Duration) error {
+	_, err := call(b, func() (struct{}, error) { return struct{}{}, b.storage.SetBlock(ctx, key, expiration) })
+	return err
+}
+
+func (b *CircuitBreaker) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return call(b, func() (bool, error) { return b.storage.IsBlocked(ctx, key) })
+}
+
+func (b *CircuitBreaker) Unblock(ctx context.Context, key string) (bool, error) {
+	return call(b, func() (bool, error) { return b.storage.Unblock(ctx, key) })
+}
+
+func (b *CircuitBreaker) Blocks(ctx context.Context) ([]Block, error) {
+	return call(b, func() ([]Block, error) { return b.storage.Blocks(ctx) })
+}
+
+func (b *CircuitBreaker) Inspect(ctx context.Context, key string) (KeyState, error) {
+	return call(b, func() (KeyState, error) { return b.storage.Inspect(ctx, key) })
+}
+
+func (b *CircuitBreaker) FixedWindow(ctx context.Context, key string, limit Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.FixedWindow(ctx, key, limit) })
+}
+
+func (b *CircuitBreaker) SlidingWindowLog(ctx context.Context, key string, limit Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.SlidingWindowLog(ctx, key, limit) })
+}
+
+func (b *CircuitBreaker) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.SlidingWindowCounter(ctx, key, limit) })
+}
+
+func (b *CircuitBreaker) TokenBucket(ctx context.Context, key string, limit Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.TokenBucket(ctx, key, limit) })
+}
+
+func (b *CircuitBreaker) GCRA(ctx context.Context, key string, limit Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.GCRA(ctx, key, limit) })
+}
+
+func (b *CircuitBreaker) Quotas(ctx context.Context, key string, limits []Limit) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.Quotas(ctx, key, limits) })
+}
+
+func (b *CircuitBreaker) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (Result, error) {
+	return call(b, func() (Result, error) { return b.storage.Acquire(ctx, key, id, limit, ttl) })
+}
+
+func (b *CircuitBreaker) Release(ctx context.Context, key, id string) error {
+	_, err := call(b, func() (struct{}, error) { return struct{}{}, b.storage.Release(ctx, key, id) })
+	return err
+}
+
+func (b *CircuitBreaker) Close() error {
+	return b.storage.Close()
+}
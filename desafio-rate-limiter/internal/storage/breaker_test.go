@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage fails every call while err is set
+type flakyStorage struct {
+	Storage
+	err   error
+	calls int
+}
+
+func (s *flakyStorage) FixedWindow(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.calls++
+	if s.err != nil {
+		return Result{}, s.err
+	}
+	return Result{Allowed: true}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Period: time.Second}
+	down := errors.New("connection refused")
+
+	store := &flakyStorage{err: down}
+	breaker := NewCircuitBreaker(store, 3, 10*time.Second)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	// Trips after 3 consecutive errors
+	for i := 0; i < 3; i++ {
+		_, err := breaker.FixedWindow(ctx, "key", limit)
+		assert.ErrorIs(t, err, down)
+	}
+	_, err := breaker.FixedWindow(ctx, "key", limit)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 3, store.calls)
+
+	// A failed probe after the cooldown opens the circuit again
+	now = now.Add(10 * time.Second)
+	_, err = breaker.FixedWindow(ctx, "key", limit)
+	assert.ErrorIs(t, err, down)
+	_, err = breaker.FixedWindow(ctx, "key", limit)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 4, store.calls)
+
+	// A successful probe closes it
+	store.err = nil
+	now = now.Add(10 * time.Second)
+	result, err := breaker.FixedWindow(ctx, "key", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	_, err = breaker.FixedWindow(ctx, "key", limit)
+	require.NoError(t, err)
+	assert.Equal(t, 6, store.calls)
+}
+
+func TestCircuitBreakerIgnoresCanceledCalls(t *testing.T) {
+	store := &flakyStorage{err: context.Canceled}
+	breaker := NewCircuitBreaker(store, 1, time.Second)
+
+	for i := 0; i < 3; i++ {
+		_, err := breaker.FixedWindow(context.Background(), "key", Limit{Rate: 1, Period: time.Second})
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Equal(t, 3, store.calls)
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-rate-limiter/internal/config"
+)
+
+// FromConfig creates the configured storage: in memory, or Redis behind a
+// circuit breaker that fails fast while Redis is unavailable. The keys are
+// prefixed with the configured key prefix, if any.
+func FromConfig(cfg *config.Config) (Storage, error) {
+	var store Storage
+	switch cfg.StorageBackend {
+	case "memory":
+		store = NewMemoryStorage(time.Minute)
+	default:
+		tlsConfig, err := cfg.Redis.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis TLS configuration: %w", err)
+		}
+		redisStore, err := NewRedisStorage(RedisOptions{
+			Mode:             cfg.Redis.Mode,
+			Addrs:            cfg.Redis.Addrs,
+			MasterName:       cfg.Redis.MasterName,
+			Username:         cfg.Redis.Username,
+			Password:         cfg.Redis.Password,
+			SentinelUsername: cfg.Redis.SentinelUsername,
+			SentinelPassword: cfg.Redis.SentinelPassword,
+			DB:               cfg.Redis.DB,
+			TLSConfig:        tlsConfig,
+			PoolSize:         cfg.Redis.PoolSize,
+			MinIdleConns:     cfg.Redis.MinIdleConns,
+			DialTimeout:      cfg.Redis.DialTimeout,
+			ReadTimeout:      cfg.Redis.ReadTimeout,
+			WriteTimeout:     cfg.Redis.WriteTimeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Redis storage: %w", err)
+		}
+		store = NewCircuitBreaker(redisStore, cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	}
+	if cfg.KeyPrefix != "" {
+		store = NewPrefixed(store, cfg.KeyPrefix+":")
+	}
+	return store, nil
+}
@@ -0,0 +1,574 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memoryShardCount = 32
+
+// MemoryStorage keeps the rate limiter state in process. The keyspace is split
+// in shards guarded by their own lock, and the state of a key lives in the same
+// shard as its block so that every decision is taken under a single lock.
+// Expired entries are ignored on access and evicted by a background janitor.
+type MemoryStorage struct {
+	shards [memoryShardCount]*memoryShard
+	now    func() time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// memoryEntry holds the state of one key. Only the fields used by the
+// algorithm that owns the key are set.
+type memoryEntry struct {
+	expiresAt time.Time
+
+	// count is the fixed window counter or the current sliding window counter
+	count int64
+	// previous and window are the previous counter and the index of the current
+	// window of the sliding window counter
+	previous int64
+	window   int64
+	// log holds the request timestamps of the sliding window log
+	log []time.Time
+	// tokens and timestamp are the token bucket level and last refill time,
+	// timestamp is also the theoretical arrival time of GCRA
+	tokens    float64
+	timestamp time.Time
+	// leases maps the lease ids held on a key to their expiry
+	leases map[string]time.Time
+}
+
+func NewMemoryStorage(cleanupInterval time.Duration) *MemoryStorage {
+	m := &MemoryStorage{
+		now:  time.Now,
+		stop: make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+
+	go m.janitor(cleanupInterval)
+
+	return m
+}
+
+func (m *MemoryStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	entry := shard.entry(key, now, expiration)
+	entry.count++
+	return entry.count, nil
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, key string) (int64, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, exists := shard.lookup(key, m.now())
+	if !exists {
+		return 0, nil
+	}
+	return entry.count, nil
+}
+
+func (m *MemoryStorage) SetBlock(ctx context.Context, key string, expiration time.Duration) error {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.entries[blockKey(key)] = &memoryEntry{expiresAt: m.now().Add(expiration), count: 1}
+	return nil
+}
+
+func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	_, blocked := shard.lookup(blockKey(key), m.now())
+	return blocked, nil
+}
+
+func (m *MemoryStorage) Unblock(ctx context.Context, key string) (bool, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	_, blocked := shard.lookup(blockKey(key), m.now())
+	delete(shard.entries, blockKey(key))
+	return blocked, nil
+}
+
+func (m *MemoryStorage) Blocks(ctx context.Context) ([]Block, error) {
+	now := m.now()
+	var blocks []Block
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if strings.HasPrefix(key, blockPrefix) && now.Before(entry.expiresAt) {
+				block := Block{Key: strings.TrimPrefix(key, blockPrefix), TTL: entry.expiresAt.Sub(now)}
+				if offenses, exists := shard.lookup(offenseKey(block.Key), now); exists {
+					block.Offenses = offenses.count
+				}
+				blocks = append(blocks, block)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return blocks, nil
+}
+
+func (m *MemoryStorage) Inspect(ctx context.Context, key string) (KeyState, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	state := KeyState{}
+	for _, algorithm := range algorithms {
+		entry, exists := shard.lookup(algorithmKey(key, algorithm), now)
+		if !exists {
+			continue
+		}
+
+		// Describe the state with the same fields kept by RedisStorage
+		var fields map[string]string
+		switch algorithm {
+		case "fixed_window":
+			fields = map[string]string{"count": strconv.FormatInt(entry.count, 10)}
+		case "sliding_window_log":
+			fields = map[string]string{"entries": strconv.Itoa(len(entry.log))}
+		case "sliding_window_counter":
+			fields = map[string]string{
+				"window":   strconv.FormatInt(entry.window, 10),
+				"current":  strconv.FormatInt(entry.count, 10),
+				"previous": strconv.FormatInt(entry.previous, 10),
+			}
+		case "token_bucket":
+			fields = map[string]string{
+				"tokens":    strconv.FormatFloat(entry.tokens, 'g', -1, 64),
+				"timestamp": strconv.FormatInt(entry.timestamp.UnixMicro(), 10),
+			}
+		case "gcra":
+			fields = map[string]string{"tat": strconv.FormatInt(entry.timestamp.UnixMicro(), 10)}
+		}
+
+		state.Counters = append(state.Counters, CounterState{
+			Algorithm: algorithm,
+			Fields:    fields,
+			TTL:       entry.expiresAt.Sub(now),
+		})
+	}
+
+	// Quota windows are only known from the keys counting them, which live
+	// in the shard of the key
+	var quotaKeys []string
+	var counts []int64
+	var ttls []time.Duration
+	for stateKey := range shard.entries {
+		if !strings.HasPrefix(stateKey, quotaPrefix(key)) {
+			continue
+		}
+		if entry, exists := shard.lookup(stateKey, now); exists {
+			quotaKeys = append(quotaKeys, stateKey)
+			counts = append(counts, entry.count)
+			ttls = append(ttls, entry.expiresAt.Sub(now))
+		}
+	}
+	state.Counters = append(state.Counters, quotaCounters(key, quotaKeys, counts, ttls)...)
+
+	if block, blocked := shard.lookup(blockKey(key), now); blocked {
+		state.Blocked = true
+		state.BlockTTL = block.expiresAt.Sub(now)
+	}
+	if offenses, exists := shard.lookup(offenseKey(key), now); exists {
+		state.Offenses = offenses.count
+	}
+	if leases, exists := shard.lookup(leaseKey(key), now); exists {
+		for _, expiresAt := range leases.leases {
+			if now.Before(expiresAt) {
+				state.InFlight++
+			}
+		}
+	}
+	return state, nil
+}
+
+func (m *MemoryStorage) FixedWindow(ctx context.Context, key string, limit Limit) (Result, error) {
+	return m.take(key, key, limit, func(now time.Time, shard *memoryShard) (Result, bool) {
+		count, reset := int64(0), limit.Period
+		if entry, exists := shard.lookup(key, now); exists {
+			count, reset = entry.count, entry.expiresAt.Sub(now)
+		}
+		if count+limit.cost() > limit.Rate {
+			return Result{RetryAfter: reset, ResetAfter: reset}, false
+		}
+
+		entry := shard.entry(key, now, limit.Period)
+		entry.count += limit.cost()
+		return Result{Allowed: true, Remaining: limit.Rate - entry.count, ResetAfter: entry.expiresAt.Sub(now)}, true
+	})
+}
+
+func (m *MemoryStorage) SlidingWindowLog(ctx context.Context, key string, limit Limit) (Result, error) {
+	stateKey := algorithmKey(key, "sliding_window_log")
+	return m.take(key, stateKey, limit, func(now time.Time, shard *memoryShard) (Result, bool) {
+		entry := shard.entry(stateKey, now, limit.Period)
+
+		// Drop the requests that left the window
+		start := now.Add(-limit.Period)
+		expired := 0
+		for expired < len(entry.log) && !entry.log[expired].After(start) {
+			expired++
+		}
+		entry.log = entry.log[expired:]
+
+		count, cost := int64(len(entry.log)), limit.cost()
+		if count+cost <= limit.Rate {
+			for i := int64(0); i < cost; i++ {
+				entry.log = append(entry.log, now)
+			}
+			entry.expiresAt = now.Add(limit.Period)
+			return Result{Allowed: true, Remaining: limit.Rate - count - cost, ResetAfter: limit.Period}, true
+		}
+		if count == 0 {
+			return Result{RetryAfter: limit.Period, ResetAfter: limit.Period}, false
+		}
+
+		// Wait until enough requests leave the window for the cost to fit
+		first := max(0, min(count-1, count+cost-limit.Rate-1))
+		return Result{
+			RetryAfter: entry.log[first].Add(limit.Period).Sub(now),
+			ResetAfter: entry.log[len(entry.log)-1].Add(limit.Period).Sub(now),
+		}, false
+	})
+}
+
+func (m *MemoryStorage) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (Result, error) {
+	stateKey := algorithmKey(key, "sliding_window_counter")
+	return m.take(key, stateKey, limit, func(now time.Time, shard *memoryShard) (Result, bool) {
+		entry := shard.entry(stateKey, now, 2*limit.Period)
+
+		window := float64(limit.Period)
+		current := now.UnixNano() / int64(limit.Period)
+		offset := float64(now.UnixNano() % int64(limit.Period))
+		if entry.window != current {
+			if entry.window == current-1 {
+				entry.previous = entry.count
+			} else {
+				entry.previous = 0
+			}
+			entry.count = 0
+			entry.window = current
+		}
+		entry.expiresAt = now.Add(2 * limit.Period)
+
+		cost := limit.cost()
+		prev := float64(entry.previous)
+		weighted := prev*(window-offset)/window + float64(entry.count)
+		allowed := weighted+float64(cost) <= float64(limit.Rate)
+
+		var retry float64
+		switch {
+		case allowed:
+			entry.count += cost
+			weighted += float64(cost)
+		case entry.count+cost <= limit.Rate:
+			// Wait until the previous window weighs little enough
+			retry = window - float64(limit.Rate-cost-entry.count)*window/prev - offset
+		case entry.count > 0:
+			// Wait until the current window becomes the previous one and decays
+			retry = window - offset + window - float64(limit.Rate-cost)*window/float64(entry.count)
+		default:
+			retry = window - offset
+		}
+
+		reset := time.Duration(window - offset)
+		if entry.count > 0 {
+			reset += limit.Period
+		}
+		if !allowed {
+			return Result{RetryAfter: time.Duration(math.Max(0, math.Ceil(retry))), ResetAfter: reset}, false
+		}
+		return Result{
+			Allowed:    true,
+			Remaining:  int64(math.Max(0, math.Floor(float64(limit.Rate)-weighted))),
+			ResetAfter: reset,
+		}, true
+	})
+}
+
+func (m *MemoryStorage) TokenBucket(ctx context.Context, key string, limit Limit) (Result, error) {
+	stateKey := algorithmKey(key, "token_bucket")
+	return m.take(key, stateKey, limit, func(now time.Time, shard *memoryShard) (Result, bool) {
+		capacity := float64(limit.Rate)
+		rate := capacity / float64(limit.Period)
+
+		entry, exists := shard.lookup(stateKey, now)
+		if !exists {
+			entry = &memoryEntry{tokens: capacity, timestamp: now}
+			shard.entries[stateKey] = entry
+		}
+		entry.tokens = math.Min(capacity, entry.tokens+float64(now.Sub(entry.timestamp))*rate)
+		entry.timestamp = now
+
+		cost := float64(limit.cost())
+		allowed := entry.tokens >= cost
+		if allowed {
+			entry.tokens -= cost
+		}
+
+		reset := time.Duration(math.Ceil((capacity - entry.tokens) / rate))
+		entry.expiresAt = now.Add(reset)
+		if !allowed {
+			return Result{RetryAfter: time.Duration(math.Ceil((cost - entry.tokens) / rate)), ResetAfter: reset}, false
+		}
+		return Result{Allowed: true, Remaining: int64(entry.tokens), ResetAfter: reset}, true
+	})
+}
+
+func (m *MemoryStorage) GCRA(ctx context.Context, key string, limit Limit) (Result, error) {
+	stateKey := algorithmKey(key, "gcra")
+	return m.take(key, stateKey, limit, func(now time.Time, shard *memoryShard) (Result, bool) {
+		interval := limit.Period / time.Duration(limit.Rate)
+
+		tat := now
+		if entry, exists := shard.lookup(stateKey, now); exists && entry.timestamp.After(now) {
+			tat = entry.timestamp
+		}
+
+		newTat := tat.Add(interval * time.Duration(limit.cost()))
+		allowAt := newTat.Add(-limit.Period)
+		if allowAt.After(now) {
+			return Result{RetryAfter: allowAt.Sub(now), ResetAfter: tat.Sub(now)}, false
+		}
+
+		shard.entries[stateKey] = &memoryEntry{timestamp: newTat, expiresAt: newTat}
+		return Result{
+			Allowed:    true,
+			Remaining:  int64(now.Sub(allowAt) / interval),
+			ResetAfter: newTat.Sub(now),
+		}, true
+	})
+}
+
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+func (m *MemoryStorage) Quotas(ctx context.Context, key string, limits []Limit) (Result, error) {
+	if len(limits) == 0 {
+		return Result{}, errors.New("no limits to enforce")
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	if block, blocked := shard.lookup(blockKey(key), now); blocked {
+		ttl := block.expiresAt.Sub(now)
+		return Result{RetryAfter: ttl, ResetAfter: ttl}, nil
+	}
+
+	// Deny without counting if any window is exhausted, reporting the longest wait
+	denied := -1
+	var retry time.Duration
+	for i, limit := range limits {
+		count, wait := int64(0), limit.Period
+		if entry, exists := shard.lookup(quotaKey(key, limit.Period), now); exists {
+			count, wait = entry.count, entry.expiresAt.Sub(now)
+		}
+		if count+limit.cost() > limit.Rate && wait > retry {
+			denied, retry = i, wait
+		}
+	}
+	if denied >= 0 {
+		result := Result{RetryAfter: retry, ResetAfter: retry, Index: denied}
+		if limits[denied].Block > 0 {
+			block, offenses := shard.block(key, now, limits[denied])
+			result.RetryAfter = block
+			result.ResetAfter = max(retry, block)
+			result.Blocked = true
+			result.Offenses = offenses
+		}
+		return result, nil
+	}
+
+	var result Result
+	for i, limit := range limits {
+		entry := shard.entry(quotaKey(key, limit.Period), now, limit.Period)
+		entry.count += limit.cost()
+
+		remaining := limit.Rate - entry.count
+		if i == 0 || remaining < result.Remaining {
+			result = Result{Allowed: true, Remaining: remaining, ResetAfter: entry.expiresAt.Sub(now), Index: i}
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (Result, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	entry := shard.entry(leaseKey(key), now, ttl)
+	if entry.leases == nil {
+		entry.leases = make(map[string]time.Time)
+	}
+
+	// Drop the leases of requests that never released them
+	for lease, expiresAt := range entry.leases {
+		if !now.Before(expiresAt) {
+			delete(entry.leases, lease)
+		}
+	}
+
+	inFlight := int64(len(entry.leases))
+	if inFlight >= limit {
+		return Result{}, nil
+	}
+	entry.leases[id] = now.Add(ttl)
+	if expiresAt := now.Add(ttl); expiresAt.After(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+	}
+	return Result{Allowed: true, Remaining: limit - inFlight - 1}, nil
+}
+
+func (m *MemoryStorage) Release(ctx context.Context, key, id string) error {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if entry, exists := shard.lookup(leaseKey(key), m.now()); exists {
+		delete(entry.leases, id)
+		if len(entry.leases) == 0 {
+			delete(shard.entries, leaseKey(key))
+		}
+	}
+	return nil
+}
+
+// take runs an algorithm under the lock of the shard owning the key. Blocked
+// keys are rejected before the algorithm runs, and the key is blocked when the
+// algorithm rejects the request and a block duration is configured.
+func (m *MemoryStorage) take(key, stateKey string, limit Limit, algorithm func(now time.Time, shard *memoryShard) (Result, bool)) (Result, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	if block, blocked := shard.lookup(blockKey(key), now); blocked {
+		ttl := block.expiresAt.Sub(now)
+		return Result{RetryAfter: ttl, ResetAfter: ttl}, nil
+	}
+
+	result, allowed := algorithm(now, shard)
+	if !allowed && limit.Block > 0 {
+		block, offenses := shard.block(key, now, limit)
+		result.RetryAfter = block
+		result.ResetAfter = max(result.ResetAfter, block)
+		result.Blocked = true
+		result.Offenses = offenses
+	}
+	return result, nil
+}
+
+// block blocks the key, counting the offense when the limit has a lookback so
+// that repeat offenders are blocked longer. It returns the block duration and
+// the offenses of the key. The shard lock must be held.
+func (s *memoryShard) block(key string, now time.Time, limit Limit) (time.Duration, int64) {
+	var offenses int64
+	if limit.BlockLookback > 0 {
+		entry := s.entry(offenseKey(key), now, limit.BlockLookback)
+		entry.count++
+		entry.expiresAt = now.Add(limit.BlockLookback)
+		offenses = entry.count
+	}
+
+	block := limit.blockDuration(offenses)
+	s.entries[blockKey(key)] = &memoryEntry{expiresAt: now.Add(block), count: 1}
+	return block, offenses
+}
+
+// shard returns the shard owning the key. Block and algorithm keys derived
+// from the key are stored in the same shard.
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%memoryShardCount]
+}
+
+// janitor periodically evicts expired entries until the storage is closed
+func (m *MemoryStorage) janitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.evictExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *MemoryStorage) evictExpired() {
+	now := m.now()
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// lookup returns the entry for the key unless it is missing or expired.
+// The shard lock must be held.
+func (s *memoryShard) lookup(key string, now time.Time) (*memoryEntry, bool) {
+	entry, exists := s.entries[key]
+	if !exists || !now.Before(entry.expiresAt) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// entry returns the entry for the key, replacing a missing or expired entry by
+// an empty one that expires after expiration. The shard lock must be held.
+func (s *memoryShard) entry(key string, now time.Time, expiration time.Duration) *memoryEntry {
+	entry, exists := s.lookup(key, now)
+	if !exists {
+		entry = &memoryEntry{expiresAt: now.Add(expiration)}
+		s.entries[key] = entry
+	}
+	return entry
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryStorage(t *testing.T) (*MemoryStorage, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	m := NewMemoryStorage(time.Hour)
+	m.now = func() time.Time { return now }
+	t.Cleanup(func() { m.Close() })
+	return m, &now
+}
+
+func TestMemoryStorageIncrementExpires(t *testing.T) {
+	m, now := newTestMemoryStorage(t)
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := m.Increment(ctx, "key", time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	*now = now.Add(time.Second)
+	count, err := m.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestMemoryStorageBlockExpires(t *testing.T) {
+	m, now := newTestMemoryStorage(t)
+	ctx := context.Background()
+
+	require.NoError(t, m.SetBlock(ctx, "key", 5*time.Second))
+	blocked, err := m.IsBlocked(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	*now = now.Add(5 * time.Second)
+	blocked, err = m.IsBlocked(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestMemoryStorageEvictExpired(t *testing.T) {
+	m, now := newTestMemoryStorage(t)
+	ctx := context.Background()
+
+	_, err := m.Increment(ctx, "counter", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, m.SetBlock(ctx, "counter", time.Minute))
+
+	*now = now.Add(time.Second)
+	m.evictExpired()
+
+	shard := m.shard("counter")
+	assert.NotContains(t, shard.entries, "counter")
+	assert.Contains(t, shard.entries, blockKey("counter"))
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Prefixed wraps a storage and prefixes every key, so that several
+// environments, such as staging and production, share one Redis without
+// sharing counters and blocks. The prefix comes before the derived keys, e.g.
+// "block:staging:ratelimit:{ip:10.0.0.1}", keeping the Redis Cluster hash tag
+// of the key. Blocks only lists the blocks of the prefix.
+type Prefixed struct {
+	storage Storage
+	prefix  string
+}
+
+func NewPrefixed(storage Storage, prefix string) *Prefixed {
+	return &Prefixed{storage: storage, prefix: prefix}
+}
+
+func (p *Prefixed) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return p.storage.Increment(ctx, p.prefix+key, expiration)
+}
+
+func (p *Prefixed) Get(ctx context.Context, key string) (int64, error) {
+	return p.storage.Get(ctx, p.prefix+key)
+}
+
+func (p *Prefixed) SetBlock(ctx context.Context, key string, expiration time.Duration) error {
+	return p.storage.SetBlock(ctx, p.prefix+key, expiration)
+}
+
+func (p *Prefixed) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return p.storage.IsBlocked(ctx, p.prefix+key)
+}
+
+func (p *Prefixed) Unblock(ctx context.Context, key string) (bool, error) {
+	return p.storage.Unblock(ctx, p.prefix+key)
+}
+
+func (p *Prefixed) Blocks(ctx context.Context) ([]Block, error) {
+	blocks, err := p.storage.Blocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	own := blocks[:0]
+	for _, block := range blocks {
+		if key, found := strings.CutPrefix(block.Key, p.prefix); found {
+			block.Key = key
+			own = append(own, block)
+		}
+	}
+	return own, nil
+}
+
+func (p *Prefixed) Inspect(ctx context.Context, key string) (KeyState, error) {
+	return p.storage.Inspect(ctx, p.prefix+key)
+}
+
+func (p *Prefixed) FixedWindow(ctx context.Context, key string, limit Limit) (Result, error) {
+	return p.storage.FixedWindow(ctx, p.prefix+key, limit)
+}
+
+func (p *Prefixed) SlidingWindowLog(ctx context.Context, key string, limit Limit) (Result, error) {
+	return p.storage.SlidingWindowLog(ctx, p.prefix+key, limit)
+}
+
+func (p *Prefixed) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (Result, error) {
+	return p.storage.SlidingWindowCounter(ctx, p.prefix+key, limit)
+}
+
+func (p *Prefixed) TokenBucket(ctx context.Context, key string, limit Limit) (Result, error) {
+	return p.storage.TokenBucket(ctx, p.prefix+key, limit)
+}
+
+func (p *Prefixed) GCRA(ctx context.Context, key string, limit Limit) (Result, error) {
+	return p.storage.GCRA(ctx, p.prefix+key, limit)
+}
+
+func (p *Prefixed) Quotas(ctx context.Context, key string, limits []Limit) (Result, error) {
+	return p.storage.Quotas(ctx, p.prefix+key, limits)
+}
+
+func (p *Prefixed) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (Result, error) {
+	return p.storage.Acquire(ctx, p.prefix+key, id, limit, ttl)
+}
+
+func (p *Prefixed) Release(ctx context.Context, key, id string) error {
+	return p.storage.Release(ctx, p.prefix+key, id)
+}
+
+func (p *Prefixed) Close() error {
+	return p.storage.Close()
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixedStorage(t *testing.T) {
+	store := NewMemoryStorage(time.Minute)
+	defer store.Close()
+	staging := NewPrefixed(store, "staging:")
+	production := NewPrefixed(store, "production:")
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Period: time.Minute, Block: time.Minute}
+
+	// Each environment counts and blocks the same key separately
+	result, err := staging.FixedWindow(ctx, "ratelimit:{ip:10.0.0.1}", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	result, err = staging.FixedWindow(ctx, "ratelimit:{ip:10.0.0.1}", limit)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	result, err = production.FixedWindow(ctx, "ratelimit:{ip:10.0.0.1}", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	blocked, err := store.IsBlocked(ctx, "staging:ratelimit:{ip:10.0.0.1}")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	blocks, err := staging.Blocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "ratelimit:{ip:10.0.0.1}", blocks[0].Key)
+
+	blocks, err = production.Blocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, blocks)
+}
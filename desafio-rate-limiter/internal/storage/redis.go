@@ -2,31 +2,100 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// RedisOptions configure the connection to a standalone Redis, a Redis Cluster
+// or a Redis managed by Sentinel. Zero values keep the go-redis defaults.
+type RedisOptions struct {
+	// Mode is "standalone" (the default), "cluster" or "sentinel"
+	Mode string
+	// Addrs is the server address in standalone mode, the seed nodes in
+	// cluster mode and the sentinels in sentinel mode
+	Addrs []string
+	// MasterName is the name of the master monitored by the sentinels
+	MasterName string
+
+	Username         string
+	Password         string
+	SentinelUsername string
+	SentinelPassword string
+	// DB is ignored in cluster mode
+	DB int
+
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
 type RedisStorage struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
-func NewRedisStorage(addr, password string, db int) (*RedisStorage, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
+func NewRedisStorage(opts RedisOptions) (*RedisStorage, error) {
+	universal := &redis.UniversalOptions{
+		Addrs:            opts.Addrs,
+		MasterName:       opts.MasterName,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelUsername: opts.SentinelUsername,
+		SentinelPassword: opts.SentinelPassword,
+		DB:               opts.DB,
+		TLSConfig:        opts.TLSConfig,
+		PoolSize:         opts.PoolSize,
+		MinIdleConns:     opts.MinIdleConns,
+		DialTimeout:      opts.DialTimeout,
+		ReadTimeout:      opts.ReadTimeout,
+		WriteTimeout:     opts.WriteTimeout,
+	}
+
+	var client redis.UniversalClient
+	switch opts.Mode {
+	case "", "standalone":
+		client = redis.NewClient(universal.Simple())
+	case "cluster":
+		client = redis.NewClusterClient(universal.Cluster())
+	case "sentinel":
+		if opts.MasterName == "" {
+			return nil, errors.New("sentinel mode requires a master name")
+		}
+		client = redis.NewFailoverClient(universal.Failover())
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
+	// Cache the rate limit scripts on the server so requests only send their SHA.
+	// Scripts flushed later are sent again on the NOSCRIPT reply. In cluster
+	// mode the scripts are loaded on every master.
+	for _, script := range limitScripts {
+		if err := script.Load(ctx, client).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to load rate limit script: %w", err)
+		}
+	}
+
 	return &RedisStorage{
 		client: client,
 	}, nil
@@ -58,8 +127,7 @@ func (r *RedisStorage) Get(ctx context.Context, key string) (int64, error) {
 }
 
 func (r *RedisStorage) SetBlock(ctx context.Context, key string, expiration time.Duration) error {
-	blockKey := fmt.Sprintf("block:%s", key)
-	err := r.client.Set(ctx, blockKey, "1", expiration).Err()
+	err := r.client.Set(ctx, blockKey(key), "1", expiration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to set block for key %s: %w", key, err)
 	}
@@ -67,8 +135,7 @@ func (r *RedisStorage) SetBlock(ctx context.Context, key string, expiration time
 }
 
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blockKey := fmt.Sprintf("block:%s", key)
-	val, err := r.client.Get(ctx, blockKey).Result()
+	val, err := r.client.Get(ctx, blockKey(key)).Result()
 	if err == redis.Nil {
 		return false, nil
 	}
@@ -78,6 +145,302 @@ func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 	return val == "1", nil
 }
 
+func (r *RedisStorage) Unblock(ctx context.Context, key string) (bool, error) {
+	deleted, err := r.client.Del(ctx, blockKey(key)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock key %s: %w", key, err)
+	}
+	return deleted > 0, nil
+}
+
+func (r *RedisStorage) Blocks(ctx context.Context) ([]Block, error) {
+	keys, err := r.scan(ctx, blockPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan blocks: %w", err)
+	}
+
+	pipe := r.client.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	offenses := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key)
+		offenses[i] = pipe.Get(ctx, offenseKey(strings.TrimPrefix(key, blockPrefix)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get block TTLs: %w", err)
+	}
+
+	blocks := make([]Block, 0, len(keys))
+	for i, key := range keys {
+		// Skip blocks that expired after the scan
+		if ttls[i].Val() <= 0 {
+			continue
+		}
+		count, _ := offenses[i].Int64()
+		blocks = append(blocks, Block{Key: strings.TrimPrefix(key, blockPrefix), TTL: ttls[i].Val(), Offenses: count})
+	}
+	return blocks, nil
+}
+
+func (r *RedisStorage) Inspect(ctx context.Context, key string) (KeyState, error) {
+	// Quota windows are only known from the keys counting them
+	quotaKeys, err := r.scan(ctx, globEscape(quotaPrefix(key))+"*")
+	if err != nil {
+		return KeyState{}, fmt.Errorf("failed to scan quotas of key %s: %w", key, err)
+	}
+
+	// Find which algorithms keep state for the key
+	pipe := r.client.Pipeline()
+	types := make([]*redis.StatusCmd, len(algorithms))
+	ttls := make([]*redis.DurationCmd, len(algorithms))
+	for i, algorithm := range algorithms {
+		types[i] = pipe.Type(ctx, algorithmKey(key, algorithm))
+		ttls[i] = pipe.PTTL(ctx, algorithmKey(key, algorithm))
+	}
+	blockTTL := pipe.PTTL(ctx, blockKey(key))
+	offenses := pipe.Get(ctx, offenseKey(key))
+	inFlight := inFlightScript.Eval(ctx, pipe, []string{leaseKey(key)})
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return KeyState{}, fmt.Errorf("failed to inspect key %s: %w", key, err)
+	}
+
+	// Read the state according to its type
+	pipe = r.client.Pipeline()
+	values := make([]redis.Cmder, len(algorithms))
+	for i, algorithm := range algorithms {
+		stateKey := algorithmKey(key, algorithm)
+		switch types[i].Val() {
+		case "string":
+			values[i] = pipe.Get(ctx, stateKey)
+		case "hash":
+			values[i] = pipe.HGetAll(ctx, stateKey)
+		case "zset":
+			values[i] = pipe.ZCard(ctx, stateKey)
+		}
+	}
+	quotaCounts := make([]*redis.StringCmd, len(quotaKeys))
+	quotaTTLs := make([]*redis.DurationCmd, len(quotaKeys))
+	for i, quotaKey := range quotaKeys {
+		quotaCounts[i] = pipe.Get(ctx, quotaKey)
+		quotaTTLs[i] = pipe.PTTL(ctx, quotaKey)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return KeyState{}, fmt.Errorf("failed to inspect key %s: %w", key, err)
+	}
+
+	state := KeyState{}
+	for i, algorithm := range algorithms {
+		counter := CounterState{Algorithm: algorithm, TTL: max(ttls[i].Val(), 0)}
+		switch value := values[i].(type) {
+		case *redis.StringCmd:
+			if value.Err() != nil {
+				continue
+			}
+			field := "count"
+			if algorithm == "gcra" {
+				field = "tat"
+			}
+			counter.Fields = map[string]string{field: value.Val()}
+		case *redis.MapStringStringCmd:
+			counter.Fields = value.Val()
+		case *redis.IntCmd:
+			counter.Fields = map[string]string{"entries": strconv.FormatInt(value.Val(), 10)}
+		default:
+			continue
+		}
+		state.Counters = append(state.Counters, counter)
+	}
+
+	// Skip quota windows that expired after the scan
+	var liveKeys []string
+	var counts []int64
+	var windowTTLs []time.Duration
+	for i, quotaKey := range quotaKeys {
+		count, err := quotaCounts[i].Int64()
+		if err != nil || quotaTTLs[i].Val() <= 0 {
+			continue
+		}
+		liveKeys = append(liveKeys, quotaKey)
+		counts = append(counts, count)
+		windowTTLs = append(windowTTLs, quotaTTLs[i].Val())
+	}
+	state.Counters = append(state.Counters, quotaCounters(key, liveKeys, counts, windowTTLs)...)
+
+	if blockTTL.Val() > 0 {
+		state.Blocked = true
+		state.BlockTTL = blockTTL.Val()
+	}
+	state.Offenses, _ = offenses.Int64()
+	state.InFlight, _ = inFlight.Int64()
+	return state, nil
+}
+
+func (r *RedisStorage) FixedWindow(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := r.runLimitScript(ctx, fixedWindowScript, key, key, limit)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate fixed window for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) SlidingWindowLog(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := r.runLimitScript(ctx, slidingWindowLogScript, algorithmKey(key, "sliding_window_log"), key, limit)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate sliding window log for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := r.runLimitScript(ctx, slidingWindowCounterScript, algorithmKey(key, "sliding_window_counter"), key, limit)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate sliding window counter for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) TokenBucket(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := r.runLimitScript(ctx, tokenBucketScript, algorithmKey(key, "token_bucket"), key, limit)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate token bucket for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) GCRA(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := r.runLimitScript(ctx, gcraScript, algorithmKey(key, "gcra"), key, limit)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate GCRA for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) Quotas(ctx context.Context, key string, limits []Limit) (Result, error) {
+	if len(limits) == 0 {
+		return Result{}, errors.New("no limits to enforce")
+	}
+
+	// The block and offense keys go second and third, where the script prelude
+	// expects them
+	keys := []string{quotaKey(key, limits[0].Period), blockKey(key), offenseKey(key)}
+	args := make([]interface{}, 0, 7*len(limits))
+	for i, limit := range limits {
+		if i > 0 {
+			keys = append(keys, quotaKey(key, limit.Period))
+		}
+		args = append(args, scriptArgs(limit)...)
+	}
+
+	result, err := r.runScript(ctx, quotasScript, keys, args...)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate quotas for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (Result, error) {
+	result, err := r.runScript(ctx, acquireScript, []string{leaseKey(key)}, id, limit, ttl.Microseconds())
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to acquire lease for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) Release(ctx context.Context, key, id string) error {
+	if err := r.client.ZRem(ctx, leaseKey(key), id).Err(); err != nil {
+		return fmt.Errorf("failed to release lease for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// scan returns the keys matching the pattern. A cluster is scanned on every
+// master, since SCAN only walks the keys of the node it is sent to.
+func (r *RedisStorage) scan(ctx context.Context, match string) ([]string, error) {
+	cluster, isCluster := r.client.(*redis.ClusterClient)
+	if !isCluster {
+		return scanKeys(ctx, r.client, match)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		nodeKeys, err := scanKeys(ctx, client, match)
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+// globEscape escapes the characters with a meaning in SCAN patterns, such as
+// the "*" of the route keys
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func scanKeys(ctx context.Context, client redis.Cmdable, match string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, match, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// runLimitScript runs one of the single limit scripts for the key
+func (r *RedisStorage) runLimitScript(ctx context.Context, script *redis.Script, stateKey, key string, limit Limit) (Result, error) {
+	keys := []string{stateKey, blockKey(key), offenseKey(key)}
+	return r.runScript(ctx, script, keys, scriptArgs(limit)...)
+}
+
+// scriptArgs returns the arguments of a limit expected by the script prelude
+func scriptArgs(limit Limit) []interface{} {
+	return []interface{}{
+		limit.Rate,
+		limit.Period.Microseconds(),
+		limit.Block.Microseconds(),
+		limit.cost(),
+		limit.BlockMultiplier,
+		limit.MaxBlock.Microseconds(),
+		limit.BlockLookback.Microseconds(),
+	}
+}
+
+// runScript runs a rate limit script with EVALSHA, falling back to EVAL when
+// the script is missing from the server cache, and decodes its reply
+func (r *RedisStorage) runScript(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) (Result, error) {
+	vals, err := script.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(vals) < 4 || len(vals) > 6 {
+		return Result{}, fmt.Errorf("unexpected script reply %v", vals)
+	}
+
+	result := Result{
+		Allowed:    vals[0] == 1,
+		Remaining:  vals[1],
+		RetryAfter: time.Duration(vals[2]) * time.Microsecond,
+		ResetAfter: time.Duration(vals[3]) * time.Microsecond,
+	}
+	if len(vals) > 4 {
+		result.Index = int(vals[4])
+	}
+	if len(vals) > 5 {
+		result.Blocked = true
+		result.Offenses = vals[5]
+	}
+	return result, nil
+}
+
 func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
@@ -0,0 +1,276 @@
+package storage
+
+import "github.com/redis/go-redis/v9"
+
+// All scripts receive the state key in KEYS[1], the block key in KEYS[2] and
+// the offense key in KEYS[3]. ARGV holds the limit rate, the period in
+// microseconds, the block duration in microseconds, the cost of the request
+// (the number of units of the rate it consumes), the block multiplier, and the
+// maximum block and the offense lookback in microseconds. They read the clock
+// from the Redis server so that every replica of the application agrees on the
+// current time, and reply with {allowed, remaining, retry_after_us,
+// reset_after_us}, followed by {index, offenses} when the key was blocked.
+//
+// The prelude rejects requests for blocked keys and defines deny, which blocks
+// the key when a block duration is configured, escalating the block of repeat
+// offenders. Checking the block, counting the request and setting the block
+// therefore happen in a single atomic call.
+const scriptPrelude = `
+local key = KEYS[1]
+local blockKey = KEYS[2]
+local offenseKey = KEYS[3]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local multiplier = tonumber(ARGV[5])
+local maxBlock = tonumber(ARGV[6])
+local lookback = tonumber(ARGV[7])
+
+local blockTTL = redis.call('PTTL', blockKey)
+if blockTTL > 0 then
+	return {0, 0, blockTTL * 1000, blockTTL * 1000}
+end
+
+local function deny(retry, reset)
+	if block > 0 then
+		local offenses = 0
+		if lookback > 0 then
+			offenses = redis.call('INCR', offenseKey)
+			redis.call('PEXPIRE', offenseKey, math.ceil(lookback / 1000))
+			if multiplier > 1 and offenses > 1 then
+				block = block * multiplier ^ (offenses - 1)
+				if maxBlock > 0 then
+					block = math.min(block, maxBlock)
+				end
+				-- never past 2^53 microseconds, see maxBlockDuration
+				block = math.floor(math.min(block, 2 ^ 53))
+			end
+		end
+		redis.call('SET', blockKey, '1', 'PX', math.ceil(block / 1000))
+		return {0, 0, block, math.max(block, reset), 0, offenses}
+	end
+	return {0, 0, retry, reset}
+end
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+`
+
+var fixedWindowScript = redis.NewScript(scriptPrelude + `
+local count = tonumber(redis.call('GET', key) or '0')
+if count + cost > limit then
+	local reset = redis.call('PTTL', key) * 1000
+	if reset <= 0 then
+		reset = window
+	end
+	return deny(reset, reset)
+end
+
+count = redis.call('INCRBY', key, cost)
+if redis.call('PTTL', key) < 0 then
+	redis.call('PEXPIRE', key, math.ceil(window / 1000))
+end
+return {1, limit - count, 0, redis.call('PTTL', key) * 1000}
+`)
+
+var slidingWindowLogScript = redis.NewScript(scriptPrelude + `
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+if count + cost <= limit then
+	for i = 0, cost - 1 do
+		redis.call('ZADD', key, now, string.format('%d:%d', now, count + i))
+	end
+	redis.call('PEXPIRE', key, math.ceil(window / 1000))
+	return {1, limit - count - cost, 0, window}
+end
+if count == 0 then
+	return deny(window, window)
+end
+
+-- wait until enough requests leave the window for the cost to fit
+local first = math.max(0, math.min(count - 1, count + cost - limit - 1))
+local oldest = redis.call('ZRANGE', key, first, first, 'WITHSCORES')
+local newest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+return deny(tonumber(oldest[2]) + window - now, tonumber(newest[2]) + window - now)
+`)
+
+var slidingWindowCounterScript = redis.NewScript(scriptPrelude + `
+local current = math.floor(now / window)
+local offset = now - current * window
+local state = redis.call('HMGET', key, 'window', 'current', 'previous')
+local cur = tonumber(state[2]) or 0
+local prev = tonumber(state[3]) or 0
+if tonumber(state[1]) ~= current then
+	if tonumber(state[1]) == current - 1 then
+		prev = cur
+	else
+		prev = 0
+	end
+	cur = 0
+end
+
+local weighted = prev * (window - offset) / window + cur
+local allowed = weighted + cost <= limit
+local retry = 0
+if allowed then
+	cur = cur + cost
+	weighted = weighted + cost
+elseif cur + cost <= limit then
+	-- wait until the previous window weighs little enough
+	retry = window - (limit - cost - cur) * window / prev - offset
+elseif cur > 0 then
+	-- wait until the current window becomes the previous one and decays
+	retry = window - offset + window - (limit - cost) * window / cur
+else
+	retry = window - offset
+end
+
+redis.call('HSET', key, 'window', current, 'current', cur, 'previous', prev)
+redis.call('PEXPIRE', key, math.ceil(window * 2 / 1000))
+
+local reset = window - offset
+if cur > 0 then
+	reset = reset + window
+end
+if not allowed then
+	return deny(math.max(0, math.ceil(retry)), reset)
+end
+return {1, math.max(0, math.floor(limit - weighted)), 0, reset}
+`)
+
+var tokenBucketScript = redis.NewScript(scriptPrelude + `
+local rate = limit / window
+local state = redis.call('HMGET', key, 'tokens', 'timestamp')
+local tokens = tonumber(state[1])
+local timestamp = tonumber(state[2])
+if tokens == nil or timestamp == nil then
+	tokens = limit
+else
+	tokens = math.min(limit, tokens + (now - timestamp) * rate)
+end
+
+local allowed = tokens >= cost
+if allowed then
+	tokens = tokens - cost
+end
+
+local reset = math.ceil((limit - tokens) / rate)
+redis.call('HSET', key, 'tokens', tokens, 'timestamp', now)
+redis.call('PEXPIRE', key, math.ceil(reset / 1000) + 1)
+if not allowed then
+	return deny(math.ceil((cost - tokens) / rate), reset)
+end
+return {1, math.floor(tokens), 0, reset}
+`)
+
+var gcraScript = redis.NewScript(scriptPrelude + `
+local interval = window / limit
+local tat = tonumber(redis.call('GET', key))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local newTat = tat + interval * cost
+local allowAt = newTat - window
+if allowAt > now then
+	return deny(math.ceil(allowAt - now), math.ceil(tat - now))
+end
+
+redis.call('SET', key, newTat, 'PX', math.ceil((newTat - now) / 1000))
+return {1, math.floor((now - allowAt) / interval + 1e-9), 0, math.ceil(newTat - now)}
+`)
+
+// quotasScript counts the request in several fixed windows, only when all of
+// them allow it. KEYS[1] and KEYS[4..] hold the counters of the limits, KEYS[2]
+// and KEYS[3] the block and offense keys, and ARGV holds the seven arguments of
+// every limit in turn. The reply carries the 0-based index of the reported limit
+// as a fifth value.
+var quotasScript = redis.NewScript(scriptPrelude + `
+local keys = {KEYS[1]}
+for i = 4, #KEYS do
+	keys[#keys + 1] = KEYS[i]
+end
+
+local denied, retry = 0, 0
+for i = 1, #keys do
+	local count = tonumber(redis.call('GET', keys[i]) or '0')
+	local arg = 7 * (i - 1)
+	if count + tonumber(ARGV[arg + 4]) > tonumber(ARGV[arg + 1]) then
+		local ttl = redis.call('PTTL', keys[i])
+		local wait = tonumber(ARGV[arg + 2])
+		if ttl > 0 then
+			wait = ttl * 1000
+		end
+		if wait > retry then
+			denied, retry = i, wait
+		end
+	end
+end
+
+if denied > 0 then
+	-- block with the settings of the exhausted limit
+	local arg = 7 * (denied - 1)
+	block = tonumber(ARGV[arg + 3])
+	multiplier = tonumber(ARGV[arg + 5])
+	maxBlock = tonumber(ARGV[arg + 6])
+	lookback = tonumber(ARGV[arg + 7])
+	local reply = deny(retry, retry)
+	reply[5] = denied - 1
+	return reply
+end
+
+local tightest, remaining, reset = 0, 0, 0
+for i = 1, #keys do
+	local arg = 7 * (i - 1)
+	local count = redis.call('INCRBY', keys[i], ARGV[arg + 4])
+	if redis.call('PTTL', keys[i]) < 0 then
+		redis.call('PEXPIRE', keys[i], math.ceil(tonumber(ARGV[arg + 2]) / 1000))
+	end
+	local left = tonumber(ARGV[arg + 1]) - count
+	if tightest == 0 or left < remaining then
+		tightest, remaining, reset = i, left, redis.call('PTTL', keys[i]) * 1000
+	end
+end
+return {1, remaining, 0, reset, tightest - 1}
+`)
+
+// acquireScript keeps the leases of a key in a sorted set scored by their
+// expiry in microseconds. KEYS[1] is the lease key and ARGV holds the lease id,
+// the limit and the lease ttl in microseconds. Expired leases are dropped
+// before counting, and the key lives as long as its last lease.
+var acquireScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local limit = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	return {0, 0, 0, 0}
+end
+
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('PEXPIRE', KEYS[1], math.ceil((tonumber(last[2]) - now) / 1000))
+return {1, limit - count - 1, 0, 0}
+`)
+
+// inFlightScript counts the leases of KEYS[1] that have not expired by the
+// clock of the Redis server, the clock acquireScript scores them with
+var inFlightScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+return redis.call('ZCOUNT', KEYS[1], '(' .. now, '+inf')
+`)
+
+var limitScripts = []*redis.Script{
+	fixedWindowScript,
+	slidingWindowLogScript,
+	slidingWindowCounterScript,
+	tokenBucketScript,
+	gcraScript,
+	quotasScript,
+	acquireScript,
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorageLoadsScripts(t *testing.T) {
+	r, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+
+	for _, script := range limitScripts {
+		exists, err := r.client.ScriptExists(ctx, script.Hash()).Result()
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true}, exists)
+	}
+}
+
+func TestRedisStorageReloadsFlushedScripts(t *testing.T) {
+	r, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Period: time.Second}
+
+	// EVALSHA fails with NOSCRIPT and the script is sent again
+	require.NoError(t, r.client.ScriptFlush(ctx).Err())
+	result, err := r.TokenBucket(ctx, "key", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	require.NoError(t, r.client.ScriptFlush(ctx).Err())
+	result, err = r.Quotas(ctx, "key", []Limit{limit})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	require.NoError(t, r.client.ScriptFlush(ctx).Err())
+	result, err = r.Acquire(ctx, "key", "a", 1, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRedisStorageUsesServerClock(t *testing.T) {
+	r, clock := newTestRedisStorage(t)
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Period: time.Second}
+
+	for _, tt := range algorithmTests[1:] {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.take(r, ctx, tt.name, limit)
+			require.NoError(t, err)
+			require.True(t, result.Allowed)
+			result, err = tt.take(r, ctx, tt.name, limit)
+			require.NoError(t, err)
+			require.False(t, result.Allowed)
+
+			// Moving the clock of the server without expiring any key restores
+			// the limit, whatever the clock of the application says
+			clock.skew(2 * time.Second)
+			result, err = tt.take(r, ctx, tt.name, limit)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+		})
+	}
+
+	t.Run("leases", func(t *testing.T) {
+		result, err := r.Acquire(ctx, "leases", "a", 1, time.Minute)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+
+		// The lease expired by the clock of the server before its key did
+		clock.skew(time.Minute)
+		state, err := r.Inspect(ctx, "leases")
+		require.NoError(t, err)
+		assert.Zero(t, state.InFlight)
+		result, err = r.Acquire(ctx, "leases", "b", 1, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	})
+}
+
+func TestRedisStorageRejectsUnknownMode(t *testing.T) {
+	_, err := NewRedisStorage(RedisOptions{Mode: "replicated"})
+	assert.EqualError(t, err, `unknown Redis mode "replicated"`)
+
+	_, err = NewRedisStorage(RedisOptions{Mode: "sentinel", Addrs: []string{"localhost:26379"}})
+	assert.EqualError(t, err, "sentinel mode requires a master name")
+}
+
+func TestRedisStorageScriptKeysShareSlot(t *testing.T) {
+	r, _ := newTestRedisStorage(t)
+	hook := &slotHook{t: t}
+	r.client.AddHook(hook)
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Period: time.Second, Block: time.Minute, BlockMultiplier: 2, BlockLookback: time.Hour}
+	quotas := []Limit{limit, {Rate: 5, Period: time.Minute}, {Rate: 100, Period: 24 * time.Hour}}
+
+	keys := []string{
+		"ratelimit:{ip:10.0.0.1}",
+		"ratelimit:{ip:2001:db8::/64}",
+		"ratelimit:{tenant:acme:token:abc}",
+		"ratelimit:{tenant:acme}",
+		"ratelimit:{network:10.0.0.0/24}",
+		"ratelimit:{ip:10.0.0.1}:route:POST:/login",
+	}
+	for _, store := range []Storage{r, NewPrefixed(r, "staging:")} {
+		for _, key := range keys {
+			for _, tt := range algorithmTests {
+				for i := 0; i < 2; i++ {
+					_, err := tt.take(store, ctx, key, limit)
+					require.NoError(t, err)
+				}
+			}
+			_, err := store.Quotas(ctx, key, quotas)
+			require.NoError(t, err)
+			_, err = store.Acquire(ctx, key, "a", 1, time.Minute)
+			require.NoError(t, err)
+			_, err = store.Inspect(ctx, key)
+			require.NoError(t, err)
+		}
+	}
+	assert.Positive(t, hook.scripts)
+	assert.Equal(t, 12182, hashSlot("foo"))
+}
+
+// slotHook fails the test when a script receives keys of different Redis
+// Cluster slots, which a cluster rejects with CROSSSLOT
+type slotHook struct {
+	t       *testing.T
+	scripts int
+}
+
+func (h *slotHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *slotHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.check(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *slotHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.check(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (h *slotHook) check(cmd redis.Cmder) {
+	if cmd.Name() != "evalsha" && cmd.Name() != "eval" {
+		return
+	}
+	h.scripts++
+
+	// EVALSHA sha numkeys key [key ...] arg [arg ...]
+	args := cmd.Args()
+	keys := args[3 : 3+args[2].(int)]
+	for _, key := range keys[1:] {
+		assert.Equal(h.t, hashSlot(keys[0].(string)), hashSlot(key.(string)), "keys %v", keys)
+	}
+}
+
+// hashSlot returns the Redis Cluster slot of a key, the CRC16 of its hash tag
+// modulo 16384
+func hashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
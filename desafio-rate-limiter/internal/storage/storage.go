@@ -2,9 +2,131 @@ package storage
 
 import (
 	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Limit describes a rate of Rate requests per Period. When Block is positive a
+// key that exceeds the limit is blocked for Block.
+type Limit struct {
+	Rate   int64
+	Period time.Duration
+	Block  time.Duration
+	// Cost is the number of units of Rate the request consumes, one when not
+	// positive. It must not exceed Rate, or the request is never allowed.
+	Cost int64
+	// BlockLookback is how long the offenses of a key, the times it was
+	// blocked, are remembered after the last one. Zero does not track them.
+	BlockLookback time.Duration
+	// BlockMultiplier multiplies Block on each offense of the key within
+	// BlockLookback, up to MaxBlock when positive. Values up to 1 keep Block.
+	BlockMultiplier float64
+	MaxBlock        time.Duration
+}
+
+// blockDuration returns the block of a key for its given offense, the first
+// offense being blocked for Block
+func (l Limit) blockDuration(offenses int64) time.Duration {
+	if l.BlockMultiplier <= 1 || offenses <= 1 {
+		return l.Block
+	}
+
+	block := float64(l.Block) * math.Pow(l.BlockMultiplier, float64(offenses-1))
+	if l.MaxBlock > 0 && block > float64(l.MaxBlock) {
+		return l.MaxBlock
+	}
+	if block >= float64(maxBlockDuration) {
+		return maxBlockDuration
+	}
+	return time.Duration(block)
+}
+
+// maxBlockDuration caps escalated blocks, so that blocks of repeat offenders
+// without a MaxBlock do not overflow. 2^53 microseconds, about 285 years, is
+// the longest block the Redis scripts compute exactly with Lua numbers.
+const maxBlockDuration = (1 << 53) * time.Microsecond
+
+// cost returns the number of units the request consumes
+func (l Limit) cost() int64 {
+	if l.Cost <= 0 {
+		return 1
+	}
+	return l.Cost
+}
+
+// Result is the outcome of a rate limit evaluation performed by the storage
+type Result struct {
+	// Allowed reports whether the request fits in the limit
+	Allowed bool
+	// Remaining is the number of requests still available
+	Remaining int64
+	// RetryAfter is the time until the next request may be allowed (zero when allowed)
+	RetryAfter time.Duration
+	// ResetAfter is the time until the limit is fully restored
+	ResetAfter time.Duration
+	// Index is the position of the limit the result reports when several
+	// limits are evaluated together by Quotas
+	Index int
+	// Blocked reports that the request blocked the key, RetryAfter being the
+	// block duration
+	Blocked bool
+	// Offenses is the number of times the key was blocked within the lookback,
+	// set when the request blocked the key
+	Offenses int64
+}
+
+// Block is an active block of a key
+type Block struct {
+	Key string
+	TTL time.Duration
+	// Offenses is the number of times the key was blocked within the lookback
+	Offenses int64
+}
+
+// KeyState is a snapshot of the state kept for a key
+type KeyState struct {
+	// Counters holds the state of each algorithm that counted requests for the
+	// key, followed by the counters of its quota windows from the shortest
+	Counters []CounterState
+	Blocked  bool
+	BlockTTL time.Duration
+	// Offenses is the number of times the key was blocked within the lookback
+	Offenses int64
+	// InFlight is the number of unexpired leases held on the key
+	InFlight int64
+}
+
+// CounterState is the state kept by one algorithm for a key. The counter of a
+// quota window has the "quota" algorithm, and its window and count as fields.
+type CounterState struct {
+	Algorithm string
+	Fields    map[string]string
+	TTL       time.Duration
+}
+
+// quotaCounters describes the quota windows counted in the given state keys of
+// the key, ordered from the shortest window
+func quotaCounters(key string, stateKeys []string, counts []int64, ttls []time.Duration) []CounterState {
+	counters := make([]CounterState, 0, len(stateKeys))
+	windows := make(map[string]time.Duration, len(stateKeys))
+	for i, stateKey := range stateKeys {
+		window := strings.TrimPrefix(stateKey, quotaPrefix(key))
+		windows[window], _ = time.ParseDuration(window)
+		counters = append(counters, CounterState{
+			Algorithm: "quota",
+			Fields:    map[string]string{"window": window, "count": strconv.FormatInt(counts[i], 10)},
+			TTL:       ttls[i],
+		})
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		return windows[counters[i].Fields["window"]] < windows[counters[j].Fields["window"]]
+	})
+	return counters
+}
+
 // Storage is the interface for rate limiter storage
 type Storage interface {
 	// Increment increments the counter for the given key and returns the new value
@@ -19,6 +141,111 @@ type Storage interface {
 	// IsBlocked checks if the given key is blocked
 	IsBlocked(ctx context.Context, key string) (bool, error)
 
+	// Unblock removes the block of the given key and reports whether it was blocked
+	Unblock(ctx context.Context, key string) (bool, error)
+
+	// Blocks lists the active blocks
+	Blocks(ctx context.Context) ([]Block, error)
+
+	// Inspect returns the counters and block kept for the given key
+	Inspect(ctx context.Context, key string) (KeyState, error)
+
+	// The methods below evaluate a request for the given key with one rate limit
+	// algorithm. Each of them atomically rejects the request if the key is blocked,
+	// counts the request and blocks the key when the limit is exceeded. A request
+	// consumes limit.Cost units, and a rejected request consumes none.
+
+	// FixedWindow increments the counter of the current window for the given key
+	FixedWindow(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// SlidingWindowLog records a request in a log of timestamps for the given key
+	// and allows it only if the log holds fewer than limit.Rate entries within limit.Period
+	SlidingWindowLog(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// SlidingWindowCounter weights the previous fixed window counter by the portion
+	// of it still covered by the sliding window and adds the current window counter
+	SlidingWindowCounter(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// TokenBucket takes one token from a bucket of limit.Rate tokens that is refilled
+	// at limit.Rate tokens per limit.Period
+	TokenBucket(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// GCRA applies the generic cell rate algorithm, tracking the theoretical arrival
+	// time of the next request for the given key
+	GCRA(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// Quotas enforces several fixed window limits at once, such as 10 requests
+	// per second, 500 per minute and 100000 per day. The request is counted in
+	// every window only when none of them is exhausted. A denial reports the
+	// exhausted window with the longest wait and blocks the key for its Block,
+	// otherwise the window with the fewest remaining requests is reported.
+	Quotas(ctx context.Context, key string, limits []Limit) (Result, error)
+
+	// Acquire takes one of the limit slots of the given key for the lease id,
+	// held until the lease is released or its ttl expires so that the leases of
+	// a crashed instance do not hold slots forever. Remaining is the number of
+	// free slots. Blocks do not apply to leases.
+	Acquire(ctx context.Context, key, id string, limit int64, ttl time.Duration) (Result, error)
+
+	// Release frees the slot held by the lease id on the given key
+	Release(ctx context.Context, key, id string) error
+
 	// Close closes the storage connection
 	Close() error
 }
+
+// blockPrefix and the algorithm suffixes surround the key without adding braces,
+// so a key carrying a Redis hash tag, such as "ratelimit:{ip:10.0.0.1}", keeps
+// its state and block on the same Redis Cluster slot. The rate limit scripts
+// need both in the same slot.
+const blockPrefix = "block:"
+
+// algorithms lists the algorithms keeping state in the storage
+var algorithms = []string{
+	"fixed_window",
+	"sliding_window_log",
+	"sliding_window_counter",
+	"token_bucket",
+	"gcra",
+}
+
+// offensePrefix prefixes the key counting the offenses of a key, kept next to
+// its block
+const offensePrefix = "offenses:"
+
+// blockKey returns the key that marks the given key as blocked
+func blockKey(key string) string {
+	return blockPrefix + key
+}
+
+// offenseKey returns the key counting the times the given key was blocked
+func offenseKey(key string) string {
+	return offensePrefix + key
+}
+
+// leaseKey returns the key holding the leases of the requests in flight for the
+// given key, e.g. "ratelimit:{token:abc}:leases"
+func leaseKey(key string) string {
+	return key + ":leases"
+}
+
+// quotaKey returns the key counting the requests of the given key in the window
+// of a quota, e.g. "ratelimit:{token:abc}:quota:24h0m0s"
+func quotaKey(key string, period time.Duration) string {
+	return quotaPrefix(key) + period.String()
+}
+
+// quotaPrefix returns the prefix of the keys counting the quota windows of the
+// given key
+func quotaPrefix(key string) string {
+	return algorithmKey(key, "quota:")
+}
+
+// algorithmKey returns the key holding the state of an algorithm for the given
+// key. Fixed window counters keep the bare key.
+func algorithmKey(key string, algorithm string) string {
+	if algorithm == "fixed_window" {
+		return key
+	}
+	return key + ":" + algorithm
+}
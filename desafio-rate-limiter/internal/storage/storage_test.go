@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// algorithmTests lists the single limit algorithms of the storage
+var algorithmTests = []struct {
+	name string
+	take func(Storage, context.Context, string, Limit) (Result, error)
+}{
+	{name: "fixed window", take: Storage.FixedWindow},
+	{name: "sliding window log", take: Storage.SlidingWindowLog},
+	{name: "sliding window counter", take: Storage.SlidingWindowCounter},
+	{name: "token bucket", take: Storage.TokenBucket},
+	{name: "gcra", take: Storage.GCRA},
+}
+
+// forEachStorage runs the test against the memory storage and the Redis scripts,
+// with a clock that only moves when the test advances it
+func forEachStorage(t *testing.T, test func(t *testing.T, store Storage, advance func(time.Duration))) {
+	t.Run("memory", func(t *testing.T) {
+		m, now := newTestMemoryStorage(t)
+		test(t, m, func(d time.Duration) { *now = now.Add(d) })
+	})
+	t.Run("redis", func(t *testing.T) {
+		r, clock := newTestRedisStorage(t)
+		test(t, r, clock.advance)
+	})
+}
+
+// redisClock is the clock of an in-process Redis server
+type redisClock struct {
+	server *miniredis.Miniredis
+	now    time.Time
+}
+
+// advance moves both the clock read by the scripts and the key TTLs
+func (c *redisClock) advance(d time.Duration) {
+	c.skew(d)
+	c.server.FastForward(d)
+}
+
+// skew moves the clock read by the scripts without expiring any key
+func (c *redisClock) skew(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.server.SetTime(c.now)
+}
+
+// newTestRedisStorage returns a storage backed by an in-process Redis whose
+// clock is frozen at the same time as newTestMemoryStorage
+func newTestRedisStorage(t *testing.T) (*RedisStorage, *redisClock) {
+	clock := &redisClock{server: miniredis.RunT(t), now: time.Unix(1700000000, 0)}
+	clock.server.SetTime(clock.now)
+
+	r, err := NewRedisStorage(RedisOptions{Addrs: []string{clock.server.Addr()}})
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r, clock
+}
+
+func TestStorageAlgorithms(t *testing.T) {
+	limit := Limit{Rate: 3, Period: time.Second}
+
+	for _, tt := range algorithmTests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+				ctx := context.Background()
+
+				for i := int64(1); i <= limit.Rate; i++ {
+					result, err := tt.take(store, ctx, "key", limit)
+					require.NoError(t, err)
+					assert.True(t, result.Allowed)
+					assert.Equal(t, limit.Rate-i, result.Remaining)
+				}
+
+				result, err := tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+				assert.Positive(t, result.RetryAfter)
+
+				// The whole limit is available again after two windows
+				advance(2 * limit.Period)
+				result, err = tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+			})
+		})
+	}
+}
+
+func TestStorageAlgorithmsCost(t *testing.T) {
+	limit := Limit{Rate: 5, Period: time.Second, Cost: 2}
+
+	for _, tt := range algorithmTests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+				ctx := context.Background()
+
+				for _, remaining := range []int64{3, 1} {
+					result, err := tt.take(store, ctx, "key", limit)
+					require.NoError(t, err)
+					assert.True(t, result.Allowed)
+					assert.Equal(t, remaining, result.Remaining)
+				}
+
+				// A single unit is left, so the request is rejected without spending it
+				result, err := tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+
+				limit := limit
+				limit.Cost = 1
+				result, err = tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+			})
+		})
+	}
+}
+
+func TestStorageBlocksExceededKey(t *testing.T) {
+	limit := Limit{Rate: 1, Period: time.Second, Block: 10 * time.Second}
+
+	for _, tt := range algorithmTests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+				ctx := context.Background()
+
+				result, err := tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+
+				result, err = tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+				assert.True(t, result.Blocked)
+				assert.Equal(t, 10*time.Second, result.RetryAfter)
+
+				// The limit is restored but the key is still blocked
+				advance(5 * time.Second)
+				result, err = tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+				assert.False(t, result.Blocked)
+				assert.Equal(t, 5*time.Second, result.RetryAfter)
+
+				blocks, err := store.Blocks(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, []Block{{Key: "key", TTL: 5 * time.Second}}, blocks)
+
+				advance(5 * time.Second)
+				result, err = tt.take(store, ctx, "key", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+			})
+		})
+	}
+}
+
+func TestStorageUnblock(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+		limit := Limit{Rate: 1, Period: time.Second, Block: time.Minute}
+
+		_, err := store.GCRA(ctx, "key", limit)
+		require.NoError(t, err)
+		result, err := store.GCRA(ctx, "key", limit)
+		require.NoError(t, err)
+		require.True(t, result.Blocked)
+
+		unblocked, err := store.Unblock(ctx, "key")
+		require.NoError(t, err)
+		assert.True(t, unblocked)
+		unblocked, err = store.Unblock(ctx, "key")
+		require.NoError(t, err)
+		assert.False(t, unblocked)
+
+		// The request is counted again once the limit is restored
+		advance(time.Second)
+		result, err = store.GCRA(ctx, "key", limit)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	})
+}
+
+func TestStorageQuotas(t *testing.T) {
+	limits := []Limit{
+		{Rate: 2, Period: time.Second},
+		{Rate: 3, Period: time.Minute},
+	}
+
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+
+		result, err := store.Quotas(ctx, "key", limits)
+		require.NoError(t, err)
+		assert.Equal(t, Result{Allowed: true, Remaining: 1, ResetAfter: time.Second, Index: 0}, result)
+
+		result, err = store.Quotas(ctx, "key", limits)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+
+		// The per second limit is exhausted and the request is not counted per minute
+		result, err = store.Quotas(ctx, "key", limits)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, 0, result.Index)
+		assert.Equal(t, time.Second, result.RetryAfter)
+
+		advance(time.Second)
+		result, err = store.Quotas(ctx, "key", limits)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 1, result.Index)
+		assert.Equal(t, int64(0), result.Remaining)
+
+		// The per minute quota is exhausted with a second still available
+		advance(time.Second)
+		result, err = store.Quotas(ctx, "key", limits)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, 1, result.Index)
+		assert.Equal(t, 58*time.Second, result.RetryAfter)
+
+		// The exhausted quota blocks the key with its own settings
+		blocking := []Limit{limits[0], limits[1]}
+		blocking[1].Block = time.Hour
+		result, err = store.Quotas(ctx, "key", blocking)
+		require.NoError(t, err)
+		assert.True(t, result.Blocked)
+		assert.Equal(t, 1, result.Index)
+		assert.Equal(t, time.Hour, result.RetryAfter)
+	})
+}
+
+func TestStorageEscalatesRepeatedBlocks(t *testing.T) {
+	limit := Limit{
+		Rate:            1,
+		Period:          time.Second,
+		Block:           10 * time.Second,
+		BlockMultiplier: 2,
+		MaxBlock:        35 * time.Second,
+		BlockLookback:   time.Hour,
+	}
+
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+
+		// Each block doubles the previous one up to the cap
+		for i, block := range []time.Duration{10 * time.Second, 20 * time.Second, 35 * time.Second, 35 * time.Second} {
+			result, err := store.FixedWindow(ctx, "key", limit)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+
+			result, err = store.FixedWindow(ctx, "key", limit)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, block, result.RetryAfter)
+			assert.Equal(t, int64(i+1), result.Offenses)
+
+			advance(block)
+		}
+
+		blocks, err := store.Blocks(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+		state, err := store.Inspect(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), state.Offenses)
+
+		// Offenses are forgotten after the lookback
+		advance(time.Hour)
+		_, err = store.FixedWindow(ctx, "key", limit)
+		require.NoError(t, err)
+		result, err := store.FixedWindow(ctx, "key", limit)
+		require.NoError(t, err)
+		assert.Equal(t, 10*time.Second, result.RetryAfter)
+		assert.Equal(t, int64(1), result.Offenses)
+	})
+}
+
+func TestStorageLeases(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+
+		for i, id := range []string{"a", "b"} {
+			result, err := store.Acquire(ctx, "key", id, 2, time.Minute)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, int64(1-i), result.Remaining)
+		}
+		result, err := store.Acquire(ctx, "key", "c", 2, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+
+		state, err := store.Inspect(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), state.InFlight)
+
+		// Releasing a lease frees its slot
+		require.NoError(t, store.Release(ctx, "key", "a"))
+		result, err = store.Acquire(ctx, "key", "c", 2, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+
+		// Leases never released expire
+		advance(time.Minute)
+		result, err = store.Acquire(ctx, "key", "d", 2, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(1), result.Remaining)
+	})
+}
+
+func TestStorageInspect(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+		limit := Limit{Rate: 5, Period: time.Minute}
+
+		state, err := store.Inspect(ctx, "key")
+		require.NoError(t, err)
+		assert.Empty(t, state.Counters)
+
+		for _, tt := range algorithmTests {
+			_, err := tt.take(store, ctx, "key", limit)
+			require.NoError(t, err)
+		}
+
+		state, err = store.Inspect(ctx, "key")
+		require.NoError(t, err)
+		fields := map[string]map[string]string{}
+		for _, counter := range state.Counters {
+			fields[counter.Algorithm] = counter.Fields
+			assert.Positive(t, counter.TTL, counter.Algorithm)
+		}
+		assert.Equal(t, map[string]string{"count": "1"}, fields["fixed_window"])
+		assert.Equal(t, map[string]string{"entries": "1"}, fields["sliding_window_log"])
+		assert.Equal(t, "1", fields["sliding_window_counter"]["current"])
+		assert.Equal(t, "4", fields["token_bucket"]["tokens"])
+		assert.Contains(t, fields["gcra"], "tat")
+		assert.False(t, state.Blocked)
+	})
+}
+
+func TestStorageInspectQuotas(t *testing.T) {
+	limits := []Limit{
+		{Rate: 10, Period: time.Second},
+		{Rate: 500, Period: time.Minute},
+		{Rate: 100000, Period: 24 * time.Hour},
+	}
+
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+		// Route keys hold the glob characters of their pattern
+		for _, key := range []string{"ratelimit:{token:abc}", "ratelimit:{token:abc}:route:GET:/api/*"} {
+			for i := 0; i < 3; i++ {
+				_, err := store.Quotas(ctx, key, limits)
+				require.NoError(t, err)
+			}
+		}
+		for _, key := range []string{"ratelimit:{token:abcd}", "ratelimit:{token:abc}:route:GET:/api/users"} {
+			_, err := store.Quotas(ctx, key, limits)
+			require.NoError(t, err)
+		}
+		advance(time.Second)
+
+		// The per second window expired, the others are reported from the shortest
+		state, err := store.Inspect(ctx, "ratelimit:{token:abc}")
+		require.NoError(t, err)
+		assert.Equal(t, []CounterState{
+			{Algorithm: "quota", Fields: map[string]string{"window": "1m0s", "count": "3"}, TTL: 59 * time.Second},
+			{Algorithm: "quota", Fields: map[string]string{"window": "24h0m0s", "count": "3"}, TTL: 24*time.Hour - time.Second},
+		}, state.Counters)
+
+		state, err = store.Inspect(ctx, "ratelimit:{token:abc}:route:GET:/api/*")
+		require.NoError(t, err)
+		require.Len(t, state.Counters, 2)
+		assert.Equal(t, "3", state.Counters[0].Fields["count"])
+	})
+}
+
+func TestStorageCapsEscalatedBlocks(t *testing.T) {
+	limit := Limit{
+		Rate:            1,
+		Period:          time.Hour,
+		Block:           time.Second,
+		BlockMultiplier: 2,
+		BlockLookback:   time.Hour,
+	}
+
+	forEachStorage(t, func(t *testing.T, store Storage, advance func(time.Duration)) {
+		ctx := context.Background()
+		_, err := store.FixedWindow(ctx, "key", limit)
+		require.NoError(t, err)
+
+		// The window stays exhausted, so every request after an unblock is an
+		// offense doubling the block, without a maximum
+		for offenses := int64(1); offenses <= 100; offenses++ {
+			result, err := store.FixedWindow(ctx, "key", limit)
+			require.NoError(t, err)
+			require.True(t, result.Blocked)
+			assert.Equal(t, offenses, result.Offenses)
+			switch {
+			case offenses == 10:
+				assert.Equal(t, 512*time.Second, result.RetryAfter)
+			case offenses > 60:
+				assert.Equal(t, maxBlockDuration, result.RetryAfter)
+			}
+
+			_, err = store.Unblock(ctx, "key")
+			require.NoError(t, err)
+		}
+	})
+}
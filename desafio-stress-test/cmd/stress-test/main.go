@@ -3,31 +3,47 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 
 	"github.com/lucasafonsokremer/goexpert/desafio-stress-test/internal/loadtest"
 	"github.com/lucasafonsokremer/goexpert/desafio-stress-test/internal/reporter"
+	"github.com/lucasafonsokremer/goexpert/desafio-stress-test/internal/scenario"
 )
 
 func main() {
 	// Definir flags CLI
 	url := flag.String("url", "", "URL do serviço a ser testado")
+	scenarioFile := flag.String("scenario", "", "Arquivo de cenário (YAML ou JSON) com as requisições a serem testadas, no lugar de --url")
 	requests := flag.Int("requests", 0, "Número total de requests")
 	concurrency := flag.Int("concurrency", 1, "Número de chamadas simultâneas")
 
 	flag.Parse()
 
 	// Validar parâmetros
-	if err := validateParams(*url, *requests, *concurrency); err != nil {
+	if err := validateParams(*url, *scenarioFile, *requests, *concurrency); err != nil {
 		fmt.Println(err)
 		flag.Usage()
 		return
 	}
 
+	// Carregar o cenário, ou um GET para a URL
+	var s *scenario.Scenario
+	var err error
+	if *scenarioFile != "" {
+		s, err = scenario.Load(*scenarioFile)
+	} else {
+		s, err = scenario.FromURL(*url)
+	}
+	if err != nil {
+		fmt.Printf("erro: %v\n", err)
+		return
+	}
+
 	// Exibir informações do teste
-	printTestInfo(*url, *requests, *concurrency)
+	printTestInfo(s, *requests, *concurrency)
 
 	// Executar teste de carga
-	tester := loadtest.New(*url, *requests, *concurrency)
+	tester := loadtest.New(s, *requests, *concurrency)
 	report := tester.Run()
 
 	// Exibir relatório
@@ -35,9 +51,13 @@ func main() {
 	rep.Print(report)
 }
 
-func validateParams(url string, requests int, concurrency int) error {
-	if url == "" {
-		return fmt.Errorf("erro: --url é obrigatório")
+func validateParams(url string, scenarioFile string, requests int, concurrency int) error {
+	if url == "" && scenarioFile == "" {
+		return fmt.Errorf("erro: --url ou --scenario é obrigatório")
+	}
+
+	if url != "" && scenarioFile != "" {
+		return fmt.Errorf("erro: use --url ou --scenario, não ambos")
 	}
 
 	if requests <= 0 {
@@ -51,9 +71,16 @@ func validateParams(url string, requests int, concurrency int) error {
 	return nil
 }
 
-func printTestInfo(url string, requests int, concurrency int) {
+func printTestInfo(s *scenario.Scenario, requests int, concurrency int) {
 	fmt.Printf("Iniciando teste de carga...\n")
-	fmt.Printf("URL: %s\n", url)
+	if len(s.Steps) == 1 && s.Steps[0].Method == http.MethodGet {
+		fmt.Printf("URL: %s\n", s.Steps[0].URL)
+	} else {
+		fmt.Printf("Passos do cenário:\n")
+		for _, step := range s.Steps {
+			fmt.Printf("  %s (peso %d)\n", step.Name, step.Weight)
+		}
+	}
 	fmt.Printf("Total de Requests: %d\n", requests)
 	fmt.Printf("Concorrência: %d\n\n", concurrency)
 }
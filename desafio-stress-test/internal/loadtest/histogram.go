@@ -0,0 +1,175 @@
+package loadtest
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits define a precisão do histograma: cada potência de 2 é dividida
+// em 2^subBucketBits buckets lineares, então o valor de um bucket difere dos
+// valores registrados nele em menos de 1%
+const subBucketBits = 7
+
+const subBuckets = 1 << subBucketBits
+
+// Histogram registra durações em buckets log-lineares, no estilo do
+// HdrHistogram: a memória e o custo de cada registro não dependem do número
+// de requisições, e os percentis têm erro relativo constante. Mínimo, máximo,
+// média e desvio padrão são exatos.
+type Histogram struct {
+	counts []int64
+	count  int64
+	min    time.Duration
+	max    time.Duration
+	// mean e m2 são atualizados pelo algoritmo de Welford
+	mean float64
+	m2   float64
+}
+
+// NewHistogram cria um histograma vazio
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// Record registra uma duração
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	index := bucketIndex(uint64(d))
+	if index >= len(h.counts) {
+		counts := make([]int64, index+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[index]++
+
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	delta := float64(d) - h.mean
+	h.mean += delta / float64(h.count)
+	h.m2 += delta * (float64(d) - h.mean)
+}
+
+// Count retorna o número de durações registradas
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+func (h *Histogram) Mean() time.Duration {
+	return time.Duration(h.mean)
+}
+
+// StdDev retorna o desvio padrão populacional das durações
+func (h *Histogram) StdDev() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(h.m2 / float64(h.count)))
+}
+
+// Percentile retorna a duração abaixo da qual estão p% das durações, ex:
+// Percentile(99.9)
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+
+	var seen int64
+	for index, count := range h.counts {
+		seen += count
+		if seen >= target {
+			return h.clamp(time.Duration(bucketHighest(index)))
+		}
+	}
+	return h.max
+}
+
+// Bar é uma faixa de durações do histograma e o número de durações nela
+type Bar struct {
+	From  time.Duration
+	To    time.Duration
+	Count int64
+}
+
+// Bars agrupa as durações em n faixas de largura crescente (escala
+// logarítmica) entre o mínimo e o máximo, adequadas às latências, que
+// costumam ter cauda longa
+func (h *Histogram) Bars(n int) []Bar {
+	if h.count == 0 || n <= 0 {
+		return nil
+	}
+
+	from, to := math.Max(float64(h.min), 1), math.Max(float64(h.max), 1)
+	if to <= from {
+		return []Bar{{From: h.min, To: h.max, Count: h.count}}
+	}
+	ratio := math.Pow(to/from, 1/float64(n))
+
+	bars := make([]Bar, n)
+	for i := range bars {
+		bars[i].From = time.Duration(from * math.Pow(ratio, float64(i)))
+		bars[i].To = time.Duration(from * math.Pow(ratio, float64(i+1)))
+	}
+	bars[0].From, bars[n-1].To = h.min, h.max
+
+	for index, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		// Os valores de um bucket são representados pelo seu valor central
+		value := math.Max(float64(h.clamp(time.Duration((bucketLowest(index)+bucketHighest(index))/2))), 1)
+		i := int(math.Log(value/from) / math.Log(ratio))
+		bars[max(0, min(i, n-1))].Count += count
+	}
+	return bars
+}
+
+// clamp limita um valor de bucket às durações registradas
+func (h *Histogram) clamp(d time.Duration) time.Duration {
+	return max(h.min, min(d, h.max))
+}
+
+// bucketIndex retorna o bucket de um valor. Valores até subBuckets têm um
+// bucket cada; acima disso, cada potência de 2 tem subBuckets buckets.
+func bucketIndex(value uint64) int {
+	if value < subBuckets {
+		return int(value)
+	}
+	shift := bits.Len64(value) - subBucketBits - 1
+	return subBuckets + shift*subBuckets + int(value>>shift) - subBuckets
+}
+
+// bucketLowest retorna o menor valor do bucket
+func bucketLowest(index int) uint64 {
+	if index < subBuckets {
+		return uint64(index)
+	}
+	shift := (index - subBuckets) / subBuckets
+	mantissa := uint64((index-subBuckets)%subBuckets + subBuckets)
+	return mantissa << shift
+}
+
+// bucketHighest retorna o maior valor do bucket
+func bucketHighest(index int) uint64 {
+	return bucketLowest(index+1) - 1
+}
@@ -0,0 +1,120 @@
+package loadtest
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBucketRoundTrip(t *testing.T) {
+	values := []uint64{0, 1, subBuckets - 1, subBuckets, subBuckets + 1, 255, 256, 1000, 123456789, uint64(time.Hour), math.MaxInt64}
+	for _, value := range values {
+		index := bucketIndex(value)
+		lowest, highest := bucketLowest(index), bucketHighest(index)
+		if value < lowest || value > highest {
+			t.Errorf("valor %d fora do seu bucket %d [%d, %d]", value, index, lowest, highest)
+		}
+		// Os buckets têm largura relativa de no máximo 1/subBuckets
+		if value >= subBuckets && float64(highest-lowest+1)/float64(lowest) > 1.0/subBuckets {
+			t.Errorf("bucket %d [%d, %d] largo demais", index, lowest, highest)
+		}
+	}
+
+	// Os buckets são contíguos: cada um começa logo após o anterior
+	for index := 1; index < bucketIndex(1<<20); index++ {
+		if bucketLowest(index) != bucketHighest(index-1)+1 {
+			t.Fatalf("bucket %d começa em %d, o anterior termina em %d", index, bucketLowest(index), bucketHighest(index-1))
+		}
+		if bucketIndex(bucketLowest(index)) != index || bucketIndex(bucketHighest(index)) != index {
+			t.Fatalf("limites do bucket %d não voltam ao mesmo bucket", index)
+		}
+	}
+}
+
+func TestHistogramStats(t *testing.T) {
+	h := NewHistogram()
+	if h.Percentile(50) != 0 || h.StdDev() != 0 || h.Bars(10) != nil {
+		t.Error("histograma vazio deveria retornar zero")
+	}
+
+	for _, d := range []time.Duration{2, 4, 4, 4, 5, 5, 7, 9} {
+		h.Record(d)
+	}
+	if h.Count() != 8 || h.Min() != 2 || h.Max() != 9 || h.Mean() != 5 || h.StdDev() != 2 {
+		t.Errorf("estatísticas inesperadas: count %d, min %v, max %v, média %v, desvio %v",
+			h.Count(), h.Min(), h.Max(), h.Mean(), h.StdDev())
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	// Valores abaixo de subBuckets têm um bucket cada e percentis exatos
+	h := NewHistogram()
+	for d := time.Duration(1); d <= 100; d++ {
+		h.Record(d)
+	}
+	for p, want := range map[float64]time.Duration{0: 1, 1: 1, 50: 50, 90: 90, 99: 99, 99.9: 100, 100: 100} {
+		if got := h.Percentile(p); got != want {
+			t.Errorf("p%v = %v, esperava %v", p, got, want)
+		}
+	}
+
+	// Acima disso o erro relativo é menor que 1%
+	h = NewHistogram()
+	for d := time.Millisecond; d <= time.Second; d += time.Millisecond {
+		h.Record(d)
+	}
+	for p, want := range map[float64]time.Duration{50: 500 * time.Millisecond, 90: 900 * time.Millisecond, 99.9: 999 * time.Millisecond} {
+		got := h.Percentile(p)
+		if math.Abs(float64(got-want))/float64(want) > 0.01 {
+			t.Errorf("p%v = %v, esperava %v", p, got, want)
+		}
+	}
+	if got := h.Percentile(100); got != time.Second {
+		t.Errorf("p100 = %v, esperava o máximo", got)
+	}
+}
+
+func TestBars(t *testing.T) {
+	h := NewHistogram()
+	// 1 valor em 1ms, 10 em 10ms, 100 em 100ms e 1000 em 1s
+	for i, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		for n := 0; n < int(math.Pow10(i)); n++ {
+			h.Record(d)
+		}
+	}
+
+	bars := h.Bars(3)
+	if len(bars) != 3 {
+		t.Fatalf("esperava 3 faixas, recebeu %d", len(bars))
+	}
+	if bars[0].From != time.Millisecond || bars[2].To != time.Second {
+		t.Errorf("as faixas vão de %v a %v, esperava do mínimo ao máximo", bars[0].From, bars[2].To)
+	}
+	var total int64
+	for i, bar := range bars {
+		total += bar.Count
+		if i > 0 && bar.From != bars[i-1].To {
+			t.Errorf("faixa %d começa em %v, a anterior termina em %v", i, bar.From, bars[i-1].To)
+		}
+	}
+	if total != h.Count() {
+		t.Errorf("as faixas somam %d, esperava %d", total, h.Count())
+	}
+	// Em escala logarítmica, cada faixa cobre uma década: 1ms-10ms, 10ms-100ms
+	// e 100ms-1s. O valor central do bucket de 10ms e de 100ms fica logo
+	// abaixo da fronteira, na faixa anterior.
+	for i, want := range []int64{11, 100, 1000} {
+		if bars[i].Count != want {
+			t.Errorf("faixa %d com %d durações, esperava %d", i, bars[i].Count, want)
+		}
+	}
+
+	// Uma única duração gera uma única faixa
+	h = NewHistogram()
+	h.Record(time.Millisecond)
+	h.Record(time.Millisecond)
+	bars = h.Bars(10)
+	if len(bars) != 1 || bars[0].Count != 2 {
+		t.Errorf("esperava uma faixa com 2 durações, recebeu %+v", bars)
+	}
+}
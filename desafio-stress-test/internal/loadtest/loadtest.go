@@ -1,16 +1,30 @@
 package loadtest
 
 import (
+	"io"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/lucasafonsokremer/goexpert/desafio-stress-test/internal/scenario"
 )
 
+// maxAssertBody é o tamanho máximo do corpo da resposta lido para as
+// verificações do passo
+const maxAssertBody = 1 << 20
+
 // RequestResult representa o resultado de uma requisição HTTP
 type RequestResult struct {
 	StatusCode int
 	Duration   time.Duration
 	Error      error
+	// Step é o nome do passo do cenário e AssertionError a verificação do
+	// passo que falhou, se alguma
+	Step           string
+	AssertionError error
+	// NotSent indica que a requisição não pôde ser montada, ex: por um erro
+	// no template, e por isso não foi enviada. Error traz o motivo.
+	NotSent bool
 }
 
 // Report contém as métricas do teste de carga
@@ -21,20 +35,42 @@ type Report struct {
 	StatusCodes    map[int]int
 	SuccessRate    float64
 	FailedRequests int
+	// NotSent é o número de requisições que não puderam ser montadas e
+	// NotSentError o erro da primeira delas
+	NotSent      int
+	NotSentError error
+	// Steps são os resultados de cada passo do cenário, por nome
+	Steps map[string]StepReport
+	// Latency registra a duração de todas as requisições enviadas e
+	// LatencyByStatus a das requisições de cada código de status (0 para erros)
+	Latency         *Histogram
+	LatencyByStatus map[int]*Histogram
+}
+
+// StepReport contém as métricas de um passo do cenário
+type StepReport struct {
+	Requests    int
+	StatusCodes map[int]int
+	NotSent     int
+	// AssertionFailures é o número de respostas que falharam nas verificações,
+	// e Failures conta cada motivo de falha
+	AssertionFailures int
+	Failures          map[string]int
 }
 
 // LoadTester é responsável por executar os testes de carga
 type LoadTester struct {
-	url         string
+	scenario    *scenario.Scenario
 	requests    int
 	concurrency int
 	client      *http.Client
 }
 
-// New cria uma nova instância de LoadTester
-func New(url string, requests int, concurrency int) *LoadTester {
+// New cria uma nova instância de LoadTester que executa as requisições do
+// cenário
+func New(s *scenario.Scenario, requests int, concurrency int) *LoadTester {
 	return &LoadTester{
-		url:         url,
+		scenario:    s,
 		requests:    requests,
 		concurrency: concurrency,
 		client: &http.Client{
@@ -56,7 +92,7 @@ func (lt *LoadTester) Run() Report {
 	// Criar worker pool
 	for i := 0; i < lt.requests; i++ {
 		wg.Add(1)
-		go func() {
+		go func(index int) {
 			defer wg.Done()
 
 			// Adquirir slot no semáforo
@@ -64,9 +100,9 @@ func (lt *LoadTester) Run() Report {
 			defer func() { <-semaphore }()
 
 			// Fazer request
-			result := lt.makeRequest()
+			result := lt.makeRequest(index)
 			results <- result
-		}()
+		}(i)
 	}
 
 	// Aguardar todas as goroutines terminarem
@@ -82,24 +118,54 @@ func (lt *LoadTester) Run() Report {
 	return report
 }
 
-// makeRequest realiza uma requisição HTTP
-func (lt *LoadTester) makeRequest() RequestResult {
+// makeRequest sorteia um passo do cenário, realiza a requisição HTTP e aplica
+// as verificações do passo à resposta
+func (lt *LoadTester) makeRequest(index int) RequestResult {
+	step := lt.scenario.Pick()
+	req, err := lt.scenario.NewRequest(step, scenario.TemplateData{Index: index})
+	if err != nil {
+		return RequestResult{
+			Step:    step.Name,
+			Error:   err,
+			NotSent: true,
+		}
+	}
+
 	start := time.Now()
-	resp, err := lt.client.Get(lt.url)
-	duration := time.Since(start)
+	resp, err := lt.client.Do(req)
+	if err != nil {
+		return RequestResult{
+			Step:     step.Name,
+			Duration: time.Since(start),
+			Error:    err,
+		}
+	}
+	defer resp.Body.Close()
 
+	// O corpo é lido até o fim para reutilizar a conexão, e a duração inclui
+	// a leitura do corpo
+	var body []byte
+	if step.NeedsBody() {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxAssertBody))
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	duration := time.Since(start)
 	if err != nil {
 		return RequestResult{
+			Step:     step.Name,
 			Duration: duration,
 			Error:    err,
 		}
 	}
-	defer resp.Body.Close()
 
 	return RequestResult{
-		StatusCode: resp.StatusCode,
-		Duration:   duration,
-		Error:      nil,
+		StatusCode:     resp.StatusCode,
+		Duration:       duration,
+		Error:          nil,
+		Step:           step.Name,
+		AssertionError: step.Check(resp.StatusCode, body, duration),
 	}
 }
 
@@ -107,20 +173,58 @@ func (lt *LoadTester) makeRequest() RequestResult {
 func (lt *LoadTester) collectResults(results chan RequestResult) Report {
 	report := Report{
 		StatusCodes: make(map[int]int),
+		Steps:       make(map[string]StepReport),
+		Latency:     NewHistogram(),
+		// Criados no primeiro registro de cada código de status
+		LatencyByStatus: make(map[int]*Histogram),
 	}
 
 	for result := range results {
 		report.TotalRequests++
 
+		step, exists := report.Steps[result.Step]
+		if !exists {
+			step = StepReport{StatusCodes: make(map[int]int), Failures: make(map[string]int)}
+		}
+		step.Requests++
+
+		// Requisições não enviadas não têm latência nem código de status
+		if result.NotSent {
+			report.NotSent++
+			if report.NotSentError == nil {
+				report.NotSentError = result.Error
+			}
+			step.NotSent++
+			report.Steps[result.Step] = step
+			continue
+		}
+
+		statusCode := result.StatusCode
+		if result.Error != nil {
+			statusCode = 0
+		}
+		report.Latency.Record(result.Duration)
+		if report.LatencyByStatus[statusCode] == nil {
+			report.LatencyByStatus[statusCode] = NewHistogram()
+		}
+		report.LatencyByStatus[statusCode].Record(result.Duration)
+
 		if result.Error != nil {
 			report.FailedRequests++
 			report.StatusCodes[0]++ // Código 0 para erros
+			step.StatusCodes[0]++
 		} else {
 			report.StatusCodes[result.StatusCode]++
+			step.StatusCodes[result.StatusCode]++
 			if result.StatusCode == 200 {
 				report.Status200++
 			}
+			if result.AssertionError != nil {
+				step.AssertionFailures++
+				step.Failures[result.AssertionError.Error()]++
+			}
 		}
+		report.Steps[result.Step] = step
 	}
 
 	if report.TotalRequests > 0 {
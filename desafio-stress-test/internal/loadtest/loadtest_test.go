@@ -0,0 +1,41 @@
+package loadtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCollectResults(t *testing.T) {
+	results := make(chan RequestResult, 4)
+	results <- RequestResult{Step: "listar", StatusCode: 200, Duration: 10 * time.Millisecond}
+	results <- RequestResult{Step: "listar", StatusCode: 500, Duration: 20 * time.Millisecond, AssertionError: errors.New("status 500 fora de [200]")}
+	results <- RequestResult{Step: "criar", Duration: 30 * time.Millisecond, Error: errors.New("connection refused")}
+	results <- RequestResult{Step: "criar", Error: errors.New("url relativa sem base_url"), NotSent: true}
+	close(results)
+
+	report := (&LoadTester{}).collectResults(results)
+
+	if report.TotalRequests != 4 || report.Status200 != 1 || report.FailedRequests != 1 || report.NotSent != 1 {
+		t.Errorf("totais inesperados: %d requests, %d com 200, %d com erro, %d não enviados",
+			report.TotalRequests, report.Status200, report.FailedRequests, report.NotSent)
+	}
+	if report.NotSentError == nil || report.NotSentError.Error() != "url relativa sem base_url" {
+		t.Errorf("erro das requisições não enviadas inesperado: %v", report.NotSentError)
+	}
+
+	// As requisições não enviadas ficam fora da latência e dos erros de conexão
+	if report.Latency.Count() != 3 || report.Latency.Min() != 10*time.Millisecond {
+		t.Errorf("latência com %d durações a partir de %v", report.Latency.Count(), report.Latency.Min())
+	}
+	if report.StatusCodes[0] != 1 || report.LatencyByStatus[0].Count() != 1 {
+		t.Errorf("erros de conexão: %d, com latência: %d", report.StatusCodes[0], report.LatencyByStatus[0].Count())
+	}
+
+	if step := report.Steps["criar"]; step.Requests != 2 || step.NotSent != 1 || step.StatusCodes[0] != 1 {
+		t.Errorf("passo criar inesperado: %+v", step)
+	}
+	if step := report.Steps["listar"]; step.AssertionFailures != 1 || step.Failures["status 500 fora de [200]"] != 1 {
+		t.Errorf("passo listar inesperado: %+v", step)
+	}
+}
@@ -2,10 +2,20 @@ package reporter
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/lucasafonsokremer/goexpert/desafio-stress-test/internal/loadtest"
 )
 
+// histogramBars é o número de faixas do histograma de latência e
+// histogramWidth a largura da maior barra
+const (
+	histogramBars  = 10
+	histogramWidth = 40
+)
+
 // Reporter é responsável por exibir os relatórios
 type Reporter struct{}
 
@@ -27,6 +37,9 @@ func (r *Reporter) Print(report loadtest.Report) {
 	if report.FailedRequests > 0 {
 		fmt.Printf("Requests com erro: %d\n", report.FailedRequests)
 	}
+	if report.NotSent > 0 {
+		fmt.Printf("Requests não enviados: %d (ex: %v)\n", report.NotSent, report.NotSentError)
+	}
 
 	fmt.Println("\nDistribuição de códigos de status HTTP:")
 	for statusCode, count := range report.StatusCodes {
@@ -37,5 +50,115 @@ func (r *Reporter) Print(report loadtest.Report) {
 		}
 	}
 
+	r.printLatency(report)
+	r.printSteps(report)
+
 	fmt.Println("\n==========================================")
 }
+
+// printLatency exibe as estatísticas de latência de todas as requisições e de
+// cada código de status, seguidas do histograma de todas as requisições
+func (r *Reporter) printLatency(report loadtest.Report) {
+	if report.Latency == nil || report.Latency.Count() == 0 {
+		return
+	}
+
+	fmt.Println("\nLatência:")
+	printLatencyStats("  Todas", report.Latency)
+
+	codes := make([]int, 0, len(report.LatencyByStatus))
+	for statusCode := range report.LatencyByStatus {
+		codes = append(codes, statusCode)
+	}
+	sort.Ints(codes)
+	for _, statusCode := range codes {
+		label := fmt.Sprintf("  HTTP %d", statusCode)
+		if statusCode == 0 {
+			label = "  Erros de conexão"
+		}
+		printLatencyStats(label, report.LatencyByStatus[statusCode])
+	}
+
+	fmt.Println("\nHistograma de latência:")
+	bars := report.Latency.Bars(histogramBars)
+	var highest int64
+	for _, bar := range bars {
+		highest = max(highest, bar.Count)
+	}
+	for _, bar := range bars {
+		width := int(bar.Count * histogramWidth / highest)
+		if width == 0 && bar.Count > 0 {
+			width = 1
+		}
+		fmt.Printf("  %10v - %-10v | %-*s %d\n", round(bar.From), round(bar.To), histogramWidth, strings.Repeat("#", width), bar.Count)
+	}
+}
+
+// printLatencyStats exibe o resumo de um histograma em duas linhas
+func printLatencyStats(label string, h *loadtest.Histogram) {
+	fmt.Printf("%s (%d requests):\n", label, h.Count())
+	fmt.Printf("    min: %v | média: %v | max: %v | desvio padrão: %v\n",
+		round(h.Min()), round(h.Mean()), round(h.Max()), round(h.StdDev()))
+	fmt.Printf("    p50: %v | p90: %v | p95: %v | p99: %v | p99.9: %v\n",
+		round(h.Percentile(50)), round(h.Percentile(90)), round(h.Percentile(95)), round(h.Percentile(99)), round(h.Percentile(99.9)))
+}
+
+// round arredonda as durações para exibição, com três algarismos significativos
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= 100*time.Millisecond:
+		return d.Round(time.Millisecond)
+	case d >= 10*time.Millisecond:
+		return d.Round(100 * time.Microsecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
+
+// printSteps exibe os resultados de cada passo do cenário, quando há mais de
+// um passo ou alguma verificação falhou
+func (r *Reporter) printSteps(report loadtest.Report) {
+	names := make([]string, 0, len(report.Steps))
+	failed := false
+	for name, step := range report.Steps {
+		names = append(names, name)
+		failed = failed || step.AssertionFailures > 0
+	}
+	if len(names) <= 1 && !failed {
+		return
+	}
+	sort.Strings(names)
+
+	fmt.Println("\nResultados por passo:")
+	for _, name := range names {
+		step := report.Steps[name]
+		fmt.Printf("  %s: %d requests\n", name, step.Requests)
+
+		codes := make([]int, 0, len(step.StatusCodes))
+		for statusCode := range step.StatusCodes {
+			codes = append(codes, statusCode)
+		}
+		sort.Ints(codes)
+		for _, statusCode := range codes {
+			if statusCode == 0 {
+				fmt.Printf("    Erros de conexão: %d\n", step.StatusCodes[statusCode])
+			} else {
+				fmt.Printf("    HTTP %d: %d\n", statusCode, step.StatusCodes[statusCode])
+			}
+		}
+		if step.NotSent > 0 {
+			fmt.Printf("    Não enviados: %d\n", step.NotSent)
+		}
+
+		if step.AssertionFailures > 0 {
+			fmt.Printf("    Verificações com falha: %d\n", step.AssertionFailures)
+			for failure, count := range step.Failures {
+				fmt.Printf("      %s: %d\n", failure, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package scenario
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario descreve um mix de requisições a ser executado no teste de carga.
+// Cada requisição sorteia um dos passos de acordo com o peso de cada um.
+type Scenario struct {
+	// BaseURL é a base das URLs relativas dos passos, ex: http://localhost:8080
+	BaseURL string `json:"base_url" yaml:"base_url"`
+	// Headers são enviados em todas as requisições, os headers do passo têm
+	// precedência. Os valores são templates, como os dos passos.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Steps   []Step            `json:"steps" yaml:"steps"`
+
+	headers     map[string]*template.Template
+	totalWeight int
+}
+
+// Step é um tipo de requisição do cenário. URL, valores dos headers e Body são
+// templates (text/template), ex: {"id": {{randInt 1 1000}}}. A URL é relativa
+// à BaseURL quando o resultado do template não tem esquema (://).
+type Step struct {
+	Name string `json:"name" yaml:"name"`
+	// Weight é o peso do passo no sorteio, 1 quando omitido
+	Weight  int               `json:"weight" yaml:"weight"`
+	Method  string            `json:"method" yaml:"method"`
+	URL     string            `json:"url" yaml:"url"`
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Body    string            `json:"body" yaml:"body"`
+	Assert  Assertions        `json:"assert" yaml:"assert"`
+
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// Assertions são as verificações aplicadas à resposta de cada requisição do passo
+type Assertions struct {
+	// Status são os códigos aceitos, qualquer código quando vazio
+	Status []int `json:"status" yaml:"status"`
+	// BodyContains é um texto que o corpo da resposta deve conter
+	BodyContains string `json:"body_contains" yaml:"body_contains"`
+	// MaxDuration é o tempo máximo da requisição
+	MaxDuration Duration `json:"max_duration" yaml:"max_duration"`
+}
+
+// Duration é um time.Duration escrito como string, ex: "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// TemplateData são os dados disponíveis nos templates dos passos
+type TemplateData struct {
+	// Index é o número da requisição no teste, a partir de 0
+	Index int
+	// Step é o nome do passo
+	Step string
+}
+
+// funcs são as funções disponíveis nos templates dos passos
+var funcs = template.FuncMap{
+	// randInt retorna um número aleatório entre from e to, inclusive
+	"randInt": func(from, to int) int {
+		if to <= from {
+			return from
+		}
+		return from + mathrand.Intn(to-from+1)
+	},
+	// uuid retorna um UUID v4 aleatório
+	"uuid": func() string {
+		var b [16]byte
+		rand.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+	// now retorna o horário atual no formato RFC 3339
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	// env retorna o valor de uma variável de ambiente, ex: um token de API
+	"env": os.Getenv,
+}
+
+// Load lê e valida o arquivo de cenário. Arquivos terminados em ".json" são
+// lidos como JSON, os demais como YAML.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler o cenário: %w", err)
+	}
+
+	var s Scenario
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&s)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cenário inválido %s: %w", path, err)
+	}
+
+	if err := s.Compile(); err != nil {
+		return nil, fmt.Errorf("cenário inválido %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// FromURL cria um cenário com um único GET para a URL
+func FromURL(url string) (*Scenario, error) {
+	s := &Scenario{Steps: []Step{{Method: http.MethodGet, URL: url}}}
+	if err := s.Compile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Compile valida o cenário, completa os valores padrão dos passos e compila
+// os templates. Deve ser chamado antes de Pick e NewRequest.
+func (s *Scenario) Compile() error {
+	if len(s.Steps) == 0 {
+		return errors.New("o cenário precisa de ao menos um passo")
+	}
+
+	headers, err := compileHeaders(s.Headers)
+	if err != nil {
+		return fmt.Errorf("headers: %w", err)
+	}
+	s.headers = headers
+
+	s.totalWeight = 0
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if err := step.compile(s.BaseURL); err != nil {
+			name := step.Name
+			if name == "" {
+				name = fmt.Sprintf("steps[%d]", i)
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		s.totalWeight += step.Weight
+	}
+	return nil
+}
+
+func (step *Step) compile(baseURL string) error {
+	if step.Weight < 0 {
+		return errors.New("o peso não pode ser negativo")
+	}
+	if step.Weight == 0 {
+		step.Weight = 1
+	}
+	step.Method = strings.ToUpper(step.Method)
+	if step.Method == "" {
+		step.Method = http.MethodGet
+	}
+
+	if step.URL == "" {
+		return errors.New("url é obrigatória")
+	}
+	// URLs com templates só são resolvidas em NewRequest, após o template
+	if baseURL == "" && !isAbsolute(step.URL) && !strings.Contains(step.URL, "{{") {
+		return fmt.Errorf("url relativa %q sem base_url", step.URL)
+	}
+	if step.Name == "" {
+		step.Name = step.Method + " " + step.URL
+	}
+
+	var err error
+	if step.url, err = template.New("url").Funcs(funcs).Parse(step.URL); err != nil {
+		return err
+	}
+	if step.body, err = template.New("body").Funcs(funcs).Parse(step.Body); err != nil {
+		return err
+	}
+	if step.headers, err = compileHeaders(step.Headers); err != nil {
+		return err
+	}
+
+	for _, status := range step.Assert.Status {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("código de status inválido: %d", status)
+		}
+	}
+	return nil
+}
+
+func compileHeaders(headers map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(headers))
+	for name, value := range headers {
+		tmpl, err := template.New(name).Funcs(funcs).Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// isAbsolute informa se a URL tem esquema, ex: http://
+func isAbsolute(url string) bool {
+	return strings.Contains(url, "://")
+}
+
+// Pick sorteia um passo de acordo com os pesos
+func (s *Scenario) Pick() *Step {
+	n := mathrand.Intn(s.totalWeight)
+	for i := range s.Steps {
+		if n < s.Steps[i].Weight {
+			return &s.Steps[i]
+		}
+		n -= s.Steps[i].Weight
+	}
+	return &s.Steps[len(s.Steps)-1]
+}
+
+// NewRequest monta a requisição do passo, aplicando os templates com os dados
+// da requisição e os headers comuns do cenário
+func (s *Scenario) NewRequest(step *Step, data TemplateData) (*http.Request, error) {
+	data.Step = step.Name
+	url, err := execute(step.url, data)
+	if err != nil {
+		return nil, err
+	}
+	if !isAbsolute(url) {
+		if s.BaseURL == "" {
+			return nil, fmt.Errorf("url relativa %q sem base_url", url)
+		}
+		url = strings.TrimSuffix(s.BaseURL, "/") + "/" + strings.TrimPrefix(url, "/")
+	}
+	body, err := execute(step.body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(step.Method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Os headers do passo são aplicados por último para ter precedência
+	for _, headers := range []map[string]*template.Template{s.headers, step.headers} {
+		for name, tmpl := range headers {
+			value, err := execute(tmpl, data)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set(name, value)
+		}
+	}
+	return req, nil
+}
+
+func execute(tmpl *template.Template, data TemplateData) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// NeedsBody informa se as verificações do passo precisam do corpo da resposta
+func (step *Step) NeedsBody() bool {
+	return step.Assert.BodyContains != ""
+}
+
+// Check aplica as verificações do passo à resposta, retornando a primeira que
+// falhou
+func (step *Step) Check(statusCode int, body []byte, duration time.Duration) error {
+	if len(step.Assert.Status) > 0 && !contains(step.Assert.Status, statusCode) {
+		return fmt.Errorf("status %d fora de %v", statusCode, step.Assert.Status)
+	}
+	if step.Assert.BodyContains != "" && !bytes.Contains(body, []byte(step.Assert.BodyContains)) {
+		return fmt.Errorf("corpo não contém %q", step.Assert.BodyContains)
+	}
+	if limit := time.Duration(step.Assert.MaxDuration); limit > 0 && duration > limit {
+		return fmt.Errorf("duração acima de %v", limit)
+	}
+	return nil
+}
+
+func contains(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
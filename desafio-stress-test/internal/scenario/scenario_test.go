@@ -0,0 +1,289 @@
+package scenario
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		err  string
+	}{
+		{
+			name: "yaml",
+			file: "scenario.yaml",
+			data: "base_url: http://localhost:8080\nsteps:\n  - url: /orders\n",
+		},
+		{
+			name: "json",
+			file: "scenario.json",
+			data: `{"steps": [{"url": "http://localhost:8080/orders"}]}`,
+		},
+		{
+			name: "unknown yaml field",
+			file: "scenario.yaml",
+			data: "steps:\n  - url: http://localhost:8080\n    wieght: 2\n",
+			err:  "wieght",
+		},
+		{
+			name: "unknown json field",
+			file: "scenario.json",
+			data: `{"steps": [{"url": "http://localhost:8080", "wieght": 2}]}`,
+			err:  "wieght",
+		},
+		{
+			name: "invalid duration",
+			file: "scenario.yaml",
+			data: "steps:\n  - url: http://localhost:8080\n    assert:\n      max_duration: fast\n",
+			err:  "fast",
+		},
+		{
+			name: "no steps",
+			file: "scenario.yaml",
+			data: "base_url: http://localhost:8080\n",
+			err:  "ao menos um passo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Load(path)
+			checkError(t, err, tt.err)
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("esperava erro para arquivo inexistente")
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario Scenario
+		err      string
+	}{
+		{
+			name:     "relative url",
+			scenario: Scenario{BaseURL: "http://localhost:8080", Steps: []Step{{URL: "/orders"}}},
+		},
+		{
+			name:     "templated url without base_url",
+			scenario: Scenario{Steps: []Step{{URL: `{{env "API_URL"}}/orders`}}},
+		},
+		{
+			name:     "relative url without base_url",
+			scenario: Scenario{Steps: []Step{{URL: "/orders"}}},
+			err:      "sem base_url",
+		},
+		{
+			name:     "missing url",
+			scenario: Scenario{Steps: []Step{{Name: "listar"}}},
+			err:      "listar: url é obrigatória",
+		},
+		{
+			name:     "negative weight",
+			scenario: Scenario{Steps: []Step{{URL: "http://localhost", Weight: -1}}},
+			err:      "steps[0]: o peso não pode ser negativo",
+		},
+		{
+			name:     "invalid url template",
+			scenario: Scenario{Steps: []Step{{URL: "http://localhost/{{.Index"}}},
+			err:      "unclosed action",
+		},
+		{
+			name:     "invalid body template",
+			scenario: Scenario{Steps: []Step{{URL: "http://localhost", Body: "{{randInt}"}}},
+			err:      "body",
+		},
+		{
+			name:     "unknown template function",
+			scenario: Scenario{Steps: []Step{{URL: "http://localhost", Headers: map[string]string{"X-Id": "{{random}}"}}}},
+			err:      "random",
+		},
+		{
+			name:     "invalid scenario header template",
+			scenario: Scenario{Headers: map[string]string{"Authorization": "Bearer {{env"}, Steps: []Step{{URL: "http://localhost"}}},
+			err:      "headers",
+		},
+		{
+			name:     "invalid status",
+			scenario: Scenario{Steps: []Step{{URL: "http://localhost", Assert: Assertions{Status: []int{42}}}}},
+			err:      "código de status inválido: 42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkError(t, tt.scenario.Compile(), tt.err)
+		})
+	}
+}
+
+func TestCompileDefaults(t *testing.T) {
+	s := Scenario{Steps: []Step{{URL: "http://localhost/orders", Method: "post"}}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	step := s.Steps[0]
+	if step.Method != "POST" || step.Weight != 1 || step.Name != "POST http://localhost/orders" {
+		t.Errorf("padrões inesperados: method %q, weight %d, name %q", step.Method, step.Weight, step.Name)
+	}
+}
+
+func TestPick(t *testing.T) {
+	s := Scenario{Steps: []Step{
+		{Name: "a", URL: "http://localhost/a", Weight: 1},
+		{Name: "b", URL: "http://localhost/b", Weight: 3},
+		{Name: "c", URL: "http://localhost/c", Weight: 6},
+	}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	const picks = 100000
+	counts := map[string]int{}
+	for i := 0; i < picks; i++ {
+		counts[s.Pick().Name]++
+	}
+
+	// Cada passo deve ser sorteado na proporção do seu peso, com folga para
+	// a variação aleatória (o desvio padrão é inferior a 0,2%)
+	for name, weight := range map[string]int{"a": 1, "b": 3, "c": 6} {
+		got := float64(counts[name]) / picks
+		want := float64(weight) / 10
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("passo %s sorteado em %.3f das vezes, esperava %.3f", name, got, want)
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	t.Setenv("SCENARIO_TOKEN", "abc123")
+	t.Setenv("SCENARIO_URL", "http://api.local:9000")
+	s := Scenario{
+		BaseURL: "http://localhost:8080/",
+		Headers: map[string]string{
+			"Authorization": `Bearer {{env "SCENARIO_TOKEN"}}`,
+			"Accept":        "application/json",
+		},
+		Steps: []Step{
+			{
+				Name:    "criar",
+				Method:  "POST",
+				URL:     "/orders/{{.Index}}",
+				Headers: map[string]string{"Accept": "text/plain", "X-Step": "{{.Step}}"},
+				Body:    `{"index": {{.Index}}}`,
+			},
+			{URL: `{{env "SCENARIO_URL"}}/health`},
+		},
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := s.NewRequest(&s.Steps[0], TemplateData{Index: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" || req.URL.String() != "http://localhost:8080/orders/7" {
+		t.Errorf("requisição inesperada: %s %s", req.Method, req.URL)
+	}
+	for name, want := range map[string]string{
+		"Authorization": "Bearer abc123",
+		"Accept":        "text/plain",
+		"X-Step":        "criar",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("header %s = %q, esperava %q", name, got, want)
+		}
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"index": 7}` {
+		t.Errorf("corpo inesperado: %s", body)
+	}
+
+	// A URL gerada pelo template é absoluta, então a base_url não é aplicada
+	req, err = s.NewRequest(&s.Steps[1], TemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "http://api.local:9000/health" {
+		t.Errorf("URL inesperada: %s", req.URL)
+	}
+	if req.Body != nil {
+		t.Error("requisição sem corpo não deveria ter body")
+	}
+}
+
+func TestNewRequestRelativeTemplateWithoutBaseURL(t *testing.T) {
+	t.Setenv("SCENARIO_PATH", "/orders")
+	s := Scenario{Steps: []Step{{URL: `{{env "SCENARIO_PATH"}}`}}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.NewRequest(&s.Steps[0], TemplateData{})
+	checkError(t, err, `url relativa "/orders" sem base_url`)
+}
+
+func TestCheck(t *testing.T) {
+	step := Step{Assert: Assertions{
+		Status:       []int{200, 201},
+		BodyContains: "ok",
+		MaxDuration:  Duration(100 * time.Millisecond),
+	}}
+
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		duration time.Duration
+		err      string
+	}{
+		{name: "passes", status: 201, body: `{"status": "ok"}`, duration: 50 * time.Millisecond},
+		{name: "status", status: 500, body: "ok", err: "status 500 fora de [200 201]"},
+		{name: "body", status: 200, body: "erro", err: `corpo não contém "ok"`},
+		{name: "duration", status: 200, body: "ok", duration: time.Second, err: "duração acima de 100ms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkError(t, step.Check(tt.status, []byte(tt.body), tt.duration), tt.err)
+		})
+	}
+
+	if err := (&Step{}).Check(500, nil, time.Hour); err != nil {
+		t.Errorf("passo sem verificações falhou: %v", err)
+	}
+	if !step.NeedsBody() || (&Step{}).NeedsBody() {
+		t.Error("NeedsBody deve depender de body_contains")
+	}
+}
+
+// checkError verifica que err contém want, ou que é nil quando want é vazio
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("erro inesperado: %v", err)
+	case want != "" && err == nil:
+		t.Errorf("esperava erro contendo %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Errorf("erro %q não contém %q", err, want)
+	}
+}